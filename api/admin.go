@@ -0,0 +1,65 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	s "strings"
+
+	"github.com/gorilla/mux"
+
+	"plexcache/models"
+	redisH "plexcache/redis"
+)
+
+type Stats struct {
+	DryRun      bool         `json:"dryRun"`
+	Usage       models.Usage `json:"usage"`
+	RetryQueue  int64        `json:"retryQueue"`
+	DeadLetters int64        `json:"deadLetters"`
+}
+
+// StatsHandler reports the cache usage recorded in redis.
+func StatsHandler(deps Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		usage, err := redisH.GetUsage(r.Context(), deps.Redis)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		queued, dead, err := redisH.RetryQueueLength(r.Context(), deps.Redis)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Stats{DryRun: deps.DryRun, Usage: usage, RetryQueue: queued, DeadLetters: dead})
+	}
+}
+
+// AdminAuth lets requests through that carry the token as bearer token in
+// their Authorization header. Without a token the admin API is turned off,
+// as it would otherwise be open to anyone who can send webhooks.
+func AdminAuth(token string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				http.Error(w, "the admin API is off, set ADMIN_TOKEN", http.StatusForbidden)
+				return
+			}
+
+			given, ok := s.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="plex-cache admin"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
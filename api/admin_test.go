@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, tc := range []struct {
+		token, authorization string
+		want                 int
+	}{
+		{"secret", "Bearer secret", http.StatusOK},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		{"secret", "", http.StatusUnauthorized},
+		{"", "Bearer ", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/jobs/1-202", nil)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+
+		rec := httptest.NewRecorder()
+		AdminAuth(tc.token)(ok).ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("token %q with %q: got status %d, want %d", tc.token, tc.authorization, rec.Code, tc.want)
+		}
+	}
+}
@@ -3,55 +3,42 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"slices"
 	s "strings"
+	"time"
 
+	"plexcache/logging"
+	"plexcache/metrics"
 	"plexcache/models"
 	"plexcache/plex"
+	"plexcache/policy"
 	redisH "plexcache/redis"
+	"plexcache/tracing"
 	"plexcache/utils"
 
-	"github.com/LukeHagar/plexgo"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func isCacheableEvent(payload models.Payload) bool {
-	log.Println("payload event", payload.Event)
-	return payload.Event == "media.resume" || payload.Event == "media.play"
+// canCache runs the admission rules of the policy for the webhook.
+func canCache(pol *policy.Policy, payload models.Payload, history models.ShowHistory) (policy.Decision, error) {
+	return pol.Admit(policy.Input{Payload: payload, History: history})
 }
 
-func isShow(payload models.Payload) bool {
-	return payload.Metadata.LibrarySectionType == "show"
-}
-
-// skipping first episode of season 1 to be sure user likes serie
-func isCacheableEpisode(payload models.Payload) bool {
-	return payload.Metadata.ParentIndex != 1 && payload.Metadata.Index != 1
-}
-
-func canCache(payload models.Payload) bool {
-	if !isCacheableEvent(payload) || !isShow(payload) || !isCacheableEpisode(payload) {
-		return false
-	}
-
-	return true
-}
+func isAlreadyCached(ctx context.Context, lookup Lookup, payload models.Payload) bool {
+	episodeCache, found, err := lookup.CachedEpisode(ctx, payload.Metadata.RatingKey)
 
-func isAlreadyCached(rdb *redis.Client, payload models.Payload) bool {
-	ctx := context.Background()
-	storedValue, err := rdb.Get(ctx, payload.Metadata.RatingKey).Result()
-
-	if err == redis.Nil {
-		return false
-	} else if err != nil {
-		log.Println("Error retriving from redis", err)
+	if err != nil {
+		slog.ErrorContext(ctx, "could not read the cache record", "ratingKey", payload.Metadata.RatingKey, "err", err)
 		return false
-	}
-
-	var episodeCache models.EpisodeCache
-	if err := json.Unmarshal([]byte(storedValue), &episodeCache); err != nil {
+	} else if !found {
 		return false
 	}
 
@@ -64,9 +51,14 @@ func isAlreadyCached(rdb *redis.Client, payload models.Payload) bool {
 	return true
 }
 
-func parsemodels(r *http.Request) (models.Payload, error) {
-	var payload models.Payload
-	err := r.ParseMultipartForm(10 << 20) // 10 MB
+func parsemodels(ctx context.Context, r *http.Request) (payload models.Payload, err error) {
+	ctx, span := tracing.Start(ctx, "parsemodels", attribute.Int64("bytes", r.ContentLength))
+	defer func() {
+		span.SetAttributes(attribute.String("event", payload.Event), attribute.String("ratingKey", payload.Metadata.RatingKey))
+		tracing.End(span, err)
+	}()
+
+	err = r.ParseMultipartForm(10 << 20) // 10 MB
 
 	if err != nil {
 		return payload, err
@@ -79,131 +71,506 @@ func parsemodels(r *http.Request) (models.Payload, error) {
 
 	err = json.Unmarshal([]byte(payloadStr), &payload)
 	if err != nil {
-		log.Println("Error decoding JSON:", err)
+		slog.WarnContext(ctx, "could not decode the payload", "err", err)
 	}
 
 	return payload, nil
 }
 
-func copyEpisodes(episodesToCache []models.EpisodeCache) error {
-	destination := "/cache"
+// copyEpisodes copies the files of the episodes and their subtitles in order and
+// returns how many were copied.
+func copyEpisodes(ctx context.Context, deps Deps, episodesToCache []models.EpisodeCache) (int, error) {
+	destination := deps.CacheRoot
 
-	for _, item := range episodesToCache {
-		log.Print("copy: ", item.EpisodeFilePath)
-		log.Print("to: ", destination+item.EpisodeFilePath)
+	for i, item := range episodesToCache {
+		// copied by an earlier job with the same files, see mergeRecord
+		if item.Copied && (deps.DryRun || copiesExist(destination, item)) {
+			slog.DebugContext(ctx, "already copied", "ratingKey", item.RatingKey, "episode", item.Title)
+			continue
+		}
 
-		err := utils.CopyFile(item.EpisodeFilePath, destination+item.EpisodeFilePath)
+		// before copying, so a change during the copy is noticed
+		item.Sources = sourceStats(ctx, item, deps.HashSources)
 
-		if err != nil {
-			return fmt.Errorf("failed to copy %s", item.Title)
+		if deps.DryRun {
+			for _, file := range item.Files() {
+				slog.InfoContext(ctx, "dry-run: would copy", "from", file.Path, "to", destination+file.Path)
+			}
+			markCopied(ctx, deps, item)
+			continue
 		}
 
-		for _, srtPath := range item.SrtFilePaths {
-			log.Print("copy srt: ", srtPath)
-			log.Print("to: ", destination+srtPath)
-			err := utils.CopyFile(srtPath, destination+srtPath)
+		files := item.Files()
+		for j, file := range files {
+			slog.InfoContext(ctx, "copy", "from", file.Path, "to", destination+file.Path)
+			copied, err := deps.Jobs.copyOnce(ctx, file.Path, destination+file.Path, file.Size)
 
 			if err != nil {
-				return fmt.Errorf("failed to copy %s", srtPath)
+				return i, fmt.Errorf("failed to copy %s: %w", item.Title, err)
 			}
+			files[j].Size, files[j].Hash = copied.Bytes, copied.Hash
 		}
 
+		var sidecarBytes int64
+		for _, sidecar := range item.Sidecars() {
+			slog.InfoContext(ctx, "copy sidecar", "from", sidecar, "to", destination+sidecar)
+			copied, err := deps.Jobs.copyOnce(ctx, sidecar, destination+sidecar, 0)
+
+			if err != nil {
+				return i, fmt.Errorf("failed to copy %s: %w", sidecar, err)
+			}
+			sidecarBytes += copied.Bytes
+		}
+
+		copiedItem := item
+		copiedItem.SetFiles(files)
+		copiedItem.SidecarSize = sidecarBytes
+		markCopied(ctx, deps, copiedItem)
 	}
 
-	return nil
+	return len(episodesToCache), nil
 }
 
-func getSrtPaths(episodePath string, container string, stream []models.StreamPart) []string {
-	var srtFilePaths []string
-	for _, item := range stream {
-		if item.Format == "srt" {
-			srtFilePaths = append(srtFilePaths, s.Replace(episodePath, container, item.LanguageTag+"."+item.Format, 1))
+// copiesExist tells whether the files and sidecars of an episode are in the
+// cache.
+func copiesExist(destination string, item models.EpisodeCache) bool {
+	for _, file := range item.Files() {
+		if _, err := os.Stat(destination + file.Path); err != nil {
+			return false
+		}
+	}
+	for _, sidecar := range item.Sidecars() {
+		if _, err := os.Stat(destination + sidecar); err != nil {
+			return false
 		}
 	}
 
-	return srtFilePaths
+	return true
 }
 
-func formatEpisodePath(episodePath string) string {
-	return s.Replace(episodePath, "/data/tvshows", "/media/tvshows", 1)
+// markCopied flags a cache record as complete so plays of it count as hits,
+// with the sizes and hashes of the copies. The file is there even when the
+// job was just cancelled, so the record is updated regardless.
+func markCopied(ctx context.Context, deps Deps, item models.EpisodeCache) {
+	item.Copied = true
+	if err := redisH.UpdateCopiedEpisode(context.WithoutCancel(ctx), deps.Redis, item); err != nil {
+		slog.ErrorContext(ctx, "could not mark copied", "ratingKey", item.RatingKey, "err", err)
+		return
+	}
+	deps.Sources.add(ctx, item)
 }
 
-func getEpisodeCache(payload models.Payload, seasonMetadata models.SeasonMetadataResponse) []models.EpisodeCache {
-	startIndex := payload.Metadata.Index + 1
-	endIndex := payload.Metadata.Index + 4
+// DefaultPaths maps the tvshows folder of the Plex container to the media
+// mount of the plex-cache container.
+var DefaultPaths = []models.PathMapping{{Plex: "/data/tvshows", Local: "/media/tvshows"}}
+
+func formatEpisodePath(paths []models.PathMapping, episodePath string) string {
+	for _, mapping := range paths {
+		if s.HasPrefix(episodePath, mapping.Plex) {
+			return mapping.Local + s.TrimPrefix(episodePath, mapping.Plex)
+		}
+	}
+
+	return episodePath
+}
+
+// getEpisodeCache builds the records of the episodes in the window, with
+// every part of the versions picked. Episodes without a media file are left
+// out and returned as reasons.
+func getEpisodeCache(server string, payload models.Payload, seasonMetadata models.SeasonMetadataResponse, window policy.Window, paths []models.PathMapping, versions versionPicker) ([]models.EpisodeCache, []string) {
+	startIndex := payload.Metadata.Index + window.Offset
+	endIndex := startIndex + window.Count - 1
 
 	var episodesToCache []models.EpisodeCache
+	var skipped []string
 	for _, item := range seasonMetadata.MediaContainer.Metadata {
 		if item.Index >= startIndex && item.Index <= endIndex {
 
+			var files []models.CachedFile
+			var sidecars []string
+			for _, media := range versions.pick(item.Media) {
+				for _, part := range media.Part {
+					if part.File == "" {
+						continue
+					}
+
+					file := formatEpisodePath(paths, part.File)
+					files = append(files, models.CachedFile{Path: file, Size: part.Size})
+					for _, sidecar := range findSidecars(paths, file, part.Stream) {
+						if !slices.Contains(sidecars, sidecar) {
+							sidecars = append(sidecars, sidecar)
+						}
+					}
+				}
+			}
+
+			if len(files) == 0 {
+				skipped = append(skipped, fmt.Sprintf("episode %d %q has no media file", item.Index, item.Title))
+				continue
+			}
+
 			tmp := models.EpisodeCache{
+				Server:               server,
 				RatingKey:            item.RatingKey,
 				ParentRatingKey:      item.ParentRatingKey,
 				GrandparentRatingKey: item.GrandparentRatingKey,
+				GrandparentTitle:     item.GrandparentTitle,
 				Title:                item.Title,
 				Index:                item.Index,
 				ParentIndex:          item.ParentIndex,
-				EpisodeFilePath:      formatEpisodePath(item.Media[0].Part[0].File),
-				SrtFilePaths:         getSrtPaths(formatEpisodePath(item.Media[0].Part[0].File), item.Media[0].Part[0].Container, item.Media[0].Part[0].Stream),
+				EpisodeFilePath:      files[0].Path,
+				Size:                 files[0].Size,
+				SidecarFilePaths:     sidecars,
+				SidecarSize:          sidecarSize(sidecars),
 				IsLast:               item.Index == endIndex,
 			}
+			if len(files) > 1 {
+				tmp.Parts = files[1:]
+			}
 
 			episodesToCache = append(episodesToCache, tmp)
 
 		}
 	}
 
-	return episodesToCache
+	return episodesToCache, skipped
 }
 
-func WebhookHandler(rdb *redis.Client, plexApi *plexgo.PlexAPI) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// Deps are the clients and settings shared by the HTTP handlers.
+type Deps struct {
+	Redis *redis.Client
+	Plex  plex.MetadataClient
+	// PlexConnection is how Plex is reached, for the readiness check.
+	PlexConnection plex.Connection
+	Policy         *policy.Policy
+	CacheRoot      string
+	Paths          []models.PathMapping
+	// Server is the UUID records are namespaced by, set by ForServer.
+	Server string
+	// Servers maps server UUIDs to their Plex client and path mappings when
+	// plex-cache serves more than one Plex server.
+	Servers map[string]Server
+	// Jobs tracks the caching jobs in progress, nil when not needed.
+	Jobs *Jobs
+	// ShowLockTTL is how long the show lock is kept by a process that
+	// stopped extending it, 0 to not lock.
+	ShowLockTTL time.Duration
+	// Debounce is how long further playback events of an account and show
+	// are ignored, 0 to not debounce.
+	Debounce time.Duration
+	// HashSources records a utils.SampleHash of the sources, so sources
+	// that were only touched are not copied again.
+	HashSources bool
+	// Sources watches the sources of cached episodes, nil when not needed.
+	Sources *SourceWatcher
+	// Versions chooses the versions of episodes with several to cache.
+	Versions VersionPolicy
+	// DryRun processes webhooks and records state as usual but never copies
+	// or removes files.
+	DryRun bool
+	// AdminToken is the bearer token of the admin API, which is off
+	// without one.
+	AdminToken string
+}
+
+// cacheEpisodes records the planned episodes in redis and copies them as a
+// job. Nothing is copied when the records could not be saved. The records
+// and files of the episodes this job did not copy are removed again, also
+// when the job was cancelled, so a later webhook caches them. Episodes an
+// earlier job copied are left alone.
+func cacheEpisodes(ctx context.Context, deps Deps, plan Plan) error {
+	ctx, done, err := deps.Jobs.start(ctx, plan)
+	if err != nil {
+		return err
+	}
+	defer done()
+	slog.InfoContext(ctx, "job started", "episodes", len(plan.Episodes))
+
+	saved, err := redisH.SaveEpisodeCacheToRedis(ctx, deps.Redis, plan.Episodes)
 
-		log.Println("Hook request")
+	// copies without records would never expire
+	if err != nil {
+		slog.ErrorContext(ctx, "could not record the episodes in redis", "err", err)
+		return fmt.Errorf("could not record the episodes: %w", err)
+	}
 
-		payload, err := parsemodels(r)
+	copied, err := copyEpisodes(ctx, deps, saved)
+	slog.InfoContext(ctx, "job finished", "copied", copied, "err", err)
+	if err != nil {
+		// episodes copied by earlier webhooks keep their records and files
+		var uncopied []models.EpisodeCache
+		for _, item := range saved[copied:] {
+			if !item.Copied {
+				uncopied = append(uncopied, item)
+			}
+		}
 
+		unshared, err := redisH.ForgetCachedEpisodes(context.WithoutCancel(ctx), deps.Redis, uncopied)
 		if err != nil {
-			log.Println("could not parse payload")
-			http.Error(w, "No payload found", http.StatusBadRequest)
-			return
+			slog.ErrorContext(ctx, "could not remove records of uncopied episodes", "err", err)
 		}
 
-		if isAlreadyCached(rdb, payload) {
-			log.Println("Already cached")
-			w.WriteHeader(http.StatusOK)
-			return
+		if !deps.DryRun {
+			for _, path := range unshared {
+				if err := utils.RemoveFile(deps.CacheRoot + path); err != nil {
+					slog.ErrorContext(ctx, "failed to remove file", "file", path, "err", err)
+				}
+			}
 		}
+	}
 
-		if !canCache(payload) {
-			log.Println("should not cache")
-			w.WriteHeader(http.StatusOK)
-			return
+	return err
+}
+
+// requestContext carries the id of the request, taken from X-Request-Id or
+// made up, in the log records of everything done for it.
+func requestContext(w http.ResponseWriter, r *http.Request) (context.Context, string) {
+	id := r.Header.Get("X-Request-Id")
+	if id == "" {
+		id = logging.NewID()
+	}
+	w.Header().Set("X-Request-Id", id)
+
+	return logging.With(r.Context(), "request", id), id
+}
+
+// decisionTrace is what was decided for a webhook and why. It is logged as
+// one line and recorded in the journal.
+type decisionTrace struct {
+	payload  models.Payload
+	decision string
+	reason   string
+	episodes int
+
+	requestID string
+	headers   map[string]string
+	replayOf  string
+	dryRun    bool
+}
+
+func (t *decisionTrace) set(decision, reason string) {
+	t.decision = decision
+	t.reason = reason
+}
+
+func (t *decisionTrace) log(ctx context.Context) {
+	level := slog.LevelInfo
+	if t.decision == "error" {
+		level = slog.LevelError
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("event", t.payload.Event),
+		attribute.String("ratingKey", t.payload.Metadata.RatingKey),
+		attribute.String("show", t.payload.Metadata.GrandparentTitle),
+		attribute.String("decision", t.decision),
+		attribute.String("reason", t.reason),
+		attribute.Int("episodes", t.episodes),
+	)
+	if t.decision == "error" {
+		span.SetStatus(codes.Error, t.reason)
+	}
+
+	slog.Log(ctx, level, "webhook",
+		"event", t.payload.Event,
+		"account", t.payload.Account.Title,
+		"show", t.payload.Metadata.GrandparentTitle,
+		"episode", t.payload.Metadata.Title,
+		"decision", t.decision,
+		"reason", t.reason,
+		"episodes", t.episodes,
+	)
+}
+
+// record logs the decision and appends it to the journal.
+func (t *decisionTrace) record(ctx context.Context, deps Deps) models.JournalEntry {
+	t.log(ctx)
+	entry := t.entry()
+
+	id, err := redisH.AppendJournal(context.WithoutCancel(ctx), deps.Redis, entry)
+	if err != nil {
+		slog.ErrorContext(ctx, "could not journal the webhook", "err", err)
+	}
+	entry.ID = id
+
+	return entry
+}
+
+// entry is the journal entry of the webhook, without an id until it is
+// journaled.
+func (t *decisionTrace) entry() models.JournalEntry {
+	return models.JournalEntry{
+		Time:      time.Now().Unix(),
+		RequestID: t.requestID,
+		ReplayOf:  t.replayOf,
+		DryRun:    t.dryRun,
+		Headers:   t.headers,
+		Payload:   t.payload,
+		Decision:  t.decision,
+		Reason:    t.reason,
+		Episodes:  t.episodes,
+	}
+}
+
+// recordShowPlay counts a media.play in the watch history of the show.
+func recordShowPlay(ctx context.Context, deps Deps, payload models.Payload) {
+	if payload.Event != "media.play" || payload.Metadata.LibrarySectionType != "show" {
+		return
+	}
+
+	if err := redisH.RecordShowPlay(ctx, deps.Redis, deps.Server, payload); err != nil {
+		slog.WarnContext(ctx, "could not record play", "err", err)
+	}
+}
+
+// debounced tells whether the account sent a playback event for the show
+// within the debounce window, like the media.resume Plex sends right after
+// a media.play or a webhook Plex sends again.
+func debounced(ctx context.Context, deps Deps, payload models.Payload) bool {
+	if deps.Debounce <= 0 {
+		return false
+	}
+
+	seen, err := redisH.Debounce(ctx, deps.Redis, deps.Server, payload, deps.Debounce)
+	if err != nil {
+		slog.WarnContext(ctx, "could not debounce", "err", err)
+		return false
+	}
+
+	return seen
+}
+
+// lockShow takes the show lock of payload, so only one webhook plans and
+// copies episodes of a show at a time. It returns redisH.ErrLocked while
+// another one holds it. Without redis the webhook goes on unlocked.
+func lockShow(ctx context.Context, deps Deps, payload models.Payload) (func(), error) {
+	if deps.ShowLockTTL <= 0 || payload.Metadata.GrandparentRatingKey == "" {
+		return func() {}, nil
+	}
+
+	lock, err := redisH.AcquireShowLock(ctx, deps.Redis, deps.Server, payload, deps.ShowLockTTL)
+	if errors.Is(err, redisH.ErrLocked) {
+		metrics.Inc("plexcache_show_lock_total", "Show lock attempts by result.", "result", "busy")
+		return nil, err
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "could not lock the show, going on without", "err", err)
+		return func() {}, nil
+	}
+
+	metrics.Inc("plexcache_show_lock_total", "Show lock attempts by result.", "result", "acquired")
+	return func() {
+		if err := lock.Release(context.WithoutCancel(ctx)); err != nil {
+			slog.WarnContext(ctx, "could not release the show lock", "err", err)
 		}
+	}, nil
+}
 
-		seasonMetadata, err := plex.GetSeasonMetadata(plexApi, payload)
+// handleWebhook acts on a webhook, recording what was decided in trace. It
+// returns the status to answer with and, for failures, the error.
+func handleWebhook(ctx context.Context, deps Deps, payload models.Payload, trace *decisionTrace) (int, error) {
+	slog.DebugContext(ctx, "webhook received", "event", payload.Event, "server", payload.Server.UUID, "ratingKey", payload.Metadata.RatingKey)
 
-		if err != nil {
-			log.Println("Failed to parse full episode response", err)
-			http.Error(w, "Failed to parse full episode response", http.StatusBadRequest)
-			return
+	deps, err := deps.ForServer(payload)
+	if err != nil {
+		trace.set("ignored", err.Error())
+		return http.StatusOK, nil
+	}
+
+	if payload.Event == "library.new" || payload.Event == "library.on.deck" {
+		if invalidator, ok := deps.Plex.(plex.Invalidator); ok {
+			invalidator.Invalidate(ctx, payload)
 		}
+	}
 
-		episodesToCache := getEpisodeCache(payload, seasonMetadata)
-		err = redisH.SaveEpisodeCacheToRedis(rdb, episodesToCache)
+	// a replay is no new play, it is neither debounced nor counted
+	replay := trace.replayOf != ""
 
-		if err != nil {
-			log.Println("could not pipe to redis")
+	if !replay && isPlayback(payload) && debounced(ctx, deps, payload) {
+		trace.set("debounced", fmt.Sprintf("another playback event of the show within %s", deps.Debounce))
+		return http.StatusOK, nil
+	}
+
+	if !replay && isPlayback(payload) {
+		recordPlay(ctx, deps, payload)
+	}
+
+	unlock, err := lockShow(ctx, deps, payload)
+	if err != nil {
+		if !replay {
+			recordShowPlay(ctx, deps, payload)
 		}
+		trace.set("deferred", err.Error())
+		deferRetry(ctx, deps, newRetryItem(payload), err)
+		return http.StatusAccepted, nil
+	}
+	defer unlock()
 
-		err = copyEpisodes(episodesToCache)
+	plan, err := PlanCache(ctx, deps, payload)
+
+	if !replay {
+		recordShowPlay(ctx, deps, payload)
+	}
+
+	if plex.IsRetryable(err) {
+		trace.set("deferred", "plex unavailable: "+err.Error())
+		deferRetry(ctx, deps, newRetryItem(payload), err)
+		return http.StatusAccepted, nil
+	}
+
+	if err != nil {
+		trace.set("error", "could not plan: "+err.Error())
+		return http.StatusBadRequest, err
+	}
+
+	if !plan.Cache {
+		trace.set("skip", s.Join(plan.Reasons, "; "))
+		return http.StatusOK, nil
+	}
+	trace.episodes = len(plan.Episodes)
+
+	// the copy goes on when Plex stops waiting for the answer
+	err = cacheEpisodes(context.WithoutCancel(ctx), deps, plan)
+
+	if errors.Is(err, ErrShuttingDown) {
+		trace.set("refused", err.Error())
+		return http.StatusServiceUnavailable, err
+	}
+
+	if err != nil {
+		trace.set("error", "could not move files: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	trace.set("cache", s.Join(plan.Reasons, "; "))
+	return http.StatusOK, nil
+}
+
+func WebhookHandler(deps Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, requestID := requestContext(w, r)
+		ctx, span := tracing.Start(ctx, "WebhookHandler")
+		defer span.End()
+
+		trace := &decisionTrace{requestID: requestID, headers: journalHeaders(r.Header), dryRun: deps.DryRun}
+		defer func() { trace.record(ctx, deps) }()
+
+		payload, err := parsemodels(ctx, r)
+
+		if err != nil {
+			trace.set("invalid", err.Error())
+			http.Error(w, "No payload found", http.StatusBadRequest)
+			return
+		}
+		trace.payload = payload
 
+		status, err := handleWebhook(ctx, deps, payload, trace)
 		if err != nil {
-			log.Println("could not move files", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			http.Error(w, err.Error(), status)
 			return
 		}
 
-		log.Println("request ok")
+		w.WriteHeader(status)
 	}
 }
@@ -0,0 +1,518 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"plexcache/logging"
+	"plexcache/models"
+	"plexcache/plex"
+	"plexcache/plex/plextest"
+	"plexcache/policy"
+	redisH "plexcache/redis"
+	"plexcache/redis/redistest"
+	"plexcache/tracing"
+	"plexcache/tracing/tracingtest"
+
+	"github.com/LukeHagar/plexgo"
+)
+
+type testEnv struct {
+	deps  Deps
+	plex  *plextest.Server
+	redis *redistest.Server
+	media string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	srv := plextest.NewServer(t)
+	media := t.TempDir()
+
+	deps := Deps{
+		Redis: rdb,
+		Plex: plex.NewClient(plexgo.New(
+			plexgo.WithSecurity(plextest.Token),
+			plexgo.WithServerURL(srv.URL),
+		)),
+		Policy:    policy.Default(),
+		CacheRoot: t.TempDir(),
+		Paths:     plextest.CreateMedia(t, media, "200"),
+	}
+
+	return &testEnv{deps: deps, plex: srv, redis: mr, media: media}
+}
+
+func (env *testEnv) webhook(t *testing.T, name string) *httptest.ResponseRecorder {
+	t.Helper()
+	return env.post(t, plextest.Payload(t, name))
+}
+
+func (env *testEnv) post(t *testing.T, payload models.Payload) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	WebhookHandler(env.deps).ServeHTTP(rec, plextest.WebhookRequest(t, "/", payload))
+
+	return rec
+}
+
+// playing returns the media.play fixture for another episode of season 2.
+func playing(t *testing.T, index int) models.Payload {
+	payload := plextest.Payload(t, "media.play")
+	payload.Metadata.RatingKey = fmt.Sprintf("%d", 200+index)
+	payload.Metadata.Index = index
+	return payload
+}
+
+func (env *testEnv) episodePath(index int) string {
+	return filepath.Join(env.media, "Test Show", "Season 02", fmt.Sprintf("Test Show - S02E%02d.mkv", index))
+}
+
+func TestWebhookCachesNextEpisodes(t *testing.T) {
+	env := newTestEnv(t)
+
+	if rec := env.webhook(t, "media.play"); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	for index := 3; index <= 6; index++ {
+		src := env.episodePath(index)
+		info, err := os.Stat(env.deps.CacheRoot + src)
+		if err != nil {
+			t.Fatalf("episode %d not cached: %v", index, err)
+		}
+		if want := int64(1200 + index); info.Size() != want {
+			t.Fatalf("episode %d has %d bytes, want %d", index, info.Size(), want)
+		}
+	}
+
+	for _, index := range []int{3, 5} {
+		srt := env.deps.CacheRoot + env.episodePath(index)[:len(env.episodePath(index))-len("mkv")] + "en.srt"
+		if _, err := os.Stat(srt); err != nil {
+			t.Fatalf("subtitle of episode %d not cached: %v", index, err)
+		}
+	}
+
+	for _, index := range []int{2, 7} {
+		if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(index)); !os.IsNotExist(err) {
+			t.Fatalf("episode %d should not be cached", index)
+		}
+	}
+
+	for key, isLast := range map[string]bool{"203": false, "204": false, "205": false, "206": true} {
+		episode, found, err := redisH.GetCachedEpisode(t.Context(), env.deps.Redis, "", key)
+		if err != nil || !found {
+			t.Fatalf("no cache record for %s: %v", key, err)
+		}
+		if episode.IsLast != isLast || !episode.Copied {
+			t.Fatalf("record %s: isLast %v copied %v", key, episode.IsLast, episode.Copied)
+		}
+
+		if ttl := env.redis.TTL("plex-cache:episode:" + key + ":plex-expirer"); ttl != redisH.CacheTTL {
+			t.Fatalf("expirer of %s has ttl %v", key, ttl)
+		}
+	}
+}
+
+func TestWebhookSkipsAlreadyCached(t *testing.T) {
+	env := newTestEnv(t)
+	env.webhook(t, "media.play")
+	env.post(t, playing(t, 3))
+
+	if got := env.plex.Requests("/library/metadata/200/children"); got != 1 {
+		t.Fatalf("got %d season requests, want 1", got)
+	}
+
+	// the last cached episode lets the next window be cached
+	env.post(t, playing(t, 6))
+
+	if got := env.plex.Requests("/library/metadata/200/children"); got != 2 {
+		t.Fatalf("got %d season requests, want 2", got)
+	}
+
+	if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(8)); err != nil {
+		t.Fatalf("episode 8 not cached: %v", err)
+	}
+}
+
+func TestCopiedEpisodesAreNotCopiedAgain(t *testing.T) {
+	env := newTestEnv(t)
+
+	plan, err := PlanCache(t.Context(), env.deps, plextest.Payload(t, "media.play"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.webhook(t, "media.play")
+
+	// a copy of the same size the next job must leave alone, and a copy
+	// that is gone
+	marker := bytes.Repeat([]byte("x"), 1203)
+	if err := os.WriteFile(env.deps.CacheRoot+env.episodePath(3), marker, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(env.deps.CacheRoot + env.episodePath(4)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cacheEpisodes(t.Context(), env.deps, plan); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := os.ReadFile(env.deps.CacheRoot + env.episodePath(3)); !bytes.Equal(got, marker) {
+		t.Fatal("episode 3 was copied again")
+	}
+	if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(4)); err != nil {
+		t.Fatalf("missing copy of episode 4 not copied again: %v", err)
+	}
+}
+
+func TestWebhookIgnoresOtherEvents(t *testing.T) {
+	for _, name := range []string{"media.pause", "media.play.first-episode"} {
+		t.Run(name, func(t *testing.T) {
+			env := newTestEnv(t)
+
+			if rec := env.webhook(t, name); rec.Code != http.StatusOK {
+				t.Fatalf("got status %d", rec.Code)
+			}
+
+			if got := env.plex.Requests("/library/metadata/200/children"); got != 0 {
+				t.Fatalf("got %d season requests, want 0", got)
+			}
+
+			for _, key := range env.redis.Keys() {
+				if strings.HasSuffix(key, ":plex-expirer") {
+					t.Fatalf("unexpected cache record %s", key)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookDefersWhilePlexIsDown(t *testing.T) {
+	env := newTestEnv(t)
+	env.plex.FailNext(1, http.StatusServiceUnavailable)
+
+	if rec := env.webhook(t, "media.play"); rec.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusAccepted)
+	}
+
+	if queued, _, _ := redisH.RetryQueueLength(t.Context(), env.deps.Redis); queued != 1 {
+		t.Fatalf("got %d queued retries, want 1", queued)
+	}
+
+	// not due yet
+	retryDue(t.Context(), env.deps, time.Now())
+	if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(3)); !os.IsNotExist(err) {
+		t.Fatal("retry ran before it was due")
+	}
+
+	retryDue(t.Context(), env.deps, time.Now().Add(time.Hour))
+	if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(3)); err != nil {
+		t.Fatalf("episode 3 not cached by the retry: %v", err)
+	}
+
+	if queued, dead, _ := redisH.RetryQueueLength(t.Context(), env.deps.Redis); queued != 0 || dead != 0 {
+		t.Fatalf("got %d queued and %d dead retries, want none", queued, dead)
+	}
+}
+
+func TestPlayIsHitOnceCopied(t *testing.T) {
+	env := newTestEnv(t)
+	env.webhook(t, "media.play")
+
+	recordPlay(t.Context(), env.deps, playing(t, 3))
+
+	episode, _, _ := redisH.GetCachedEpisode(t.Context(), env.deps.Redis, "", "203")
+	if !episode.Played {
+		t.Fatal("episode 203 should be marked played")
+	}
+
+	hitRate, err := redisH.GetHitRate(t.Context(), env.deps.Redis, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := models.HitCounts{Hits: 1, Misses: 1, Rate: 0.5}
+	if hitRate.All != want {
+		t.Fatalf("got %+v, want %+v", hitRate.All, want)
+	}
+}
+
+func TestMetricsReadTheHitRateWhenScraped(t *testing.T) {
+	env := newTestEnv(t)
+	env.webhook(t, "media.play")
+	recordPlay(t.Context(), env.deps, playing(t, 3))
+
+	rec := httptest.NewRecorder()
+	MetricsHandler(env.deps)(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if !strings.Contains(rec.Body.String(), "plexcache_hit_rate_24h 0.5\n") {
+		t.Fatalf("hit rate missing from the metrics:\n%s", rec.Body)
+	}
+}
+
+func TestWebhookNamespacesRecordsPerServer(t *testing.T) {
+	env := newTestEnv(t)
+
+	other := plextest.NewServer(t)
+	env.deps.Servers = map[string]Server{
+		"test-server-uuid": {UUID: "test-server-uuid", Plex: env.deps.Plex, Paths: env.deps.Paths},
+		"other-uuid": {UUID: "other-uuid", Plex: plex.NewClient(plexgo.New(
+			plexgo.WithSecurity(plextest.Token),
+			plexgo.WithServerURL(other.URL),
+		)), Paths: env.deps.Paths},
+	}
+	env.deps.Plex = nil
+
+	env.webhook(t, "media.play")
+
+	payload := plextest.Payload(t, "media.play")
+	payload.Server.UUID = "other-uuid"
+	env.post(t, payload)
+
+	for _, server := range []string{"test-server-uuid", "other-uuid"} {
+		if _, found, _ := redisH.GetCachedEpisode(t.Context(), env.deps.Redis, server, "203"); !found {
+			t.Fatalf("no record of 203 for %s", server)
+		}
+		if !env.redis.Exists("plex-cache:episode:" + server + ":203:plex-expirer") {
+			t.Fatalf("no expirer of 203 for %s", server)
+		}
+	}
+
+	if env.redis.Exists("plex-cache:episode:203") {
+		t.Fatal("records of a multi-server setup should be namespaced")
+	}
+
+	if got := other.Requests("/library/metadata/200/children"); got != 1 {
+		t.Fatalf("other server got %d season requests, want 1", got)
+	}
+
+	payload.Server.UUID = "unknown-uuid"
+	payload.Metadata.RatingKey = "204"
+	if rec := env.post(t, payload); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d for an unknown server", rec.Code)
+	}
+	if got := env.plex.Requests("/library/metadata/200/children") + other.Requests("/library/metadata/200/children"); got != 2 {
+		t.Fatalf("webhook of an unknown server reached Plex")
+	}
+}
+
+func TestWebhookLogsOneDecisionTrace(t *testing.T) {
+	env := newTestEnv(t)
+	env.deps.Jobs = NewJobs()
+
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, "info", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	req := plextest.WebhookRequest(t, "/", plextest.Payload(t, "media.play"))
+	req.Header.Set("X-Request-Id", "req-1")
+	rec := httptest.NewRecorder()
+	WebhookHandler(env.deps).ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("X-Request-Id"); got != "req-1" {
+		t.Fatalf("got request id %q", got)
+	}
+
+	var traces []map[string]any
+	jobs := map[any]bool{}
+	for line := range bytes.Lines(buf.Bytes()) {
+		var record map[string]any
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["request"] != "req-1" {
+			t.Fatalf("record without the request id: %v", record)
+		}
+		if record["msg"] == "webhook" {
+			traces = append(traces, record)
+		}
+		if record["msg"] == "copy" {
+			jobs[record["job"]] = true
+		}
+	}
+
+	if len(traces) != 1 {
+		t.Fatalf("got %d decision traces, want 1", len(traces))
+	}
+	trace := traces[0]
+	if trace["event"] != "media.play" || trace["show"] != "Test Show" || trace["decision"] != "cache" || trace["episodes"] != 4.0 {
+		t.Fatalf("got trace %v", trace)
+	}
+	if !strings.Contains(trace["reason"].(string), "admitted") {
+		t.Fatalf("reason should say why: %v", trace["reason"])
+	}
+	if len(jobs) != 1 || jobs[nil] {
+		t.Fatalf("copies should carry one job id, got %v", jobs)
+	}
+}
+
+func TestWebhookSpans(t *testing.T) {
+	env := newTestEnv(t)
+	collector := tracingtest.NewCollector(t)
+
+	shutdown, err := tracing.Setup(t.Context(), collector.Endpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := env.webhook(t, "media.play"); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	if err := shutdown(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks := collector.Named("WebhookHandler")
+	if len(webhooks) != 1 {
+		t.Fatalf("got %d webhook spans", len(webhooks))
+	}
+	root := webhooks[0]
+	if root.Attributes["decision"] != "cache" || root.Attributes["ratingKey"] != "202" || root.Attributes["episodes"] != int64(4) {
+		t.Fatalf("got webhook attributes %v", root.Attributes)
+	}
+
+	for name, count := range map[string]int{"parsemodels": 1, "GetSeasonMetadata": 1, "SaveEpisodeCacheToRedis": 1, "CopyFile": 6} {
+		spans := collector.Named(name)
+		if len(spans) != count {
+			t.Fatalf("got %d %s spans, want %d", len(spans), name, count)
+		}
+		for _, span := range spans {
+			if span.TraceID != root.TraceID {
+				t.Fatalf("%s is not in the webhook trace", name)
+			}
+		}
+	}
+
+	if got := collector.Named("SaveEpisodeCacheToRedis")[0].Attributes["addedEpisodes"]; got != int64(4) {
+		t.Fatalf("got %v added episodes", got)
+	}
+
+	copied := map[any]any{}
+	for _, span := range collector.Named("CopyFile") {
+		copied[span.Attributes["src"]] = span.Attributes["bytes"]
+	}
+	if got := copied[env.episodePath(3)]; got != int64(1203) {
+		t.Fatalf("got %v bytes for episode 3", got)
+	}
+}
+
+func TestWebhookDeferredWhileShowIsLocked(t *testing.T) {
+	env := newTestEnv(t)
+	env.deps.ShowLockTTL = time.Minute
+
+	payload := plextest.Payload(t, "media.play")
+	lock, err := redisH.AcquireShowLock(t.Context(), env.deps.Redis, "", payload, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := env.webhook(t, "media.play"); rec.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want 202", rec.Code)
+	}
+	if queued, _, _ := redisH.RetryQueueLength(t.Context(), env.deps.Redis); queued != 1 {
+		t.Fatalf("got %d queued retries, want 1", queued)
+	}
+	if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(3)); !os.IsNotExist(err) {
+		t.Fatal("copied while the show was locked")
+	}
+	if history, _ := redisH.GetShowHistory(t.Context(), env.deps.Redis, "", payload); history.Plays != 1 {
+		t.Fatalf("the play should be in the history, got %d plays", history.Plays)
+	}
+
+	lock.Release(t.Context())
+	retryDue(t.Context(), env.deps, time.Now().Add(time.Hour))
+
+	if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(3)); err != nil {
+		t.Fatalf("episode 3 not cached by the retry: %v", err)
+	}
+	if env.redis.Exists("plex-cache:lock:" + payload.Metadata.GrandparentRatingKey) {
+		t.Fatal("the retry did not release the lock")
+	}
+}
+
+func TestLockContentionUsesNoRetryAttempts(t *testing.T) {
+	env := newTestEnv(t)
+	env.deps.ShowLockTTL = time.Minute
+
+	payload := plextest.Payload(t, "media.play")
+	if _, err := redisH.AcquireShowLock(t.Context(), env.deps.Redis, "", payload, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := env.webhook(t, "media.play"); rec.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want 202", rec.Code)
+	}
+
+	now := time.Now()
+	for range maxRetryAttempts + 2 {
+		now = now.Add(time.Hour)
+		retryDue(t.Context(), env.deps, now)
+	}
+
+	items, err := redisH.ClaimDueRetries(t.Context(), env.deps.Redis, now.Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Attempts != 0 || items[0].LastError != redisH.ErrLocked.Error() {
+		t.Fatalf("got %+v, want one retry without attempts", items)
+	}
+	if _, dead, _ := redisH.RetryQueueLength(t.Context(), env.deps.Redis); dead != 0 {
+		t.Fatalf("got %d dead letters", dead)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 7: time.Hour} {
+		if got := retryDelay(attempts); got < want || got > want+want/5 {
+			t.Fatalf("got %v after %d attempts, want %v with jitter", got, attempts, want)
+		}
+	}
+}
+
+func TestResumeRightAfterPlayIsDebounced(t *testing.T) {
+	env := newTestEnv(t)
+	env.deps.Debounce = 10 * time.Second
+
+	env.webhook(t, "media.play")
+
+	resume := plextest.Payload(t, "media.play")
+	resume.Event = "media.resume"
+	if rec := env.post(t, resume); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+
+	hitRate, err := redisH.GetHitRate(t.Context(), env.deps.Redis, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plays := hitRate.All.Hits + hitRate.All.Misses; plays != 1 {
+		t.Fatalf("got %d plays counted, the resume should be debounced", plays)
+	}
+
+	env.redis.FastForward(10 * time.Second)
+	env.post(t, resume)
+
+	if hitRate, _ := redisH.GetHitRate(t.Context(), env.deps.Redis, 1); hitRate.All.Hits+hitRate.All.Misses != 2 {
+		t.Fatal("a resume after the window should count")
+	}
+}
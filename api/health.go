@@ -0,0 +1,273 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"plexcache/metrics"
+	"plexcache/models"
+	"plexcache/plex"
+	redisH "plexcache/redis"
+	"plexcache/utils"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var started = time.Now()
+
+// Check is one readiness probe. Run returns details worth reporting, or why
+// the dependency is not usable.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) (map[string]any, error)
+}
+
+type CheckResult struct {
+	Name        string         `json:"name"`
+	OK          bool           `json:"ok"`
+	LatencyMs   float64        `json:"latencyMs"`
+	Error       string         `json:"error,omitempty"`
+	LastError   string         `json:"lastError,omitempty"`
+	LastErrorAt *time.Time     `json:"lastErrorAt,omitempty"`
+	Details     map[string]any `json:"details,omitempty"`
+}
+
+type Ready struct {
+	Status string        `json:"status"`
+	Checks []CheckResult `json:"checks"`
+}
+
+type lastError struct {
+	message string
+	at      time.Time
+}
+
+// Readiness runs the checks concurrently and remembers the last error of
+// each, so a check that recovered still shows what went wrong.
+type Readiness struct {
+	checks  []Check
+	timeout time.Duration
+
+	mu         sync.Mutex
+	lastErrors map[string]lastError
+}
+
+func NewReadiness(timeout time.Duration, checks ...Check) *Readiness {
+	return &Readiness{checks: checks, timeout: timeout, lastErrors: map[string]lastError{}}
+}
+
+func (r *Readiness) Run(ctx context.Context) Ready {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	ready := Ready{Status: "ok", Checks: make([]CheckResult, len(r.checks))}
+
+	var wg sync.WaitGroup
+	for i, check := range r.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			start := time.Now()
+			details, err := check.Run(ctx)
+			ready.Checks[i] = CheckResult{
+				Name:      check.Name,
+				OK:        err == nil,
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+				Details:   details,
+			}
+			if err != nil {
+				ready.Checks[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, result := range ready.Checks {
+		value := 1.0
+		if !result.OK {
+			value = 0
+			ready.Status = "unavailable"
+			r.lastErrors[result.Name] = lastError{message: result.Error, at: time.Now()}
+		}
+		metrics.Set("plexcache_ready", "1 while a readiness check passes.", value, "check", result.Name)
+
+		if last, ok := r.lastErrors[result.Name]; ok {
+			ready.Checks[i].LastError = last.message
+			ready.Checks[i].LastErrorAt = &last.at
+		}
+	}
+
+	return ready
+}
+
+// HealthHandler answers as long as the process serves requests.
+func HealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":        "ok",
+			"uptimeSeconds": int(time.Since(started).Seconds()),
+		})
+	}
+}
+
+// ReadyHandler runs the readiness checks, answering 503 when one fails.
+func ReadyHandler(readiness *Readiness) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready := readiness.Run(r.Context())
+
+		w.Header().Set("Content-Type", "application/json")
+		if ready.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(ready)
+	}
+}
+
+func RedisCheck(rdb *redis.Client) Check {
+	return Check{Name: "redis", Run: func(ctx context.Context) (map[string]any, error) {
+		return nil, rdb.Ping(ctx).Err()
+	}}
+}
+
+// ExpiryCheck reports how expired records are noticed. With notifications
+// alive tells whether the subscription still works.
+func ExpiryCheck(state models.ExpiryState, alive func(ctx context.Context) error) Check {
+	return Check{Name: "expiry", Run: func(ctx context.Context) (map[string]any, error) {
+		details := map[string]any{
+			"mode":                 state.Mode,
+			"notifyKeyspaceEvents": state.NotifyKeyspaceEvents,
+			"configured":           state.Configured,
+		}
+		if state.Error != "" {
+			details["reason"] = state.Error
+		}
+
+		if state.Mode != redisH.ExpiryNotifications {
+			return details, nil
+		}
+		if alive == nil {
+			return details, errors.New("no subscription to expired events")
+		}
+
+		return details, alive(ctx)
+	}}
+}
+
+func PlexCheck(name string, connection plex.Connection) Check {
+	return Check{Name: name, Run: func(ctx context.Context) (map[string]any, error) {
+		info, err := plex.CheckConnection(ctx, connection)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]any{"server": info.Name, "version": info.Version}, nil
+	}}
+}
+
+// CacheRootCheck writes a file to the cache root and fails when less than
+// minFree bytes are free.
+func CacheRootCheck(root string, minFree uint64) Check {
+	return Check{Name: "cache", Run: func(ctx context.Context) (map[string]any, error) {
+		f, err := os.CreateTemp(root, ".plex-cache-ready-*")
+		if err != nil {
+			return nil, fmt.Errorf("cache root is not writable: %w", err)
+		}
+		_, err = f.WriteString("ok")
+		f.Close()
+		os.Remove(f.Name())
+		if err != nil {
+			return nil, fmt.Errorf("cache root is not writable: %w", err)
+		}
+
+		free, err := utils.FreeSpace(root)
+		if err != nil {
+			return nil, err
+		}
+
+		details := map[string]any{"root": root, "freeBytes": free}
+		if free < minFree {
+			return details, fmt.Errorf("%d bytes free, less than %d", free, minFree)
+		}
+
+		return details, nil
+	}}
+}
+
+// MediaRootsCheck lists each local media root the path mappings point at.
+func MediaRootsCheck(paths []models.PathMapping) Check {
+	return Check{Name: "media", Run: func(ctx context.Context) (map[string]any, error) {
+		roots := map[string]bool{}
+		var errs []error
+
+		for _, mapping := range paths {
+			if _, done := roots[mapping.Local]; done {
+				continue
+			}
+
+			err := readable(mapping.Local)
+			roots[mapping.Local] = err == nil
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		return map[string]any{"roots": roots}, errors.Join(errs...)
+	}}
+}
+
+func readable(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// ReadinessChecks are the checks of the service: redis, expiry, every Plex
+// server, the cache root and the media roots of every server.
+func ReadinessChecks(deps Deps, expiry models.ExpiryState, alive func(ctx context.Context) error, minFree uint64) []Check {
+	checks := []Check{RedisCheck(deps.Redis), ExpiryCheck(expiry, alive)}
+	paths := deps.Paths
+
+	if len(deps.Servers) == 0 {
+		checks = append(checks, PlexCheck("plex", deps.PlexConnection))
+	} else {
+		paths = nil
+		uuids := slices.Sorted(maps.Keys(deps.Servers))
+		for _, uuid := range uuids {
+			server := deps.Servers[uuid]
+			name := server.Name
+			if name == "" {
+				name = uuid
+			}
+			checks = append(checks, PlexCheck("plex:"+name, server.Connection))
+			paths = append(paths, server.Paths...)
+		}
+	}
+
+	if paths == nil {
+		paths = DefaultPaths
+	}
+
+	return append(checks, CacheRootCheck(deps.CacheRoot, minFree), MediaRootsCheck(paths))
+}
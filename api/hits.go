@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+
+	"plexcache/metrics"
+	"plexcache/models"
+	redisH "plexcache/redis"
+)
+
+func isPlayback(payload models.Payload) bool {
+	return (payload.Event == "media.play" || payload.Event == "media.resume") &&
+		payload.Metadata.LibrarySectionType == "show"
+}
+
+// isHit tells whether the playing episode is served from the cache: it has
+// a record whose copy finished and, outside dry-run, its files are in the
+// cache root with the recorded sizes.
+func isHit(deps Deps, episodeCache models.EpisodeCache) bool {
+	if !episodeCache.Copied {
+		return false
+	}
+
+	if deps.DryRun {
+		return true
+	}
+
+	for _, file := range episodeCache.Files() {
+		info, err := os.Stat(deps.CacheRoot + file.Path)
+		if err != nil || (file.Size != 0 && info.Size() != file.Size) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// recordPlay classifies a play as a cache hit or miss, records it and marks
+// the cached episode as played so its eviction is not counted as wasted.
+func recordPlay(ctx context.Context, deps Deps, payload models.Payload) {
+	episodeCache, found, err := redisH.GetCachedEpisode(ctx, deps.Redis, deps.Server, payload.Metadata.RatingKey)
+	if err != nil {
+		slog.ErrorContext(ctx, "could not read the cache record", "ratingKey", payload.Metadata.RatingKey, "err", err)
+		return
+	}
+
+	hit := found && isHit(deps, episodeCache)
+
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	slog.InfoContext(ctx, "play", "result", result, "show", payload.Metadata.GrandparentTitle, "episode", payload.Metadata.Title)
+
+	// shows and users are in /admin/hitrate, as labels they would make a
+	// series each
+	metrics.Inc("plexcache_plays_total", "Episode plays by cache result.",
+		"result", result,
+		"library", payload.Metadata.LibrarySectionTitle)
+
+	if err := redisH.RecordPlayResult(ctx, deps.Redis, payload, hit); err != nil {
+		slog.ErrorContext(ctx, "could not record play result", "err", err)
+	}
+
+	if found && !episodeCache.Played {
+		if err := redisH.MarkPlayed(ctx, deps.Redis, deps.Server, payload.Metadata.RatingKey); err != nil {
+			slog.ErrorContext(ctx, "could not mark played", "err", err)
+		}
+	}
+}
+
+// MetricsHandler serves the metrics with the 24 hour hit rate read from
+// redis at scrape time, rather than on every play.
+func MetricsHandler(deps Deps) http.HandlerFunc {
+	serve := metrics.Handler()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if hitRate, err := redisH.GetHitRate(ctx, deps.Redis, 24); err != nil {
+			slog.ErrorContext(ctx, "could not read the hit rate", "err", err)
+		} else {
+			metrics.Set("plexcache_hit_rate_24h", "Share of episode plays served from the cache over the last 24 hours.", hitRate.All.Rate)
+		}
+
+		serve(w, r)
+	}
+}
+
+func intQuery(r *http.Request, name string, fallback int) int {
+	if n, err := strconv.Atoi(r.URL.Query().Get(name)); err == nil && n > 0 {
+		return n
+	}
+
+	return fallback
+}
+
+// HitRateHandler reports the rolling hit rate, `?hours=` defaults to 24.
+func HitRateHandler(deps Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hitRate, err := redisH.GetHitRate(r.Context(), deps.Redis, min(intQuery(r, "hours", 24), 24*7))
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hitRate)
+	}
+}
+
+// WastedHandler lists copies that expired without being played.
+func WastedHandler(deps Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wasted, err := redisH.GetWasted(r.Context(), deps.Redis, int64(intQuery(r, "limit", 100)))
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wasted)
+	}
+}
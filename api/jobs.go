@@ -0,0 +1,269 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"plexcache/logging"
+	"plexcache/metrics"
+	"plexcache/utils"
+)
+
+// ErrShuttingDown is returned for jobs started after Shutdown.
+var ErrShuttingDown = errors.New("shutting down")
+
+// Job is the caching of the episodes of one plan, started by a webhook or
+// a retry, or a verification of the cached files.
+type Job struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	RatingKey string    `json:"ratingKey"`
+	Show      string    `json:"show"`
+	Episodes  int       `json:"episodes"`
+	StartedAt time.Time `json:"startedAt"`
+
+	cancel context.CancelFunc
+}
+
+// Jobs tracks the jobs in progress, so they can be cancelled through the
+// admin API and shutdown can let them finish or cancel the ones that don't
+// make the deadline.
+type Jobs struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	closing bool
+	next    int
+	running map[string]*Job
+	// copying maps the destinations being copied to to the copy in
+	// progress
+	copying map[string]*sharedCopy
+	// verifying is the id of the verify job in progress, verified the
+	// report of the last one that finished
+	verifying string
+	verified  *VerifyReport
+}
+
+func NewJobs() *Jobs {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Jobs{ctx: ctx, cancel: cancel, running: map[string]*Job{}, copying: map[string]*sharedCopy{}}
+}
+
+// start registers a job for a plan. Its context is cancelled by Cancel or
+// when shutdown gives up waiting, done must be called when the job ended.
+func (j *Jobs) start(ctx context.Context, plan Plan) (context.Context, func(), error) {
+	job := Job{Event: plan.Event, RatingKey: plan.RatingKey, Episodes: len(plan.Episodes)}
+	if len(plan.Episodes) > 0 {
+		job.Show = plan.Episodes[0].GrandparentTitle
+	}
+
+	ctx, _, done, err := j.track(ctx, job, plan.RatingKey)
+	return ctx, done, err
+}
+
+// track registers a job with an id made of a sequence number and name, see
+// start.
+func (j *Jobs) track(ctx context.Context, job Job, name string) (context.Context, Job, func(), error) {
+	if j == nil {
+		return ctx, job, func() {}, nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closing {
+		return nil, job, nil, ErrShuttingDown
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(j.ctx, cancel)
+
+	j.next++
+	job.ID = fmt.Sprintf("%d-%s", j.next, name)
+	job.StartedAt = time.Now()
+	job.cancel = cancel
+	ctx = logging.With(ctx, "job", job.ID)
+
+	j.running[job.ID] = &job
+	j.wg.Add(1)
+
+	done := func() {
+		stop()
+		cancel()
+
+		j.mu.Lock()
+		delete(j.running, job.ID)
+		j.mu.Unlock()
+
+		j.wg.Done()
+	}
+
+	return ctx, job, done, nil
+}
+
+// sharedCopy is a copy other jobs copying to the same destination wait
+// for. Its result is set before done is closed.
+type sharedCopy struct {
+	done   chan struct{}
+	copied utils.Copy
+	err    error
+}
+
+// ErrSizeMismatch is returned for a copy whose size differs from what Plex
+// reports: the source changed since Plex scanned it, and Plex would not
+// play the copy the way it knows the file.
+var ErrSizeMismatch = errors.New("copy differs in size from Plex")
+
+// copyOnce copies src to dst unless another job is copying to dst. Then it
+// waits for that copy and takes its result, and only copies itself when
+// the other copy failed for another reason than its size. A copy whose size
+// is not the expected one, when known, is removed before anyone sees it.
+func (j *Jobs) copyOnce(ctx context.Context, src, dst string, size int64) (utils.Copy, error) {
+	if j == nil {
+		return checkedCopy(ctx, src, dst, size)
+	}
+
+	for {
+		j.mu.Lock()
+		other, copying := j.copying[dst]
+		if !copying {
+			own := &sharedCopy{done: make(chan struct{})}
+			j.copying[dst] = own
+			j.mu.Unlock()
+
+			own.copied, own.err = checkedCopy(ctx, src, dst, size)
+
+			j.mu.Lock()
+			delete(j.copying, dst)
+			j.mu.Unlock()
+			close(own.done)
+
+			return own.copied, own.err
+		}
+		j.mu.Unlock()
+
+		metrics.Inc("plexcache_copies_deduplicated_total", "Copies left to another job copying to the same destination.")
+		slog.InfoContext(ctx, "waiting for another job copying to the same destination", "to", dst)
+
+		select {
+		case <-other.done:
+		case <-ctx.Done():
+			return utils.Copy{}, ctx.Err()
+		}
+
+		if other.err == nil || errors.Is(other.err, ErrSizeMismatch) {
+			return other.copied, other.err
+		}
+	}
+}
+
+// checkedCopy copies src to dst and removes the copy again when its size
+// is not size, unless size is 0.
+func checkedCopy(ctx context.Context, src, dst string, size int64) (utils.Copy, error) {
+	copied, err := utils.CopyFileContext(ctx, src, dst)
+	if err != nil || size == 0 || copied.Bytes == size {
+		return copied, err
+	}
+
+	metrics.Inc("plexcache_copy_size_mismatches_total", "Copies whose size differs from what Plex reports.")
+	if err := utils.RemoveFile(dst); err != nil {
+		slog.ErrorContext(ctx, "failed to remove file", "file", dst, "err", err)
+	}
+
+	return copied, fmt.Errorf("%w: %s has %d bytes, Plex reports %d", ErrSizeMismatch, src, copied.Bytes, size)
+}
+
+// List returns the jobs in progress, oldest first.
+func (j *Jobs) List() []Job {
+	if j == nil {
+		return []Job{}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	jobs := make([]Job, 0, len(j.running))
+	for _, job := range j.running {
+		jobs = append(jobs, *job)
+	}
+	slices.SortFunc(jobs, func(a, b Job) int { return a.StartedAt.Compare(b.StartedAt) })
+
+	return jobs
+}
+
+// Cancel cancels a job in progress. The job stops after the chunk it is
+// copying and removes its partial output.
+func (j *Jobs) Cancel(id string) bool {
+	if j == nil {
+		return false
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.running[id]
+	if ok {
+		job.cancel()
+	}
+
+	return ok
+}
+
+// Shutdown refuses new jobs and waits for the ones in progress. When ctx
+// is done first they are cancelled, Shutdown waits for them to clean up and
+// returns ctx's error.
+func (j *Jobs) Shutdown(ctx context.Context) error {
+	j.mu.Lock()
+	j.closing = true
+	j.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		j.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		j.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// JobsHandler lists the jobs in progress.
+func JobsHandler(deps Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deps.Jobs.List())
+	}
+}
+
+// CancelJobHandler cancels the job named in the path. It answers before the
+// job has stopped.
+func CancelJobHandler(deps Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		if !deps.Jobs.Cancel(id) {
+			http.Error(w, "no job "+id, http.StatusNotFound)
+			return
+		}
+
+		slog.InfoContext(r.Context(), "cancelled job", "job", id)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,252 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"plexcache/models"
+	"plexcache/plex/plextest"
+	"plexcache/utils"
+)
+
+func TestJobsShutdownCancelsAfterDeadline(t *testing.T) {
+	jobs := NewJobs()
+
+	ctx, done, err := jobs.start(t.Context(), Plan{RatingKey: "202"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(cancelled)
+		done()
+	}()
+
+	deadline, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := jobs.Shutdown(deadline); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline", err)
+	}
+
+	select {
+	case <-cancelled:
+	default:
+		t.Fatal("the job was not cancelled")
+	}
+
+	if _, _, err := jobs.start(t.Context(), Plan{RatingKey: "202"}); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("got %v for a job after shutdown", err)
+	}
+}
+
+func TestCancelJobThroughAdminAPI(t *testing.T) {
+	deps := Deps{Jobs: NewJobs()}
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/jobs", JobsHandler(deps)).Methods("GET")
+	r.HandleFunc("/admin/jobs/{id}", CancelJobHandler(deps)).Methods("DELETE")
+
+	plan := Plan{Event: "media.play", RatingKey: "202", Episodes: []models.EpisodeCache{{GrandparentTitle: "Show"}}}
+	ctx, done, err := deps.Jobs.start(t.Context(), plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/jobs", nil))
+
+	var jobs []Job
+	if err := json.NewDecoder(rec.Body).Decode(&jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].RatingKey != "202" || jobs[0].Show != "Show" || jobs[0].Episodes != 1 {
+		t.Fatalf("got jobs %+v", jobs)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("DELETE", "/admin/jobs/"+jobs[0].ID, nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want 202", rec.Code)
+	}
+	if ctx.Err() == nil {
+		t.Fatal("the job was not cancelled")
+	}
+
+	done()
+	if jobs := deps.Jobs.List(); len(jobs) != 0 {
+		t.Fatalf("finished jobs should not be listed, got %+v", jobs)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("DELETE", "/admin/jobs/"+jobs[0].ID, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d for a finished job, want 404", rec.Code)
+	}
+}
+
+func TestCancelledJobForgetsUncopiedEpisodes(t *testing.T) {
+	env := newTestEnv(t)
+	env.deps.Jobs = NewJobs()
+
+	plan, err := PlanCache(t.Context(), env.deps, plextest.Payload(t, "media.play"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	if err := cacheEpisodes(ctx, env.deps, plan); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want the cancellation", err)
+	}
+
+	if env.redis.Exists("plex-cache:episode:203") {
+		t.Fatal("records of episodes that were not copied should be removed")
+	}
+	if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(3)); !os.IsNotExist(err) {
+		t.Fatal("a cancelled job should leave no copy")
+	}
+}
+
+func TestCancelledJobKeepsEpisodesCopiedBefore(t *testing.T) {
+	env := newTestEnv(t)
+	env.deps.Jobs = NewJobs()
+
+	plan, err := PlanCache(t.Context(), env.deps, plextest.Payload(t, "media.play"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.webhook(t, "media.play")
+	usage := env.usageBytes(t)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	if err := cacheEpisodes(ctx, env.deps, plan); err == nil {
+		t.Fatal("expected the cancellation")
+	}
+
+	for i := 3; i <= 6; i++ {
+		if !env.redis.Exists(fmt.Sprintf("plex-cache:episode:20%d", i)) {
+			t.Fatalf("record of episode %d was removed", i)
+		}
+		if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(i)); err != nil {
+			t.Fatalf("copy of episode %d was removed: %v", i, err)
+		}
+	}
+	if got := env.usageBytes(t); got != usage {
+		t.Fatalf("got usage %d, want %d", got, usage)
+	}
+}
+
+func TestJobStopsWhenRecordsAreNotSaved(t *testing.T) {
+	env := newTestEnv(t)
+
+	plan, err := PlanCache(t.Context(), env.deps, plextest.Payload(t, "media.play"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env.redis.SetError("READONLY You can't write against a read only replica.")
+	err = cacheEpisodes(t.Context(), env.deps, plan)
+	env.redis.SetError("")
+
+	if err == nil {
+		t.Fatal("expected the failed save")
+	}
+	if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(3)); !os.IsNotExist(err) {
+		t.Fatal("episodes without records should not be copied")
+	}
+}
+
+func TestWebhookDuringShutdown(t *testing.T) {
+	env := newTestEnv(t)
+	env.deps.Jobs = NewJobs()
+
+	if err := env.deps.Jobs.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := env.webhook(t, "media.play"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want 503", rec.Code)
+	}
+
+	if env.redis.Exists("plex-cache:episode:203") {
+		t.Fatal("nothing should be recorded during shutdown")
+	}
+	if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(3)); !os.IsNotExist(err) {
+		t.Fatal("nothing should be copied during shutdown")
+	}
+}
+
+func TestCopyOnceWaitsForTheSameDestination(t *testing.T) {
+	jobs := NewJobs()
+	dst := t.TempDir() + "/episode.mkv"
+
+	// another job is copying to dst
+	other := &sharedCopy{done: make(chan struct{})}
+	jobs.copying[dst] = other
+
+	result := make(chan error)
+	var copied utils.Copy
+	go func() {
+		var err error
+		copied, err = jobs.copyOnce(t.Context(), "/does/not/exist", dst, 6)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		t.Fatalf("did not wait for the other copy: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	other.copied = utils.Copy{Bytes: 6, Hash: "1234"}
+	jobs.mu.Lock()
+	delete(jobs.copying, dst)
+	jobs.mu.Unlock()
+	close(other.done)
+
+	if err := <-result; err != nil {
+		t.Fatalf("copied again instead of using the other copy: %v", err)
+	}
+	if copied != other.copied {
+		t.Fatalf("got %+v for the other copy", copied)
+	}
+}
+
+func TestCopyOnceRemovesCopiesOfTheWrongSize(t *testing.T) {
+	jobs := NewJobs()
+	src := t.TempDir() + "/episode.mkv"
+	dst := t.TempDir() + "/episode.mkv"
+	if err := os.WriteFile(src, []byte("changed since Plex scanned it"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := jobs.copyOnce(t.Context(), src, dst, 6); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("got %v, want ErrSizeMismatch", err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatal("the copy of the wrong size was kept")
+	}
+
+	// a job waiting for such a copy takes its error instead of copying
+	other := &sharedCopy{done: make(chan struct{}), err: fmt.Errorf("%w: %s", ErrSizeMismatch, src)}
+	jobs.copying[dst] = other
+	close(other.done)
+
+	if _, err := jobs.copyOnce(t.Context(), "/does/not/exist", dst, 6); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("waiter got %v, want ErrSizeMismatch", err)
+	}
+}
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	s "strings"
+
+	"plexcache/logging"
+	"plexcache/models"
+	redisH "plexcache/redis"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrNoJournalEntry is returned for a replay of a webhook the journal does
+// not have, or no longer has.
+var ErrNoJournalEntry = errors.New("no such journal entry")
+
+// secretHeaders are left out of the journal, as are headers whose name
+// mentions a token, secret, password or key.
+var secretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// journalHeaders returns the request headers worth keeping, without secrets.
+func journalHeaders(header http.Header) map[string]string {
+	kept := map[string]string{}
+
+	for name, values := range header {
+		lower := s.ToLower(name)
+		if secretHeaders[name] || s.Contains(lower, "token") || s.Contains(lower, "secret") ||
+			s.Contains(lower, "password") || s.Contains(lower, "key") {
+			continue
+		}
+		kept[name] = s.Join(values, ", ")
+	}
+
+	return kept
+}
+
+// Replay runs a journaled webhook through the handler again and returns
+// the journal entry of the replay. A replay is no new play: it is not
+// debounced and counts towards neither the hit rate nor the show history.
+// With dryRun the webhook is only planned, like /plan does, and the entry is
+// returned without being journaled, so redis and the cache are left as they
+// are.
+func Replay(ctx context.Context, deps Deps, id string, dryRun bool) (models.JournalEntry, error) {
+	original, found, err := redisH.GetJournalEntry(ctx, deps.Redis, id)
+	if err != nil {
+		return models.JournalEntry{}, err
+	}
+	if !found {
+		return models.JournalEntry{}, ErrNoJournalEntry
+	}
+
+	ctx = logging.With(ctx, "replay", id)
+	trace := &decisionTrace{
+		payload:   original.Payload,
+		requestID: original.RequestID,
+		headers:   original.Headers,
+		replayOf:  id,
+		dryRun:    deps.DryRun || dryRun,
+	}
+
+	if dryRun {
+		previewReplay(ctx, deps, original.Payload, trace)
+		trace.log(ctx)
+		return trace.entry(), nil
+	}
+
+	handleWebhook(ctx, deps, original.Payload, trace)
+
+	return trace.record(ctx, deps), nil
+}
+
+// previewReplay records in trace what handleWebhook would decide, from the
+// plan of PreviewCache.
+func previewReplay(ctx context.Context, deps Deps, payload models.Payload, trace *decisionTrace) {
+	deps, err := deps.ForServer(payload)
+	if err != nil {
+		trace.set("ignored", err.Error())
+		return
+	}
+
+	plan, err := PreviewCache(ctx, deps, payload)
+	if err != nil {
+		trace.set("error", "could not plan: "+err.Error())
+		return
+	}
+
+	if !plan.Cache {
+		trace.set("skip", s.Join(plan.Reasons, "; "))
+		return
+	}
+
+	trace.episodes = len(plan.Episodes)
+	trace.set("cache", s.Join(plan.Reasons, "; "))
+}
+
+// JournalHandler lists the journaled webhooks, newest first. `?count=`
+// defaults to 50.
+func JournalHandler(deps Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := redisH.ListJournal(r.Context(), deps.Redis, int64(min(intQuery(r, "count", 50), 1000)))
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
+
+// JournalEntryHandler shows the journaled webhook named in the path.
+func JournalEntryHandler(deps Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		entry, found, err := redisH.GetJournalEntry(r.Context(), deps.Redis, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !found {
+			http.Error(w, "no journal entry "+id, http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entry)
+	}
+}
+
+// ReplayHandler replays the journaled webhook named in the path and
+// responds with the journal entry of the replay. `?dryRun=true` only plans
+// it, see Replay.
+func ReplayHandler(deps Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, _ := requestContext(w, r)
+		id := mux.Vars(r)["id"]
+
+		entry, err := Replay(ctx, deps, id, r.URL.Query().Get("dryRun") == "true")
+		if errors.Is(err, ErrNoJournalEntry) {
+			http.Error(w, "no journal entry "+id, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entry)
+	}
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"plexcache/models"
+	"plexcache/plex/plextest"
+	redisH "plexcache/redis"
+)
+
+func (env *testEnv) journalRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/", WebhookHandler(env.deps)).Methods("POST")
+	r.HandleFunc("/admin/journal", JournalHandler(env.deps)).Methods("GET")
+	r.HandleFunc("/admin/journal/{id}", JournalEntryHandler(env.deps)).Methods("GET")
+	r.HandleFunc("/admin/journal/{id}/replay", ReplayHandler(env.deps)).Methods("POST")
+	return r
+}
+
+func serveJSON(t *testing.T, r http.Handler, req *http.Request, v any) int {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return rec.Code
+}
+
+func TestWebhooksAreJournaled(t *testing.T) {
+	env := newTestEnv(t)
+	r := env.journalRouter()
+
+	req := plextest.WebhookRequest(t, "/", plextest.Payload(t, "media.play"))
+	req.Header.Set("X-Request-Id", "req-1")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Plex-Token", "secret")
+	req.Header.Set("User-Agent", "PlexMediaServer")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	env.webhook(t, "media.pause")
+
+	var entries []models.JournalEntry
+	if code := serveJSON(t, r, httptest.NewRequest("GET", "/admin/journal", nil), &entries); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if len(entries) != 2 || entries[0].Payload.Event != "media.pause" {
+		t.Fatalf("got entries %+v, want the newest first", entries)
+	}
+
+	var entry models.JournalEntry
+	if code := serveJSON(t, r, httptest.NewRequest("GET", "/admin/journal/"+entries[1].ID, nil), &entry); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if entry.Decision != "cache" || entry.Episodes != 4 || entry.RequestID != "req-1" || entry.Payload.Metadata.RatingKey != "202" {
+		t.Fatalf("got entry %+v", entry)
+	}
+	if entry.Headers["User-Agent"] != "PlexMediaServer" {
+		t.Fatalf("got headers %v", entry.Headers)
+	}
+	for _, secret := range []string{"Authorization", "X-Plex-Token"} {
+		if _, ok := entry.Headers[secret]; ok {
+			t.Fatalf("%s should not be journaled", secret)
+		}
+	}
+
+	if code := serveJSON(t, r, httptest.NewRequest("GET", "/admin/journal/1-0", nil), &entry); code != http.StatusNotFound {
+		t.Fatalf("got status %d for a missing entry", code)
+	}
+}
+
+func TestReplayJournaledWebhook(t *testing.T) {
+	env := newTestEnv(t)
+	r := env.journalRouter()
+
+	// Plex was down, so nothing was cached
+	env.plex.FailNext(1, http.StatusServiceUnavailable)
+	env.webhook(t, "media.play")
+
+	entries, err := redisH.ListJournal(t.Context(), env.deps.Redis, 1)
+	if err != nil || len(entries) != 1 || entries[0].Decision != "deferred" {
+		t.Fatalf("got %+v, %v", entries, err)
+	}
+	id := entries[0].ID
+
+	var replay models.JournalEntry
+	if code := serveJSON(t, r, httptest.NewRequest("POST", "/admin/journal/"+id+"/replay?dryRun=true", nil), &replay); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if replay.ReplayOf != id || !replay.DryRun || replay.Decision != "cache" || replay.Episodes != 4 || replay.ID != "" {
+		t.Fatalf("got replay %+v", replay)
+	}
+	if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(3)); !os.IsNotExist(err) {
+		t.Fatal("a dry-run replay should not copy")
+	}
+
+	if _, err := Replay(t.Context(), env.deps, id, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(3)); err != nil {
+		t.Fatalf("episode 3 not cached by the replay: %v", err)
+	}
+
+	// the original play was counted when it arrived
+	hitRate, err := redisH.GetHitRate(t.Context(), env.deps.Redis, 1)
+	if err != nil || hitRate.All.Hits+hitRate.All.Misses != 1 {
+		t.Fatalf("got hit rate %+v, %v, want the replay not counted", hitRate.All, err)
+	}
+	history, err := redisH.GetShowHistory(t.Context(), env.deps.Redis, "", plextest.Payload(t, "media.play"))
+	if err != nil || history.Plays != 1 {
+		t.Fatalf("got history %+v, %v, want the replay not counted", history, err)
+	}
+
+	if _, err := Replay(t.Context(), env.deps, "1-0", false); err != ErrNoJournalEntry {
+		t.Fatalf("got %v for a missing entry", err)
+	}
+}
+
+func TestDryRunReplayLeavesRedisAlone(t *testing.T) {
+	env := newTestEnv(t)
+	env.deps.Debounce = time.Minute
+
+	// the play of episode 2, as if it arrived now
+	play, err := redisH.AppendJournal(t.Context(), env.deps.Redis, models.JournalEntry{Payload: plextest.Payload(t, "media.play")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := env.redis.Dump()
+	replay, err := Replay(t.Context(), env.deps, play, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replay.Decision != "cache" || replay.Episodes != 4 {
+		t.Fatalf("got replay %+v", replay)
+	}
+	if after := env.redis.Dump(); after != before {
+		t.Fatalf("a dry-run replay wrote to redis:\n%s\nwas\n%s", after, before)
+	}
+
+	// the play itself still caches the window
+	env.webhook(t, "media.play")
+	for i := 3; i <= 6; i++ {
+		if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(i)); err != nil {
+			t.Fatalf("episode %d not cached: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"plexcache/models"
+	"plexcache/plex"
+	"plexcache/policy"
+	redisH "plexcache/redis"
+	"plexcache/utils"
+)
+
+type PlannedCopy struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// Plan is the outcome of the decision path for one webhook, with the reasons
+// behind it. Planning never copies files, and PreviewCache never writes to
+// redis either.
+type Plan struct {
+	Event      string                `json:"event"`
+	DryRun     bool                  `json:"dryRun"`
+	RatingKey  string                `json:"ratingKey"`
+	Cache      bool                  `json:"cache"`
+	Reasons    []string              `json:"reasons"`
+	Decision   *policy.Decision      `json:"decision,omitempty"`
+	Window     *policy.Window        `json:"window,omitempty"`
+	Episodes   []models.EpisodeCache `json:"episodes"`
+	Copies     []PlannedCopy         `json:"copies"`
+	TotalBytes int64                 `json:"totalBytes"`
+	FreeBytes  uint64                `json:"freeBytes"`
+	// NoSpace is set when the plan was skipped because the episodes did
+	// not fit in the free space of the cache.
+	NoSpace bool `json:"noSpace,omitempty"`
+}
+
+func (p *Plan) skip(reason string) Plan {
+	p.Cache = false
+	p.Reasons = append(p.Reasons, reason)
+	return *p
+}
+
+func planCopies(cacheRoot string, episodes []models.EpisodeCache) []PlannedCopy {
+	var copies []PlannedCopy
+	for _, item := range episodes {
+		for _, file := range item.Files() {
+			copies = append(copies, PlannedCopy{
+				Source:      file.Path,
+				Destination: cacheRoot + file.Path,
+				Bytes:       file.Size,
+			})
+		}
+
+		for _, sidecar := range item.Sidecars() {
+			var size int64
+			if info, err := os.Stat(sidecar); err == nil {
+				size = info.Size()
+			}
+
+			copies = append(copies, PlannedCopy{
+				Source:      sidecar,
+				Destination: cacheRoot + sidecar,
+				Bytes:       size,
+			})
+		}
+	}
+
+	return copies
+}
+
+// Lookup is what the decision path reads while planning. The service reads
+// redis and Plex, the simulator a virtual cache and recorded metadata.
+type Lookup interface {
+	CachedEpisode(ctx context.Context, ratingKey string) (models.EpisodeCache, bool, error)
+	ShowHistory(ctx context.Context, payload models.Payload) (models.ShowHistory, error)
+	SeasonMetadata(ctx context.Context, payload models.Payload) (models.SeasonMetadataResponse, error)
+	FreeSpace() (uint64, error)
+}
+
+// playingLookup is implemented by Lookups that know the version a player is
+// playing, for VersionPlayed.
+type playingLookup interface {
+	PlayingMedia(ctx context.Context, payload models.Payload) (models.Media, bool, error)
+}
+
+type liveLookup struct {
+	deps Deps
+	// peek reads through the metadata cache without filling it.
+	peek bool
+}
+
+func (l liveLookup) CachedEpisode(ctx context.Context, ratingKey string) (models.EpisodeCache, bool, error) {
+	return redisH.GetCachedEpisode(ctx, l.deps.Redis, l.deps.Server, ratingKey)
+}
+
+func (l liveLookup) ShowHistory(ctx context.Context, payload models.Payload) (models.ShowHistory, error) {
+	return redisH.GetShowHistory(ctx, l.deps.Redis, l.deps.Server, payload)
+}
+
+func (l liveLookup) SeasonMetadata(ctx context.Context, payload models.Payload) (models.SeasonMetadataResponse, error) {
+	if peeker, ok := l.deps.Plex.(plex.Peeker); ok && l.peek {
+		return peeker.PeekSeasonMetadata(ctx, payload)
+	}
+	return l.deps.Plex.GetSeasonMetadata(ctx, payload)
+}
+
+func (l liveLookup) PlayingMedia(ctx context.Context, payload models.Payload) (models.Media, bool, error) {
+	reader, ok := l.deps.Plex.(plex.SessionReader)
+	if !ok {
+		return models.Media{}, false, nil
+	}
+	return reader.PlayingMedia(ctx, payload)
+}
+
+func (l liveLookup) FreeSpace() (uint64, error) {
+	return utils.FreeSpace(l.deps.CacheRoot)
+}
+
+// Planner runs the decision path against a Lookup.
+type Planner struct {
+	Policy    *policy.Policy
+	CacheRoot string
+	Paths     []models.PathMapping
+	// Server namespaces the planned records, see Deps.Server.
+	Server string
+	Lookup Lookup
+	// Versions chooses the versions of episodes with several, empty meaning
+	// VersionPlayed.
+	Versions VersionPolicy
+	// DryRun skips the free space check.
+	DryRun bool
+}
+
+// PlanCache runs the whole decision path for a webhook against redis and
+// Plex.
+func PlanCache(ctx context.Context, deps Deps, payload models.Payload) (Plan, error) {
+	return livePlanner(deps, liveLookup{deps: deps}).Plan(ctx, payload)
+}
+
+// PreviewCache is PlanCache without side effects: season metadata missing
+// from the metadata cache is read from Plex but not stored.
+func PreviewCache(ctx context.Context, deps Deps, payload models.Payload) (Plan, error) {
+	return livePlanner(deps, liveLookup{deps: deps, peek: true}).Plan(ctx, payload)
+}
+
+func livePlanner(deps Deps, lookup Lookup) Planner {
+	return Planner{
+		Policy:    deps.Policy,
+		CacheRoot: deps.CacheRoot,
+		Paths:     deps.Paths,
+		Server:    deps.Server,
+		Lookup:    lookup,
+		Versions:  deps.Versions,
+		DryRun:    deps.DryRun,
+	}
+}
+
+// Plan runs the decision path: already cached, policy admission, season
+// metadata, window and free space.
+func (p Planner) Plan(ctx context.Context, payload models.Payload) (Plan, error) {
+	plan := Plan{Event: payload.Event, RatingKey: payload.Metadata.RatingKey, DryRun: p.DryRun}
+
+	if isAlreadyCached(ctx, p.Lookup, payload) {
+		return plan.skip(fmt.Sprintf("already cached: %s is cached and is not the last cached episode", payload.Metadata.RatingKey)), nil
+	}
+
+	history, err := p.Lookup.ShowHistory(ctx, payload)
+	if err != nil {
+		slog.WarnContext(ctx, "could not read the show history", "err", err)
+	}
+
+	decision, err := canCache(p.Policy, payload, history)
+	if err != nil {
+		return plan, err
+	}
+
+	plan.Decision = &decision
+	if !decision.Cache {
+		return plan.skip(fmt.Sprintf("policy rule %q: %s", decision.Rule, decision.Reason)), nil
+	}
+	plan.Reasons = append(plan.Reasons, fmt.Sprintf("policy rule %q admitted the event", decision.Rule))
+
+	seasonMetadata, err := p.Lookup.SeasonMetadata(ctx, payload)
+	if err != nil {
+		return plan, fmt.Errorf("failed to fetch season metadata: %w", err)
+	}
+
+	window, err := p.Policy.WindowFor(policy.Input{Payload: payload, History: history, Season: &seasonMetadata})
+	if err != nil {
+		return plan, err
+	}
+
+	plan.Window = &window
+	first := payload.Metadata.Index + window.Offset
+	plan.Reasons = append(plan.Reasons, fmt.Sprintf("window rule %q: episodes %d-%d", window.Rule, first, first+window.Count-1))
+
+	paths := p.Paths
+	if paths == nil {
+		paths = DefaultPaths
+	}
+
+	versions := versionPicker{policy: p.Versions}
+	if versions.policy == "" {
+		versions.policy = VersionPlayed
+	}
+	if versions.policy == VersionPlayed && hasVersions(seasonMetadata, first, first+window.Count-1) {
+		versions.playing = p.playingMedia(ctx, payload)
+	}
+
+	var skipped []string
+	plan.Episodes, skipped = getEpisodeCache(p.Server, payload, seasonMetadata, window, paths, versions)
+	plan.Reasons = append(plan.Reasons, skipped...)
+	if len(plan.Episodes) == 0 {
+		return plan.skip("no episodes in the window"), nil
+	}
+
+	plan.Copies = planCopies(p.CacheRoot, plan.Episodes)
+	for _, c := range plan.Copies {
+		plan.TotalBytes += c.Bytes
+	}
+
+	if p.DryRun {
+		plan.Cache = true
+		plan.Reasons = append(plan.Reasons, fmt.Sprintf("%d files, %d bytes, dry-run: free space not checked", len(plan.Copies), plan.TotalBytes))
+		return plan, nil
+	}
+
+	free, err := p.Lookup.FreeSpace()
+	if err != nil {
+		return plan.skip(fmt.Sprintf("could not read free space of %s: %v", p.CacheRoot, err)), nil
+	}
+
+	plan.FreeBytes = free
+	if uint64(plan.TotalBytes) > free {
+		plan.NoSpace = true
+		return plan.skip(fmt.Sprintf("needs %d bytes but %s has %d free", plan.TotalBytes, p.CacheRoot, free)), nil
+	}
+
+	plan.Cache = true
+	plan.Reasons = append(plan.Reasons, fmt.Sprintf("%d files, %d bytes, %d free", len(plan.Copies), plan.TotalBytes, free))
+
+	return plan, nil
+}
+
+// playingMedia asks the Lookup for the version the triggering player is
+// playing. Not knowing it only falls back to the first version.
+func (p Planner) playingMedia(ctx context.Context, payload models.Payload) *models.Media {
+	reader, ok := p.Lookup.(playingLookup)
+	if !ok {
+		return nil
+	}
+
+	media, found, err := reader.PlayingMedia(ctx, payload)
+	if err != nil {
+		slog.WarnContext(ctx, "could not read the played version", "err", err)
+		return nil
+	}
+	if !found {
+		return nil
+	}
+
+	return &media
+}
+
+// PlanHandler accepts the same multipart body as the webhook and responds
+// with what would be cached, without caching anything.
+func PlanHandler(deps Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, _ := requestContext(w, r)
+		payload, err := parsemodels(ctx, r)
+
+		if err != nil {
+			http.Error(w, "No payload found", http.StatusBadRequest)
+			return
+		}
+
+		deps, err := deps.ForServer(payload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		plan, err := PreviewCache(ctx, deps, payload)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(plan)
+	}
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"plexcache/models"
+	"plexcache/plex"
+	"plexcache/plex/plextest"
+	"plexcache/policy"
+	redisH "plexcache/redis"
+
+	"github.com/LukeHagar/plexgo"
+)
+
+// planLookup is a Lookup answering from fields.
+type planLookup struct {
+	cached    map[string]models.EpisodeCache
+	history   models.ShowHistory
+	season    models.SeasonMetadataResponse
+	seasonErr error
+	free      uint64
+	freeErr   error
+}
+
+func (l planLookup) CachedEpisode(_ context.Context, ratingKey string) (models.EpisodeCache, bool, error) {
+	episode, found := l.cached[ratingKey]
+	return episode, found, nil
+}
+
+func (l planLookup) ShowHistory(context.Context, models.Payload) (models.ShowHistory, error) {
+	return l.history, nil
+}
+
+func (l planLookup) SeasonMetadata(context.Context, models.Payload) (models.SeasonMetadataResponse, error) {
+	return l.season, l.seasonErr
+}
+
+func (l planLookup) FreeSpace() (uint64, error) {
+	return l.free, l.freeErr
+}
+
+func TestPlannerPlan(t *testing.T) {
+	season := plextest.Season(t, "200")
+	// episodes 3 to 6 of the play of episode 2
+	const window = 1203 + 1204 + 1205 + 1206
+
+	for _, tc := range []struct {
+		name    string
+		lookup  planLookup
+		payload models.Payload
+		dryRun  bool
+		cache   bool
+		noSpace bool
+		reasons []string
+	}{
+		{
+			name:    "cached",
+			lookup:  planLookup{season: season, free: window, cached: map[string]models.EpisodeCache{"202": {RatingKey: "202"}}},
+			payload: plextest.Payload(t, "media.play"),
+			reasons: []string{"already cached: 202 is cached and is not the last cached episode"},
+		},
+		{
+			name:    "last cached",
+			lookup:  planLookup{season: season, free: window, cached: map[string]models.EpisodeCache{"202": {RatingKey: "202", IsLast: true}}},
+			payload: plextest.Payload(t, "media.play"),
+			cache:   true,
+			reasons: []string{
+				`policy rule "default" admitted the event`,
+				`window rule "default": episodes 3-6`,
+				"4 files, 4818 bytes, 4818 free",
+			},
+		},
+		{
+			name:    "not a playback start",
+			lookup:  planLookup{season: season},
+			payload: plextest.Payload(t, "media.pause"),
+			reasons: []string{`policy rule "playback-events": event is not a playback start`},
+		},
+		{
+			name:    "first episode",
+			lookup:  planLookup{season: season},
+			payload: plextest.Payload(t, "media.play.first-episode"),
+			reasons: []string{`policy rule "skip-first-episode": first season or first episode`},
+		},
+		{
+			name:    "end of season",
+			lookup:  planLookup{season: season, free: window},
+			payload: playing(t, 8),
+			reasons: []string{
+				`policy rule "default" admitted the event`,
+				`window rule "default": episodes 9-12`,
+				"no episodes in the window",
+			},
+		},
+		{
+			name:    "no space",
+			lookup:  planLookup{season: season, free: window - 1},
+			payload: plextest.Payload(t, "media.play"),
+			noSpace: true,
+			reasons: []string{
+				`policy rule "default" admitted the event`,
+				`window rule "default": episodes 3-6`,
+				"needs 4818 bytes but /cache has 4817 free",
+			},
+		},
+		{
+			name:    "free space unknown",
+			lookup:  planLookup{season: season, freeErr: errors.New("no such file or directory")},
+			payload: plextest.Payload(t, "media.play"),
+			reasons: []string{
+				`policy rule "default" admitted the event`,
+				`window rule "default": episodes 3-6`,
+				"could not read free space of /cache: no such file or directory",
+			},
+		},
+		{
+			name:    "dry-run",
+			lookup:  planLookup{season: season},
+			payload: plextest.Payload(t, "media.play"),
+			dryRun:  true,
+			cache:   true,
+			reasons: []string{
+				`policy rule "default" admitted the event`,
+				`window rule "default": episodes 3-6`,
+				"4 files, 4818 bytes, dry-run: free space not checked",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			planner := Planner{Policy: policy.Default(), CacheRoot: "/cache", Lookup: tc.lookup, DryRun: tc.dryRun}
+
+			plan, err := planner.Plan(t.Context(), tc.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plan.Cache != tc.cache || !slices.Equal(plan.Reasons, tc.reasons) {
+				t.Fatalf("got cache %v for %q, want %v for %q", plan.Cache, plan.Reasons, tc.cache, tc.reasons)
+			}
+			if plan.NoSpace != tc.noSpace {
+				t.Fatalf("got no space %v, want %v", plan.NoSpace, tc.noSpace)
+			}
+			if tc.cache && (len(plan.Episodes) != 4 || plan.TotalBytes != window) {
+				t.Fatalf("got %d episodes, %d bytes", len(plan.Episodes), plan.TotalBytes)
+			}
+		})
+	}
+}
+
+func TestPlannerPlanSeasonError(t *testing.T) {
+	planner := Planner{Policy: policy.Default(), CacheRoot: "/cache", Lookup: planLookup{seasonErr: errors.New("plex is down")}}
+
+	if _, err := planner.Plan(t.Context(), plextest.Payload(t, "media.play")); err == nil {
+		t.Fatal("expected an error without season metadata")
+	}
+}
+
+func TestPreviewCacheDoesNotWrite(t *testing.T) {
+	env := newTestEnv(t)
+	env.deps.DryRun = true
+	env.deps.Plex = plex.NewCachingClient(plex.NewClient(plexgo.New(
+		plexgo.WithSecurity(plextest.Token),
+		plexgo.WithServerURL(env.plex.URL),
+	)), redisH.NewMetadataStore(env.deps.Redis, ""), time.Minute)
+
+	plan, err := PreviewCache(t.Context(), env.deps, plextest.Payload(t, "media.play"))
+	if err != nil || !plan.Cache {
+		t.Fatalf("got %+v, %v", plan, err)
+	}
+
+	if keys := env.redis.Keys(); len(keys) != 0 {
+		t.Fatalf("previewing wrote %q", keys)
+	}
+
+	// the webhook fills the metadata cache
+	if _, err := PlanCache(t.Context(), env.deps, plextest.Payload(t, "media.play")); err != nil {
+		t.Fatal(err)
+	}
+	if !env.redis.Exists("plex-cache:metadata:200") {
+		t.Fatal("planning a webhook did not cache the season")
+	}
+}
+
+func TestUsageMatchesPlan(t *testing.T) {
+	env := newTestEnv(t)
+
+	plan, err := PreviewCache(t.Context(), env.deps, plextest.Payload(t, "media.play"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the media and the subtitles of episodes 3 and 5
+	if len(plan.Copies) != 6 || plan.TotalBytes != 1203+1204+1205+1206+2*64 {
+		t.Fatalf("planned %d copies of %d bytes", len(plan.Copies), plan.TotalBytes)
+	}
+
+	env.cacheSeason(t)
+	if got := env.usageBytes(t); got != plan.TotalBytes {
+		t.Fatalf("got %d bytes in use, planned %d", got, plan.TotalBytes)
+	}
+}
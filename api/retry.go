@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"plexcache/logging"
+	"plexcache/metrics"
+	"plexcache/models"
+	"plexcache/plex"
+	redisH "plexcache/redis"
+)
+
+const maxRetryAttempts = 8
+
+func newRetryItem(payload models.Payload) models.RetryItem {
+	now := time.Now()
+
+	return models.RetryItem{
+		ID:       fmt.Sprintf("%d-%s", now.UnixNano(), payload.Metadata.RatingKey),
+		Payload:  payload,
+		QueuedAt: now.Unix(),
+	}
+}
+
+// retryDelay is a minute after the first attempt and doubles with each
+// further one up to an hour, with up to 20% jitter.
+func retryDelay(attempts int) time.Duration {
+	delay := min(time.Minute<<max(attempts-1, 0), time.Hour)
+	return delay + rand.N(delay/5)
+}
+
+// deferRetry queues a webhook that failed because Plex was unavailable, or
+// moves it to the dead letters once it ran out of attempts. A webhook
+// waiting for a busy show lock is queued again without using an attempt.
+func deferRetry(ctx context.Context, deps Deps, item models.RetryItem, cause error) {
+	item.LastError = cause.Error()
+
+	if errors.Is(cause, redisH.ErrLocked) {
+		metrics.Inc("plexcache_retries_total", "Deferred webhooks by outcome.", "outcome", "locked")
+		if err := redisH.EnqueueRetry(ctx, deps.Redis, item, time.Now().Add(max(deps.ShowLockTTL, time.Second))); err != nil {
+			slog.ErrorContext(ctx, "could not queue retry, webhook lost", "retry", item.ID, "err", err)
+		}
+		return
+	}
+
+	item.Attempts++
+
+	if item.Attempts >= maxRetryAttempts {
+		slog.WarnContext(ctx, "giving up on webhook", "retry", item.ID, "attempts", item.Attempts)
+		metrics.Inc("plexcache_retries_total", "Deferred webhooks by outcome.", "outcome", "dead")
+		if err := redisH.DeadLetter(ctx, deps.Redis, item); err != nil {
+			slog.ErrorContext(ctx, "could not dead letter", "retry", item.ID, "err", err)
+		}
+		return
+	}
+
+	metrics.Inc("plexcache_retries_total", "Deferred webhooks by outcome.", "outcome", "queued")
+	if err := redisH.EnqueueRetry(ctx, deps.Redis, item, time.Now().Add(retryDelay(item.Attempts))); err != nil {
+		slog.ErrorContext(ctx, "could not queue retry, webhook lost", "retry", item.ID, "err", err)
+	}
+}
+
+// retryDue processes the queued webhooks that are due.
+func retryDue(ctx context.Context, deps Deps, now time.Time) {
+	items, err := redisH.ClaimDueRetries(ctx, deps.Redis, now, 20)
+	if err != nil {
+		slog.ErrorContext(ctx, "could not read retry queue", "err", err)
+		return
+	}
+
+	for _, item := range items {
+		ctx := logging.With(ctx, "retry", item.ID)
+
+		deps, err := deps.ForServer(item.Payload)
+		if err != nil {
+			slog.WarnContext(ctx, "dropping retry", "err", err)
+			continue
+		}
+
+		unlock, err := lockShow(ctx, deps, item.Payload)
+		if err != nil {
+			deferRetry(ctx, deps, item, err)
+			continue
+		}
+
+		plan, err := PlanCache(ctx, deps, item.Payload)
+
+		if plex.IsRetryable(err) {
+			unlock()
+			deferRetry(ctx, deps, item, err)
+			continue
+		}
+
+		if err == nil && plan.Cache {
+			// like webhook copies, only shutdown cancels it
+			err = cacheEpisodes(context.WithoutCancel(ctx), deps, plan)
+		}
+		unlock()
+
+		if errors.Is(err, ErrShuttingDown) {
+			if err := redisH.EnqueueRetry(context.WithoutCancel(ctx), deps.Redis, item, now); err != nil {
+				slog.ErrorContext(ctx, "could not queue retry, webhook lost", "err", err)
+			}
+			continue
+		}
+
+		if err != nil {
+			slog.ErrorContext(ctx, "retry failed", "err", err)
+			item.LastError = err.Error()
+			metrics.Inc("plexcache_retries_total", "Deferred webhooks by outcome.", "outcome", "dead")
+			if err := redisH.DeadLetter(ctx, deps.Redis, item); err != nil {
+				slog.ErrorContext(ctx, "could not dead letter", "err", err)
+			}
+			continue
+		}
+
+		slog.InfoContext(ctx, "retry done")
+		metrics.Inc("plexcache_retries_total", "Deferred webhooks by outcome.", "outcome", "done")
+	}
+}
+
+// RunRetries processes the retry queue every interval until ctx is done.
+func RunRetries(ctx context.Context, deps Deps, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			retryDue(ctx, deps, now)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+
+	"plexcache/models"
+	"plexcache/plex"
+)
+
+// ErrUnknownServer is returned for webhooks from a server missing from
+// Deps.Servers.
+var ErrUnknownServer = errors.New("unknown Plex server")
+
+// Server is one of several Plex servers plex-cache caches for, selected by
+// the Server.uuid of the webhook. Its cache records are namespaced by UUID
+// so rating keys of different servers never collide.
+type Server struct {
+	UUID  string
+	Name  string
+	Plex  plex.MetadataClient
+	Paths []models.PathMapping
+	// Connection is used to check that the server is reachable.
+	Connection plex.Connection
+}
+
+// ForServer returns the deps for the server that sent the payload. Without
+// Servers there is a single server and deps are returned as they are.
+func (deps Deps) ForServer(payload models.Payload) (Deps, error) {
+	if len(deps.Servers) == 0 {
+		return deps, nil
+	}
+
+	server, ok := deps.Servers[payload.Server.UUID]
+	if !ok {
+		return deps, fmt.Errorf("%w %q (%s)", ErrUnknownServer, payload.Server.Title, payload.Server.UUID)
+	}
+
+	deps.Server = server.UUID
+	deps.Plex = server.Plex
+	deps.Paths = server.Paths
+	deps.PlexConnection = server.Connection
+
+	return deps, nil
+}
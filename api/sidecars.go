@@ -0,0 +1,87 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	s "strings"
+
+	"plexcache/models"
+)
+
+// sidecarExtensions are the subtitle files Plex picks up next to a video,
+// including language, .forced and .sdh variants like Episode.en.forced.srt.
+var sidecarExtensions = map[string]bool{
+	".srt": true,
+	".ass": true,
+	".ssa": true,
+	".vtt": true,
+	".sup": true,
+	".idx": true,
+	".sub": true,
+}
+
+// subtitleStream is the Plex stream type of subtitles.
+const subtitleStream = 3
+
+// findSidecars returns the sidecar files of an episode that exist: the files
+// of the external subtitle streams Plex reports, and the subtitle files in
+// the episode's directory named after it.
+func findSidecars(paths []models.PathMapping, episodePath string, streams []models.StreamPart) []string {
+	var sidecars []string
+
+	add := func(path string) {
+		if _, err := os.Stat(path); err == nil && !slices.Contains(sidecars, path) {
+			sidecars = append(sidecars, path)
+		}
+	}
+
+	for _, stream := range streams {
+		if stream.StreamType != subtitleStream || stream.File == "" {
+			continue
+		}
+
+		file := formatEpisodePath(paths, stream.File)
+		add(file)
+
+		// VobSub images are in the .sub next to the .idx index
+		if s.EqualFold(filepath.Ext(file), ".idx") {
+			add(s.TrimSuffix(file, filepath.Ext(file)) + ".sub")
+		}
+	}
+
+	dir := filepath.Dir(episodePath)
+	base := s.TrimSuffix(filepath.Base(episodePath), filepath.Ext(episodePath))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return sidecars
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !sidecarExtensions[s.ToLower(filepath.Ext(name))] {
+			continue
+		}
+
+		// Episode.srt or Episode.<language and flags>.srt, not Episode 10.srt
+		stem := s.TrimSuffix(name, filepath.Ext(name))
+		if stem == base || s.HasPrefix(stem, base+".") {
+			add(filepath.Join(dir, name))
+		}
+	}
+
+	return sidecars
+}
+
+// sidecarSize is the size of the sidecars of an episode together.
+func sidecarSize(sidecars []string) int64 {
+	var size int64
+	for _, sidecar := range sidecars {
+		if info, err := os.Stat(sidecar); err == nil {
+			size += info.Size()
+		}
+	}
+
+	return size
+}
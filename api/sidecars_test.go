@@ -0,0 +1,84 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"plexcache/models"
+)
+
+func TestFindSidecars(t *testing.T) {
+	root := t.TempDir()
+	season := filepath.Join(root, "Show", "Season 01")
+	subs := filepath.Join(root, "Subs")
+
+	for _, name := range []string{
+		filepath.Join(season, "Show - S01E01.mkv"),
+		filepath.Join(season, "Show - S01E01.srt"),
+		filepath.Join(season, "Show - S01E01.en.srt"),
+		filepath.Join(season, "Show - S01E01.en.forced.srt"),
+		filepath.Join(season, "Show - S01E01.eng.sdh.SRT"),
+		filepath.Join(season, "Show - S01E01.ass"),
+		filepath.Join(season, "Show - S01E01.de.ssa"),
+		filepath.Join(season, "Show - S01E01.vtt"),
+		filepath.Join(season, "Show - S01E01.sup"),
+		filepath.Join(season, "Show - S01E01.idx"),
+		filepath.Join(season, "Show - S01E01.sub"),
+		// not sidecars of episode 1
+		filepath.Join(season, "Show - S01E01.nfo"),
+		filepath.Join(season, "Show - S01E01-thumb.jpg"),
+		filepath.Join(season, "Show - S01E010.en.srt"),
+		filepath.Join(season, "Show - S01E02.en.srt"),
+		// reported by Plex
+		filepath.Join(subs, "episode one.idx"),
+		filepath.Join(subs, "episode one.sub"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths := []models.PathMapping{{Plex: "/data", Local: root}}
+	streams := []models.StreamPart{
+		{StreamType: subtitleStream, Key: "/library/streams/1", File: "/data/Subs/episode one.idx"},
+		{StreamType: subtitleStream, Key: "/library/streams/2", File: "/data/Subs/missing.srt"},
+		{StreamType: 1, Codec: "h264"},
+	}
+
+	got := findSidecars(paths, filepath.Join(season, "Show - S01E01.mkv"), streams)
+
+	want := []string{
+		filepath.Join(subs, "episode one.idx"),
+		filepath.Join(subs, "episode one.sub"),
+	}
+	for _, name := range []string{"srt", "en.srt", "en.forced.srt", "eng.sdh.SRT", "ass", "de.ssa", "vtt", "sup", "idx", "sub"} {
+		want = append(want, filepath.Join(season, "Show - S01E01."+name))
+	}
+
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %q\nwant %q", got, want)
+	}
+
+	if got := findSidecars(paths, filepath.Join(root, "missing", "episode.mkv"), nil); len(got) != 0 {
+		t.Fatalf("got %q for a missing directory", got)
+	}
+}
+
+func TestSidecarsOfOldRecords(t *testing.T) {
+	old := models.EpisodeCache{SrtFilePaths: []string{"a.en.srt"}}
+	current := models.EpisodeCache{SidecarFilePaths: []string{"a.en.forced.srt", "a.ass"}}
+
+	if got := old.Sidecars(); !slices.Equal(got, []string{"a.en.srt"}) {
+		t.Fatalf("got %q", got)
+	}
+	if got := current.Sidecars(); !slices.Equal(got, []string{"a.en.forced.srt", "a.ass"}) {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,392 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"plexcache/logging"
+	"plexcache/metrics"
+	"plexcache/models"
+	redisH "plexcache/redis"
+	"plexcache/utils"
+)
+
+// The outcomes of checking the sources of a cached episode.
+const (
+	sourceUnchanged   = "unchanged"
+	sourceRecopied    = "recopied"
+	sourceInvalidated = "invalidated"
+)
+
+// errSourceUnmounted is returned for a missing source whose directory is
+// missing too: an unmounted drive rather than a replaced file.
+var errSourceUnmounted = errors.New("source directory is missing")
+
+// statSource describes a media file as it is now.
+func statSource(path string, hash bool) (models.SourceStat, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return models.SourceStat{}, err
+	}
+
+	stat := models.SourceStat{Path: path, Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+	if hash {
+		stat.Hash, err = utils.SampleHash(path)
+	}
+
+	return stat, err
+}
+
+// sourceStats describes the media files of an episode before they are
+// copied. Files that cannot be read are left out, their copy fails anyway.
+func sourceStats(ctx context.Context, item models.EpisodeCache, hash bool) []models.SourceStat {
+	var stats []models.SourceStat
+	for _, file := range item.Files() {
+		stat, err := statSource(file.Path, hash)
+		if err != nil {
+			slog.WarnContext(ctx, "could not read source", "file", file.Path, "err", err)
+			continue
+		}
+		stats = append(stats, stat)
+	}
+
+	return stats
+}
+
+// compareSource tells whether a source differs from what was copied. A file
+// that was only touched is the same when its hash was recorded and did not
+// change. The current stat is returned either way.
+func compareSource(recorded models.SourceStat, hash bool) (models.SourceStat, bool, error) {
+	current, err := statSource(recorded.Path, false)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Dir(recorded.Path)); err != nil {
+			return current, false, fmt.Errorf("%w: %s", errSourceUnmounted, filepath.Dir(recorded.Path))
+		}
+	}
+	if err != nil {
+		return current, false, err
+	}
+
+	if current.Size == recorded.Size && current.ModTime == recorded.ModTime {
+		return recorded, false, nil
+	}
+
+	if recorded.Hash != "" || hash {
+		if current.Hash, err = utils.SampleHash(recorded.Path); err != nil {
+			return current, false, err
+		}
+	}
+
+	changed := current.Size != recorded.Size || recorded.Hash == "" || current.Hash != recorded.Hash
+	return current, changed, nil
+}
+
+// checkSources compares the sources of a cached episode to what was copied.
+// Changed files are copied again, an episode whose source is gone or could
+// not be copied again is dropped from the cache, so mergerfs serves the
+// source again.
+func checkSources(ctx context.Context, deps Deps, item models.EpisodeCache) (string, error) {
+	if !item.Copied || len(item.Sources) == 0 {
+		return sourceUnchanged, nil
+	}
+
+	var current, changed []models.SourceStat
+	for _, recorded := range item.Sources {
+		stat, differs, err := compareSource(recorded, deps.HashSources)
+		if os.IsNotExist(err) {
+			return sourceInvalidated, invalidateEpisode(ctx, deps, item, fmt.Sprintf("source %s is gone", recorded.Path))
+		}
+		if err != nil {
+			return "", err
+		}
+
+		current = append(current, stat)
+		if differs {
+			changed = append(changed, stat)
+		}
+	}
+
+	if len(changed) == 0 {
+		if !slices.Equal(current, item.Sources) {
+			// touched only, remember the new times
+			item.Sources = current
+			return sourceUnchanged, updateSources(ctx, redisH.UpdateCachedEpisode(ctx, deps.Redis, item))
+		}
+		return sourceUnchanged, nil
+	}
+
+	copies, err := recopySources(ctx, deps, item, changed)
+	if err != nil {
+		slog.WarnContext(ctx, "could not copy changed sources again", "ratingKey", item.RatingKey, "err", err)
+		return sourceInvalidated, invalidateEpisode(ctx, deps, item, fmt.Sprintf("copying changed sources failed: %v", err))
+	}
+
+	updated := item
+	updated.Sources = current
+	files := item.Files()
+	for i, file := range files {
+		if copied, ok := copies[file.Path]; ok {
+			files[i].Size, files[i].Hash = copied.Bytes, copied.Hash
+		}
+	}
+	updated.SetFiles(files)
+
+	return sourceRecopied, updateSources(ctx, redisH.UpdateCopiedEpisode(ctx, deps.Redis, updated))
+}
+
+// updateSources passes on the error of writing the checked sources back,
+// but for a record that changed since it was read. The check of the new
+// record is left to the next round.
+func updateSources(ctx context.Context, err error) error {
+	if errors.Is(err, redisH.ErrRecordChanged) {
+		slog.DebugContext(ctx, "record changed while its sources were checked")
+		return nil
+	}
+
+	return err
+}
+
+// recopySources copies changed sources over their cached copies as a job
+// and returns the copies by source.
+func recopySources(ctx context.Context, deps Deps, item models.EpisodeCache, changed []models.SourceStat) (map[string]utils.Copy, error) {
+	for _, stat := range changed {
+		slog.InfoContext(ctx, "source changed", "file", stat.Path, "size", stat.Size)
+	}
+
+	if deps.DryRun {
+		slog.InfoContext(ctx, "dry-run: would copy changed sources again", "ratingKey", item.RatingKey)
+		return nil, nil
+	}
+
+	ctx, done, err := deps.Jobs.start(context.WithoutCancel(ctx), Plan{Event: "source.changed", RatingKey: item.RatingKey, Episodes: []models.EpisodeCache{item}})
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	copies := map[string]utils.Copy{}
+	for _, stat := range changed {
+		copied, err := deps.Jobs.copyOnce(ctx, stat.Path, deps.CacheRoot+stat.Path, 0)
+		if err != nil {
+			return nil, err
+		}
+		copies[stat.Path] = copied
+	}
+
+	return copies, nil
+}
+
+// invalidateEpisode drops an episode from the cache without counting it as
+// expired.
+func invalidateEpisode(ctx context.Context, deps Deps, item models.EpisodeCache, reason string) error {
+	slog.InfoContext(ctx, "invalidating cached episode", "ratingKey", item.RatingKey, "show", item.GrandparentTitle, "episode", item.Title, "reason", reason)
+
+	unshared, err := redisH.ForgetCachedEpisodes(ctx, deps.Redis, []models.EpisodeCache{item})
+	if err != nil {
+		return err
+	}
+
+	if deps.DryRun {
+		return nil
+	}
+
+	for _, path := range unshared {
+		if err := utils.RemoveFile(deps.CacheRoot + path); err != nil {
+			slog.ErrorContext(ctx, "failed to remove file", "file", path, "err", err)
+		}
+	}
+
+	return nil
+}
+
+// SourceCheck counts the outcomes of checking the cached episodes.
+type SourceCheck struct {
+	Checked     int `json:"checked"`
+	Recopied    int `json:"recopied"`
+	Invalidated int `json:"invalidated"`
+	Errors      int `json:"errors"`
+}
+
+func (c *SourceCheck) add(ctx context.Context, outcome string, err error) {
+	c.Checked++
+	switch countSourceCheck(ctx, outcome, err) {
+	case sourceRecopied:
+		c.Recopied++
+	case sourceInvalidated:
+		c.Invalidated++
+	case "error":
+		c.Errors++
+	}
+}
+
+// countSourceCheck logs a failed check and counts the outcome.
+func countSourceCheck(ctx context.Context, outcome string, err error) string {
+	if err != nil {
+		slog.WarnContext(ctx, "could not check sources", "err", err)
+		outcome = "error"
+	}
+
+	metrics.Inc("plexcache_source_checks_total", "Cached episodes checked against their sources by outcome.", "outcome", outcome)
+	return outcome
+}
+
+// CheckSources checks the sources of every cached episode.
+func CheckSources(ctx context.Context, deps Deps) (SourceCheck, error) {
+	var check SourceCheck
+
+	episodes, err := redisH.ListCachedEpisodes(ctx, deps.Redis)
+	if err != nil {
+		return check, err
+	}
+
+	var kept []models.EpisodeCache
+	for _, item := range episodes {
+		ctx := logging.With(ctx, "ratingKey", item.RatingKey)
+		outcome, err := checkSources(ctx, deps, item)
+		check.add(ctx, outcome, err)
+		if outcome != sourceInvalidated {
+			kept = append(kept, item)
+		}
+	}
+
+	deps.Sources.track(ctx, kept)
+
+	return check, nil
+}
+
+// RunSourceChecks checks the sources of the cached episodes right away, for
+// changes made while plex-cache was not running, and then every interval
+// until ctx is done.
+func RunSourceChecks(ctx context.Context, deps Deps, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		check, err := CheckSources(ctx, deps)
+		if err != nil {
+			slog.ErrorContext(ctx, "could not check sources", "err", err)
+		} else if check.Recopied > 0 || check.Invalidated > 0 || check.Errors > 0 {
+			slog.InfoContext(ctx, "checked sources", "checked", check.Checked, "recopied", check.Recopied, "invalidated", check.Invalidated, "errors", check.Errors)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type recordRef struct {
+	server    string
+	ratingKey string
+}
+
+// SourceWatcher checks cached episodes as soon as their sources change,
+// between the periodic checks. It watches the directories of the sources of
+// cached episodes with inotify.
+type SourceWatcher struct {
+	watcher *utils.Watcher
+
+	mu      sync.Mutex
+	sources map[string][]recordRef
+}
+
+func NewSourceWatcher() (*SourceWatcher, error) {
+	watcher, err := utils.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SourceWatcher{watcher: watcher, sources: map[string][]recordRef{}}, nil
+}
+
+// add watches the sources of a newly cached episode.
+func (w *SourceWatcher) add(ctx context.Context, item models.EpisodeCache) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ref := recordRef{server: item.Server, ratingKey: item.RatingKey}
+	for _, source := range item.Sources {
+		if !slices.Contains(w.sources[source.Path], ref) {
+			w.sources[source.Path] = append(w.sources[source.Path], ref)
+		}
+		if err := w.watcher.Watch(filepath.Dir(source.Path)); err != nil {
+			slog.WarnContext(ctx, "could not watch source directory", "err", err)
+		}
+	}
+}
+
+// track watches the sources of the cached episodes and nothing else.
+func (w *SourceWatcher) track(ctx context.Context, episodes []models.EpisodeCache) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	w.sources = map[string][]recordRef{}
+	w.mu.Unlock()
+
+	for _, item := range episodes {
+		w.add(ctx, item)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	needed := map[string]bool{}
+	for path := range w.sources {
+		needed[filepath.Dir(path)] = true
+	}
+	for _, dir := range w.watcher.Dirs() {
+		if !needed[dir] {
+			w.watcher.Unwatch(dir)
+		}
+	}
+}
+
+// Run checks the episodes of changed sources until ctx is done.
+func (w *SourceWatcher) Run(ctx context.Context, deps Deps) {
+	stop := context.AfterFunc(ctx, func() { w.watcher.Close() })
+	defer stop()
+
+	err := w.watcher.Run(func(path string) {
+		if path == "" {
+			slog.WarnContext(ctx, "missed source changes, checking all sources")
+			if _, err := CheckSources(ctx, deps); err != nil {
+				slog.ErrorContext(ctx, "could not check sources", "err", err)
+			}
+			return
+		}
+
+		w.mu.Lock()
+		refs := slices.Clone(w.sources[path])
+		w.mu.Unlock()
+
+		for _, ref := range refs {
+			ctx := logging.With(ctx, "ratingKey", ref.ratingKey)
+
+			item, found, err := redisH.GetCachedEpisode(ctx, deps.Redis, ref.server, ref.ratingKey)
+			if err != nil || !found {
+				continue
+			}
+
+			outcome, err := checkSources(ctx, deps, item)
+			countSourceCheck(ctx, outcome, err)
+		}
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "stopped watching sources", "err", err)
+	}
+}
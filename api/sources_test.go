@@ -0,0 +1,165 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	redisH "plexcache/redis"
+)
+
+func (env *testEnv) cacheSeason(t *testing.T) {
+	t.Helper()
+	if rec := env.webhook(t, "media.play"); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func (env *testEnv) usageBytes(t *testing.T) int64 {
+	t.Helper()
+	usage, err := redisH.GetUsage(t.Context(), env.deps.Redis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usage.Bytes
+}
+
+func TestCopiesRecordTheirSources(t *testing.T) {
+	env := newTestEnv(t)
+	env.deps.HashSources = true
+	env.cacheSeason(t)
+
+	episode, _, _ := redisH.GetCachedEpisode(t.Context(), env.deps.Redis, "", "203")
+	if len(episode.Sources) != 1 {
+		t.Fatalf("got sources %+v", episode.Sources)
+	}
+
+	source := episode.Sources[0]
+	info, _ := os.Stat(env.episodePath(3))
+	if source.Path != env.episodePath(3) || source.Size != 1203 || source.ModTime != info.ModTime().UnixNano() || source.Hash == "" {
+		t.Fatalf("unexpected source %+v", source)
+	}
+}
+
+func TestCheckSourcesRecopiesChangedSources(t *testing.T) {
+	env := newTestEnv(t)
+	env.cacheSeason(t)
+	before := env.usageBytes(t)
+
+	upgraded := bytes.Repeat([]byte("upgrade"), 300)
+	if err := os.WriteFile(env.episodePath(3), upgraded, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	check, err := CheckSources(t.Context(), env.deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Checked != 4 || check.Recopied != 1 || check.Invalidated != 0 || check.Errors != 0 {
+		t.Fatalf("got %+v", check)
+	}
+
+	cached, err := os.ReadFile(env.deps.CacheRoot + env.episodePath(3))
+	if err != nil || !bytes.Equal(cached, upgraded) {
+		t.Fatalf("cached copy was not replaced: %v", err)
+	}
+
+	episode, _, _ := redisH.GetCachedEpisode(t.Context(), env.deps.Redis, "", "203")
+	if episode.Size != int64(len(upgraded)) || episode.Sources[0].Size != int64(len(upgraded)) || !isHit(env.deps, episode) {
+		t.Fatalf("record not updated: %+v", episode)
+	}
+	if got := env.usageBytes(t); got != before+int64(len(upgraded))-1203 {
+		t.Fatalf("got %d bytes in use, had %d", got, before)
+	}
+
+	// nothing changed since
+	if check, _ := CheckSources(t.Context(), env.deps); check.Recopied != 0 {
+		t.Fatalf("got %+v on the second check", check)
+	}
+}
+
+func TestCheckSourcesInvalidatesRemovedSources(t *testing.T) {
+	env := newTestEnv(t)
+	env.cacheSeason(t)
+
+	if err := os.Remove(env.episodePath(4)); err != nil {
+		t.Fatal(err)
+	}
+
+	check, err := CheckSources(t.Context(), env.deps)
+	if err != nil || check.Invalidated != 1 {
+		t.Fatalf("got %+v, %v", check, err)
+	}
+
+	if _, found, _ := redisH.GetCachedEpisode(t.Context(), env.deps.Redis, "", "204"); found {
+		t.Fatal("record of the removed source was kept")
+	}
+	if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(4)); !os.IsNotExist(err) {
+		t.Fatal("cached copy of the removed source was kept")
+	}
+	if env.redis.Exists("plex-cache:episode:204:plex-expirer") {
+		t.Fatal("expirer of the removed source was kept")
+	}
+}
+
+func TestCheckSourcesKeepsTouchedAndUnmountedSources(t *testing.T) {
+	env := newTestEnv(t)
+	env.deps.HashSources = true
+	env.cacheSeason(t)
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(env.episodePath(3), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	check, err := CheckSources(t.Context(), env.deps)
+	if err != nil || check.Recopied != 0 || check.Invalidated != 0 {
+		t.Fatalf("got %+v, %v for a touched source", check, err)
+	}
+
+	episode, _, _ := redisH.GetCachedEpisode(t.Context(), env.deps.Redis, "", "203")
+	if episode.Sources[0].ModTime != later.UnixNano() {
+		t.Fatal("the new time of the touched source was not recorded")
+	}
+
+	if err := os.RemoveAll(env.media); err != nil {
+		t.Fatal(err)
+	}
+
+	check, err = CheckSources(t.Context(), env.deps)
+	if err != nil || check.Invalidated != 0 || check.Errors != 4 {
+		t.Fatalf("got %+v, %v with the media drive gone", check, err)
+	}
+}
+
+func TestSourceWatcherRecopiesChangedSources(t *testing.T) {
+	watcher, err := NewSourceWatcher()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	env := newTestEnv(t)
+	env.deps.Sources = watcher
+	env.cacheSeason(t)
+
+	go watcher.Run(t.Context(), env.deps)
+
+	upgraded := bytes.Repeat([]byte("upgrade"), 300)
+	if err := os.WriteFile(env.episodePath(5), upgraded, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cached, _ := os.ReadFile(env.deps.CacheRoot + env.episodePath(5))
+		if bytes.Equal(cached, upgraded) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the changed source was not copied again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
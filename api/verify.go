@@ -0,0 +1,250 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+
+	"plexcache/logging"
+	"plexcache/metrics"
+	"plexcache/models"
+	redisH "plexcache/redis"
+	"plexcache/utils"
+)
+
+// CorruptEpisode is a cached episode whose copy does not match its record.
+type CorruptEpisode struct {
+	Server    string `json:"server,omitempty"`
+	RatingKey string `json:"ratingKey"`
+	Show      string `json:"show"`
+	Title     string `json:"title"`
+	File      string `json:"file"`
+	Reason    string `json:"reason"`
+	Evicted   bool   `json:"evicted"`
+}
+
+// VerifyReport is the outcome of rehashing the cached files.
+type VerifyReport struct {
+	// Job is the id of the job that verified, when run through the API.
+	Job      string `json:"job,omitempty"`
+	DryRun   bool   `json:"dryRun"`
+	Episodes int    `json:"episodes"`
+	Files    int    `json:"files"`
+	// Unhashed are files copied before hashes were recorded, only their
+	// size is checked.
+	Unhashed int              `json:"unhashed"`
+	Corrupt  []CorruptEpisode `json:"corrupt"`
+	Errors   int              `json:"errors"`
+}
+
+// verifyFile checks a cached copy against its record and tells what is
+// wrong with it, or nothing.
+func verifyFile(cacheRoot string, file models.CachedFile) (string, bool, error) {
+	info, err := os.Stat(cacheRoot + file.Path)
+	if os.IsNotExist(err) {
+		return "missing", true, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	if file.Size != 0 && info.Size() != file.Size {
+		return fmt.Sprintf("has %d bytes, recorded %d", info.Size(), file.Size), true, nil
+	}
+
+	if file.Hash == "" {
+		return "", false, nil
+	}
+
+	hash, err := utils.HashFile(cacheRoot + file.Path)
+	if err != nil {
+		return "", false, err
+	}
+	if hash != file.Hash {
+		return fmt.Sprintf("hash %s, recorded %s", hash, file.Hash), true, nil
+	}
+
+	return "", false, nil
+}
+
+// Verify rehashes the copies of every cached episode and evicts the
+// episodes with a missing, truncated or corrupted copy, so mergerfs serves
+// the source again and a later webhook caches them again. With dryRun, or
+// in dry-run mode where nothing was copied, it only reports them.
+func Verify(ctx context.Context, deps Deps, dryRun bool) (VerifyReport, error) {
+	report := VerifyReport{DryRun: dryRun || deps.DryRun, Corrupt: []CorruptEpisode{}}
+
+	episodes, err := redisH.ListCachedEpisodes(ctx, deps.Redis)
+	if err != nil {
+		return report, err
+	}
+
+	for _, item := range episodes {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if !item.Copied {
+			continue
+		}
+		ctx := logging.With(ctx, "ratingKey", item.RatingKey)
+		report.Episodes++
+
+		for _, file := range item.Files() {
+			report.Files++
+			if file.Hash == "" {
+				report.Unhashed++
+			}
+
+			reason, corrupt, err := verifyFile(deps.CacheRoot, file)
+			if err != nil {
+				slog.WarnContext(ctx, "could not verify", "file", file.Path, "err", err)
+				metrics.Inc("plexcache_verified_files_total", "Cached files verified by result.", "result", "error")
+				report.Errors++
+				continue
+			}
+			if !corrupt {
+				metrics.Inc("plexcache_verified_files_total", "Cached files verified by result.", "result", "ok")
+				continue
+			}
+
+			metrics.Inc("plexcache_verified_files_total", "Cached files verified by result.", "result", "corrupt")
+			slog.WarnContext(ctx, "corrupt copy", "file", file.Path, "reason", reason)
+
+			found := CorruptEpisode{Server: item.Server, RatingKey: item.RatingKey, Show: item.GrandparentTitle, Title: item.Title, File: file.Path, Reason: reason}
+			if !report.DryRun {
+				found.Evicted, err = evictCorrupt(ctx, deps, item, reason)
+				if err != nil {
+					slog.ErrorContext(ctx, "could not evict", "err", err)
+					report.Errors++
+				}
+			}
+			report.Corrupt = append(report.Corrupt, found)
+			break
+		}
+	}
+
+	return report, nil
+}
+
+// evictCorrupt drops an episode from the cache unless its files were copied
+// again while it was being verified.
+func evictCorrupt(ctx context.Context, deps Deps, verified models.EpisodeCache, reason string) (bool, error) {
+	current, found, err := redisH.GetCachedEpisode(ctx, deps.Redis, verified.Server, verified.RatingKey)
+	if err != nil || !found {
+		return false, err
+	}
+	if !slices.Equal(current.Files(), verified.Files()) {
+		return false, nil
+	}
+
+	if err := invalidateEpisode(ctx, deps, current, "corrupt copy: "+reason); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ErrVerifying is returned when a verification is started while another
+// one is in progress.
+var ErrVerifying = errors.New("already verifying")
+
+// StartVerify runs Verify as a job, listed and cancelled like the caching
+// jobs, and keeps its report for LastVerify.
+func (j *Jobs) StartVerify(ctx context.Context, deps Deps, dryRun bool) (Job, error) {
+	if j == nil {
+		return Job{}, errors.New("jobs are not tracked")
+	}
+
+	j.mu.Lock()
+	if j.verifying != "" {
+		j.mu.Unlock()
+		return Job{}, ErrVerifying
+	}
+	j.verifying = "starting"
+	j.mu.Unlock()
+
+	ctx, job, done, err := j.track(ctx, Job{Event: "verify"}, "verify")
+
+	j.mu.Lock()
+	j.verifying = job.ID
+	j.mu.Unlock()
+	if err != nil {
+		return job, err
+	}
+
+	go func() {
+		defer done()
+		slog.InfoContext(ctx, "verify started", "dryRun", dryRun)
+
+		report, err := Verify(ctx, deps, dryRun)
+		report.Job = job.ID
+		slog.InfoContext(ctx, "verify finished", "episodes", report.Episodes, "corrupt", len(report.Corrupt), "err", err)
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.verifying = ""
+		if err == nil {
+			j.verified = &report
+		}
+	}()
+
+	return job, nil
+}
+
+// LastVerify returns the report of the last verification that finished.
+func (j *Jobs) LastVerify() (VerifyReport, bool) {
+	if j == nil {
+		return VerifyReport{}, false
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.verified == nil {
+		return VerifyReport{}, false
+	}
+	return *j.verified, true
+}
+
+// VerifyHandler starts verifying the cached files as a job and responds
+// with the job, before it has finished. With ?dryRun=true corrupted copies
+// are only reported.
+func VerifyHandler(deps Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, _ := requestContext(w, r)
+
+		job, err := deps.Jobs.StartVerify(context.WithoutCancel(ctx), deps, r.URL.Query().Get("dryRun") == "true")
+		if errors.Is(err, ErrVerifying) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/admin/verify")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+	}
+}
+
+// VerifyReportHandler responds with the report of the last verification
+// that finished.
+func VerifyReportHandler(deps Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, ok := deps.Jobs.LastVerify()
+		if !ok {
+			http.Error(w, "no verification finished yet", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	redisH "plexcache/redis"
+	"plexcache/utils"
+)
+
+func TestCopiesRecordTheirHashes(t *testing.T) {
+	env := newTestEnv(t)
+	env.cacheSeason(t)
+
+	episode, _, _ := redisH.GetCachedEpisode(t.Context(), env.deps.Redis, "", "203")
+	hash, err := utils.HashFile(env.episodePath(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if episode.Hash != hash || episode.Size != 1203 {
+		t.Fatalf("got hash %q and size %d, want %q", episode.Hash, episode.Size, hash)
+	}
+}
+
+func TestVerifyEvictsCorruptCopies(t *testing.T) {
+	env := newTestEnv(t)
+	env.cacheSeason(t)
+
+	// a flipped byte in episode 4, a truncated episode 5
+	flipped := env.deps.CacheRoot + env.episodePath(4)
+	data, _ := os.ReadFile(flipped)
+	data[100] ^= 0xff
+	os.WriteFile(flipped, data, 0644)
+	os.Truncate(env.deps.CacheRoot+env.episodePath(5), 100)
+
+	report, err := Verify(t.Context(), env.deps, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Episodes != 4 || report.Files != 4 || report.Unhashed != 0 || len(report.Corrupt) != 2 {
+		t.Fatalf("got %+v", report)
+	}
+	for _, corrupt := range report.Corrupt {
+		if corrupt.Evicted {
+			t.Fatalf("dry-run evicted %+v", corrupt)
+		}
+	}
+
+	report, err = Verify(t.Context(), env.deps, false)
+	if err != nil || len(report.Corrupt) != 2 {
+		t.Fatalf("got %+v, %v", report, err)
+	}
+
+	for key, index := range map[string]int{"204": 4, "205": 5} {
+		if _, found, _ := redisH.GetCachedEpisode(t.Context(), env.deps.Redis, "", key); found {
+			t.Fatalf("record of corrupt episode %d was kept", index)
+		}
+		if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(index)); !os.IsNotExist(err) {
+			t.Fatalf("corrupt copy of episode %d was kept", index)
+		}
+	}
+	if _, found, _ := redisH.GetCachedEpisode(t.Context(), env.deps.Redis, "", "203"); !found {
+		t.Fatal("intact episode 3 was evicted")
+	}
+
+	usage, _ := redisH.GetUsage(t.Context(), env.deps.Redis)
+	// episode 3 with its subtitles
+	if usage.Bytes != 1203+64+1206 || usage.Wasted != 0 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+}
+
+func TestVerifyHandler(t *testing.T) {
+	env := newTestEnv(t)
+	env.cacheSeason(t)
+	os.Remove(env.deps.CacheRoot + env.episodePath(6))
+
+	env.deps.Jobs = NewJobs()
+
+	rec := httptest.NewRecorder()
+	VerifyHandler(env.deps).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/verify?dryRun=true", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	var job Job
+	if err := json.NewDecoder(rec.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+
+	// waits for the job
+	if err := env.deps.Jobs.Shutdown(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	VerifyReportHandler(env.deps).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/verify", nil))
+
+	var report VerifyReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Job != job.ID || !report.DryRun || len(report.Corrupt) != 1 || report.Corrupt[0].RatingKey != "206" || report.Corrupt[0].Reason != "missing" {
+		t.Fatalf("got %+v", report)
+	}
+}
+
+func TestVerifyRunsOneAtATime(t *testing.T) {
+	jobs := NewJobs()
+	jobs.verifying = "1-verify"
+
+	if _, err := jobs.StartVerify(t.Context(), Deps{}, true); !errors.Is(err, ErrVerifying) {
+		t.Fatalf("got %v, want ErrVerifying", err)
+	}
+	if _, ok := jobs.LastVerify(); ok {
+		t.Fatal("got a report before any verification finished")
+	}
+}
+
+func TestCopiesFailWhenPlexIsBehind(t *testing.T) {
+	env := newTestEnv(t)
+
+	// upgraded after Plex scanned it
+	if err := os.WriteFile(env.episodePath(3), make([]byte, 2000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rec := env.webhook(t, "media.play"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d, want the copy to fail", rec.Code)
+	}
+
+	if _, err := os.Stat(env.deps.CacheRoot + env.episodePath(3)); !os.IsNotExist(err) {
+		t.Fatal("copy differing from Plex was kept")
+	}
+	if _, found, _ := redisH.GetCachedEpisode(t.Context(), env.deps.Redis, "", "203"); found {
+		t.Fatal("copy differing from Plex was recorded")
+	}
+	if bytes := env.usageBytes(t); bytes != 0 {
+		t.Fatalf("got %d bytes in use", bytes)
+	}
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"plexcache/models"
+)
+
+// VersionPolicy chooses which versions of an episode with several, e.g. a
+// 1080p and a 4K file, are cached.
+type VersionPolicy string
+
+const (
+	// VersionPlayed caches the version the triggering player is playing,
+	// or the first version Plex lists when that is not known.
+	VersionPlayed VersionPolicy = "played"
+	// VersionHighest caches the version with the highest resolution.
+	VersionHighest VersionPolicy = "highest"
+	// VersionLowest caches the version with the lowest resolution.
+	VersionLowest VersionPolicy = "lowest"
+	// VersionAll caches every version.
+	VersionAll VersionPolicy = "all"
+)
+
+// ParseVersionPolicy reads MEDIA_VERSIONS, empty meaning VersionPlayed.
+func ParseVersionPolicy(value string) (VersionPolicy, error) {
+	switch policy := VersionPolicy(value); policy {
+	case "":
+		return VersionPlayed, nil
+	case VersionPlayed, VersionHighest, VersionLowest, VersionAll:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("unknown media version policy %q, expected played, highest, lowest or all", value)
+}
+
+// compareResolution orders versions by height, width and then bitrate.
+func compareResolution(a, b models.Media) int {
+	return cmp.Or(cmp.Compare(a.Height, b.Height), cmp.Compare(a.Width, b.Width), cmp.Compare(a.Bitrate, b.Bitrate))
+}
+
+// sameVersion tells whether a version of an episode is the one played of
+// another episode. Versions are per episode, so they are matched by
+// resolution rather than by id.
+func sameVersion(media, playing models.Media) bool {
+	if media.VideoResolution != "" && playing.VideoResolution != "" {
+		return media.VideoResolution == playing.VideoResolution
+	}
+	return media.Height == playing.Height
+}
+
+// versionPicker applies a VersionPolicy to the versions of each episode.
+type versionPicker struct {
+	policy VersionPolicy
+	// playing is the version the triggering player is playing, nil when
+	// not known.
+	playing *models.Media
+}
+
+func (v versionPicker) pick(media []models.Media) []models.Media {
+	if len(media) <= 1 {
+		return media
+	}
+
+	switch v.policy {
+	case VersionAll:
+		return media
+	case VersionHighest:
+		return []models.Media{slices.MaxFunc(media, compareResolution)}
+	case VersionLowest:
+		return []models.Media{slices.MinFunc(media, compareResolution)}
+	}
+
+	if v.playing != nil {
+		for _, version := range media {
+			if sameVersion(version, *v.playing) {
+				return []models.Media{version}
+			}
+		}
+	}
+
+	return media[:1]
+}
+
+// hasVersions tells whether any episode of a season in the window has more
+// than one version, so the played version is worth asking Plex for.
+func hasVersions(seasonMetadata models.SeasonMetadataResponse, first, last int) bool {
+	for _, item := range seasonMetadata.MediaContainer.Metadata {
+		if item.Index >= first && item.Index <= last && len(item.Media) > 1 {
+			return true
+		}
+	}
+	return false
+}
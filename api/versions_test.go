@@ -0,0 +1,196 @@
+package api
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"plexcache/models"
+	"plexcache/plex/plextest"
+	"plexcache/policy"
+)
+
+func version(id, height int, resolution string) models.Media {
+	return models.Media{ID: id, Height: height, Width: height * 16 / 9, VideoResolution: resolution}
+}
+
+func TestVersionPicker(t *testing.T) {
+	hd, uhd, sd := version(1, 1080, "1080"), version(2, 2160, "4k"), version(3, 480, "sd")
+	media := []models.Media{hd, uhd, sd}
+	playingUHD := version(9, 2160, "4k")
+	playingOther := version(9, 720, "720")
+
+	for _, tc := range []struct {
+		name   string
+		picker versionPicker
+		want   []int
+	}{
+		{"played", versionPicker{policy: VersionPlayed, playing: &playingUHD}, []int{2}},
+		{"played unknown", versionPicker{policy: VersionPlayed}, []int{1}},
+		{"played not among versions", versionPicker{policy: VersionPlayed, playing: &playingOther}, []int{1}},
+		{"highest", versionPicker{policy: VersionHighest}, []int{2}},
+		{"lowest", versionPicker{policy: VersionLowest}, []int{3}},
+		{"all", versionPicker{policy: VersionAll}, []int{1, 2, 3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []int
+			for _, m := range tc.picker.pick(media) {
+				got = append(got, m.ID)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("got versions %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	if got := (versionPicker{policy: VersionHighest}).pick(nil); len(got) != 0 {
+		t.Fatalf("got %v for no media", got)
+	}
+}
+
+func TestParseVersionPolicy(t *testing.T) {
+	if got, err := ParseVersionPolicy(""); err != nil || got != VersionPlayed {
+		t.Fatalf("got %q, %v for empty", got, err)
+	}
+	if got, err := ParseVersionPolicy("highest"); err != nil || got != VersionHighest {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if _, err := ParseVersionPolicy("best"); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+}
+
+// versionLookup serves a season and the version a player is playing.
+type versionLookup struct {
+	season  models.SeasonMetadataResponse
+	playing *models.Media
+	asked   int
+}
+
+func (l *versionLookup) CachedEpisode(context.Context, string) (models.EpisodeCache, bool, error) {
+	return models.EpisodeCache{}, false, nil
+}
+
+func (l *versionLookup) ShowHistory(context.Context, models.Payload) (models.ShowHistory, error) {
+	return models.ShowHistory{}, nil
+}
+
+func (l *versionLookup) SeasonMetadata(context.Context, models.Payload) (models.SeasonMetadataResponse, error) {
+	return l.season, nil
+}
+
+func (l *versionLookup) FreeSpace() (uint64, error) {
+	return 1 << 40, nil
+}
+
+func (l *versionLookup) PlayingMedia(context.Context, models.Payload) (models.Media, bool, error) {
+	l.asked++
+	if l.playing == nil {
+		return models.Media{}, false, nil
+	}
+	return *l.playing, true, nil
+}
+
+// multiVersionSeason is season 2 where episode 3 has no media, episode 4 a
+// 4K version split in two parts and episode 5 a second 1080p version.
+func multiVersionSeason(t *testing.T) models.SeasonMetadataResponse {
+	season := plextest.Season(t, "200")
+	episodes := season.MediaContainer.Metadata
+
+	episodes[2].Media = nil
+
+	uhd := version(7204, 2160, "4k")
+	uhd.Part = []models.MediaPart{
+		{File: "/data/tvshows/Test Show/Season 02/Test Show - S02E04 - 4K - pt1.mkv", Size: 4000},
+		{File: "/data/tvshows/Test Show/Season 02/Test Show - S02E04 - 4K - pt2.mkv", Size: 3000},
+	}
+	episodes[3].Media = append(episodes[3].Media, uhd)
+
+	remux := episodes[4].Media[0]
+	remux.ID = 7205
+	remux.Part = []models.MediaPart{{File: "/data/tvshows/Test Show/Season 02/Test Show - S02E05 - Remux.mkv", Size: 9000}}
+	episodes[4].Media = append(episodes[4].Media, remux)
+
+	return season
+}
+
+func planVersions(t *testing.T, lookup *versionLookup, versions VersionPolicy) Plan {
+	t.Helper()
+
+	planner := Planner{Policy: policy.Default(), CacheRoot: "/cache", Lookup: lookup, Versions: versions}
+	plan, err := planner.Plan(t.Context(), plextest.Payload(t, "media.play"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.Cache {
+		t.Fatalf("plan skipped: %q", plan.Reasons)
+	}
+
+	return plan
+}
+
+func episodeFiles(plan Plan, index int) []models.CachedFile {
+	for _, episode := range plan.Episodes {
+		if episode.Index == index {
+			return episode.Files()
+		}
+	}
+	return nil
+}
+
+func TestPlanSkipsEpisodesWithoutMedia(t *testing.T) {
+	plan := planVersions(t, &versionLookup{season: multiVersionSeason(t)}, VersionPlayed)
+
+	if episodeFiles(plan, 3) != nil {
+		t.Fatalf("episode 3 without media was planned: %+v", plan.Episodes)
+	}
+	if len(plan.Episodes) != 3 {
+		t.Fatalf("got %d episodes, want 4, 5 and 6", len(plan.Episodes))
+	}
+	if !slices.Contains(plan.Reasons, `episode 3 "Episode 3" has no media file`) {
+		t.Fatalf("no reason for episode 3 in %q", plan.Reasons)
+	}
+}
+
+func TestPlanCopiesEveryPartOfTheChosenVersion(t *testing.T) {
+	uhd := version(5202, 2160, "4k")
+	lookup := &versionLookup{season: multiVersionSeason(t), playing: &uhd}
+	plan := planVersions(t, lookup, VersionPlayed)
+
+	if lookup.asked != 1 {
+		t.Fatalf("asked for the played version %d times, want once", lookup.asked)
+	}
+
+	files := episodeFiles(plan, 4)
+	if len(files) != 2 || files[0].Size != 4000 || files[1].Size != 3000 {
+		t.Fatalf("got %+v, want both 4K parts", files)
+	}
+
+	// no 4K version: Plex's first version
+	if files := episodeFiles(plan, 5); len(files) != 1 || files[0].Size != 1205 {
+		t.Fatalf("got %+v, want the first version of episode 5", files)
+	}
+
+	var total int64
+	for _, c := range plan.Copies {
+		total += c.Bytes
+	}
+	if total != plan.TotalBytes || plan.TotalBytes != 4000+3000+1205+1206 {
+		t.Fatalf("got %d bytes in %d copies", plan.TotalBytes, len(plan.Copies))
+	}
+}
+
+func TestPlanAllVersions(t *testing.T) {
+	lookup := &versionLookup{season: multiVersionSeason(t)}
+	plan := planVersions(t, lookup, VersionAll)
+
+	if lookup.asked != 0 {
+		t.Fatal("asked for the played version while caching all versions")
+	}
+	if files := episodeFiles(plan, 4); len(files) != 3 {
+		t.Fatalf("got %+v, want the 1080p file and both 4K parts", files)
+	}
+	if files := episodeFiles(plan, 5); len(files) != 2 || files[1].Size != 9000 {
+		t.Fatalf("got %+v, want both versions of episode 5", files)
+	}
+}
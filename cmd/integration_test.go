@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"plexcache/api"
+	"plexcache/models"
+	"plexcache/plex"
+	"plexcache/plex/plextest"
+	"plexcache/policy"
+	redisH "plexcache/redis"
+	"plexcache/redis/redistest"
+
+	"github.com/LukeHagar/plexgo"
+)
+
+type harness struct {
+	deps   api.Deps
+	server *httptest.Server
+	plex   *plextest.Server
+	redis  *redistest.Server
+	media  string
+}
+
+const adminToken = "secret"
+
+// newHarness boots the router of main against the redis stand-in, the fake
+// Plex server and temporary media and cache directories, with the expiry
+// subscriber running.
+func newHarness(t *testing.T, dryRun bool) *harness {
+	t.Helper()
+
+	mr := redistest.NewServer(t)
+	plexServer := plextest.NewServer(t)
+	media := t.TempDir()
+
+	deps := api.Deps{
+		Redis: mr.Client(t),
+		Plex: plex.NewClient(plexgo.New(
+			plexgo.WithSecurity(plextest.Token),
+			plexgo.WithServerURL(plexServer.URL),
+		)),
+		PlexConnection: plex.Connection{URL: plexServer.URL, Token: plextest.Token},
+		Policy:         policy.Default(),
+		CacheRoot:      t.TempDir(),
+		Paths:          plextest.CreateMedia(t, media, "200"),
+		DryRun:         dryRun,
+		AdminToken:     adminToken,
+	}
+
+	subscriber := redisH.SubscribeToExpired(t.Context(), deps.Redis, deps.CacheRoot, deps.DryRun)
+	t.Cleanup(func() { subscriber.Close() })
+
+	// expiries published before the subscription is active would be lost
+	eventually(t, "the expiry subscription", func() bool { return mr.PubSubNumPat() > 0 })
+
+	expiry, err := redisH.CheckNotifications(t.Context(), deps.Redis, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readiness := api.NewReadiness(5*time.Second, api.ReadinessChecks(deps, expiry, subscriber.Alive, 0)...)
+
+	server := httptest.NewServer(newRouter(deps, readiness))
+	t.Cleanup(server.Close)
+
+	return &harness{deps: deps, server: server, plex: plexServer, redis: mr, media: media}
+}
+
+func (h *harness) post(t *testing.T, path string, payload models.Payload) *http.Response {
+	t.Helper()
+
+	req := plextest.WebhookRequest(t, h.server.URL+path, payload)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+
+	return res
+}
+
+func (h *harness) get(t *testing.T, path string, v any) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, h.server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s returned %s", path, res.Status)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (h *harness) cached(index int) string {
+	return h.deps.CacheRoot + filepath.Join(h.media, "Test Show", "Season 02", fmt.Sprintf("Test Show - S02E%02d.mkv", index))
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestWebhookCacheAndExpire(t *testing.T) {
+	h := newHarness(t, false)
+
+	res := h.post(t, "/", plextest.Payload(t, "media.play"))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("webhook returned %s", res.Status)
+	}
+
+	for index := 3; index <= 6; index++ {
+		if !exists(h.cached(index)) {
+			t.Fatalf("episode %d was not copied", index)
+		}
+		if !h.redis.Exists(fmt.Sprintf("plex-cache:episode:%d", 200+index)) {
+			t.Fatalf("no redis record for episode %d", index)
+		}
+	}
+
+	var stats api.Stats
+	h.get(t, "/admin/stats", &stats)
+	// with the subtitles of episodes 3 and 5
+	if stats.Usage.Episodes != 4 || stats.Usage.Bytes != 1203+1204+1205+1206+2*64 {
+		t.Fatalf("unexpected usage %+v", stats.Usage)
+	}
+
+	h.redis.FastForward(redisH.CacheTTL)
+
+	eventually(t, "expired episodes to be removed", func() bool {
+		for index := 3; index <= 6; index++ {
+			if exists(h.cached(index)) || h.redis.Exists(fmt.Sprintf("plex-cache:episode:%d", 200+index)) {
+				return false
+			}
+		}
+		return true
+	})
+
+	h.get(t, "/admin/stats", &stats)
+	if stats.Usage.Episodes != 0 || stats.Usage.Bytes != 0 || stats.Usage.Wasted != 4 {
+		t.Fatalf("unexpected usage after expiry %+v", stats.Usage)
+	}
+}
+
+func TestPlanDoesNotCache(t *testing.T) {
+	h := newHarness(t, false)
+
+	res := h.post(t, "/plan", plextest.Payload(t, "media.play"))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("plan returned %s", res.Status)
+	}
+
+	var plan api.Plan
+	if err := json.NewDecoder(res.Body).Decode(&plan); err != nil {
+		t.Fatal(err)
+	}
+
+	if !plan.Cache || len(plan.Episodes) != 4 || len(plan.Copies) != 6 {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+
+	if exists(h.cached(3)) || h.redis.Exists("plex-cache:episode:203") {
+		t.Fatal("plan must not copy or record anything")
+	}
+}
+
+func TestDryRunKeepsFilesAlone(t *testing.T) {
+	h := newHarness(t, true)
+
+	h.post(t, "/", plextest.Payload(t, "media.play"))
+
+	if exists(h.cached(3)) {
+		t.Fatal("dry-run copied a file")
+	}
+	if !h.redis.Exists("plex-cache:episode:203") {
+		t.Fatal("dry-run should record the episode")
+	}
+
+	// a file that is really in the cache must survive a dry-run expiry
+	if err := os.MkdirAll(filepath.Dir(h.cached(3)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(h.cached(3), []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h.redis.FastForward(redisH.CacheTTL)
+	eventually(t, "expired records to be removed", func() bool { return !h.redis.Exists("plex-cache:episode:203") })
+
+	if !exists(h.cached(3)) {
+		t.Fatal("dry-run removed a file")
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	h := newHarness(t, false)
+
+	res, err := http.Get(h.server.URL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ready api.Ready
+	json.NewDecoder(res.Body).Decode(&ready)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || ready.Status != "ok" {
+		t.Fatalf("got %d %+v", res.StatusCode, ready)
+	}
+
+	names := map[string]bool{}
+	for _, check := range ready.Checks {
+		names[check.Name] = check.OK
+	}
+	for _, name := range []string{"redis", "expiry", "plex", "cache", "media"} {
+		if !names[name] {
+			t.Fatalf("check %s missing or failing: %+v", name, ready.Checks)
+		}
+	}
+
+	h.plex.Close()
+
+	res, err = http.Get(h.server.URL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(res.Body).Decode(&ready)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got %d with Plex down", res.StatusCode)
+	}
+	for _, check := range ready.Checks {
+		if check.Name == "plex" && (check.OK || check.LastError == "" || check.LastErrorAt == nil) {
+			t.Fatalf("plex check should fail with its last error: %+v", check)
+		}
+	}
+
+	res, err = http.Get(h.server.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("healthz answered %d", res.StatusCode)
+	}
+}
+
+func TestAdminNeedsToken(t *testing.T) {
+	h := newHarness(t, true)
+
+	for path, method := range map[string]string{"/admin/stats": http.MethodGet, "/admin/verify": http.MethodPost, "/plan": http.MethodPost} {
+		req, err := http.NewRequest(method, h.server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%s %s without a token returned %s", method, path, res.Status)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"plexcache/api"
+	red "plexcache/redis"
+)
+
+const journalUsage = "usage: plex-cache journal list [-count n] | show <id> | replay [-dry-run] <id>"
+
+// runJournal implements `plex-cache journal`, which lists and shows the
+// journaled webhooks and replays one of them.
+func runJournal(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, journalUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("journal "+args[0], flag.ExitOnError)
+	count := fs.Int64("count", 20, "how many webhooks to list, newest first")
+	dryRun := fs.Bool("dry-run", false, "only plan the replay, without writing to redis or copying files")
+	fs.Parse(args[1:])
+
+	if args[0] != "list" && fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, journalUsage)
+		return 2
+	}
+
+	ctx := context.Background()
+	deps, err := connect(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var result any
+	switch args[0] {
+	case "list":
+		result, err = red.ListJournal(ctx, deps.Redis, *count)
+	case "show":
+		entry, found, findErr := red.GetJournalEntry(ctx, deps.Redis, fs.Arg(0))
+		if findErr == nil && !found {
+			findErr = api.ErrNoJournalEntry
+		}
+		result, err = entry, findErr
+	case "replay":
+		result, err = api.Replay(ctx, deps, fs.Arg(0), *dryRun)
+	default:
+		fmt.Fprintln(os.Stderr, journalUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+
+	return 0
+}
@@ -2,55 +2,526 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	s "strings"
+	"syscall"
+	"time"
 
 	"plexcache/api"
+	"plexcache/logging"
+	"plexcache/models"
+	"plexcache/plex"
 	red "plexcache/redis"
+	"plexcache/tracing"
+	"plexcache/utils"
 
-	"github.com/LukeHagar/plexgo"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	"github.com/redis/go-redis/v9"
 )
 
-func main() {
-	log.Println("Starting")
+func cacheRoot() string {
+	if root := os.Getenv("CACHE_ROOT"); root != "" {
+		return root
+	}
+
+	return "/cache"
+}
+
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+func envDuration(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+
+	return d, nil
+}
+
+// pathMappings reads PATH_MAPPINGS, a comma separated list of
+// plex-path=local-path pairs.
+func pathMappings() ([]models.PathMapping, error) {
+	return parsePathMappings(os.Getenv("PATH_MAPPINGS"))
+}
+
+func parsePathMappings(value string) ([]models.PathMapping, error) {
+	if value == "" {
+		return api.DefaultPaths, nil
+	}
+
+	var paths []models.PathMapping
+	for _, pair := range s.Split(value, ",") {
+		plexPath, localPath, ok := s.Cut(s.TrimSpace(pair), "=")
+		if !ok || plexPath == "" || localPath == "" {
+			return nil, fmt.Errorf("invalid path mapping %q", pair)
+		}
+		paths = append(paths, models.PathMapping{Plex: plexPath, Local: localPath})
+	}
+
+	return paths, nil
+}
+
+func plexConnection() (plex.Connection, error) {
+	timeout, err := envDuration("PLEX_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return plex.Connection{}, err
+	}
+
+	return plex.Connection{
+		URL:       os.Getenv("PLEX_URL"),
+		Protocol:  os.Getenv("PLEX_PROTOCOL"),
+		IP:        os.Getenv("PLEX_IP"),
+		Port:      os.Getenv("PLEX_PORT"),
+		Token:     os.Getenv("PLEX_API_KEY"),
+		Timeout:   timeout,
+		CAFile:    os.Getenv("PLEX_CA_FILE"),
+		PinSHA256: os.Getenv("PLEX_CERT_SHA256"),
+	}, nil
+}
+
+// redisConfig reads REDIS_URL, either host:port or a redis:// or rediss://
+// URL, and the REDIS_* settings overriding it.
+func redisConfig() (red.Config, error) {
+	config := red.Config{
+		URL:                os.Getenv("REDIS_URL"),
+		Username:           os.Getenv("REDIS_USERNAME"),
+		Password:           os.Getenv("REDIS_PASSWORD"),
+		TLS:                os.Getenv("REDIS_TLS") == "true",
+		CAFile:             os.Getenv("REDIS_CA_FILE"),
+		InsecureSkipVerify: os.Getenv("REDIS_TLS_INSECURE") == "true",
+		SentinelMaster:     os.Getenv("REDIS_SENTINEL_MASTER"),
+		SentinelPassword:   os.Getenv("REDIS_SENTINEL_PASSWORD"),
+	}
+
+	if value := os.Getenv("REDIS_DB"); value != "" {
+		db, err := strconv.Atoi(value)
+		if err != nil || db < 0 {
+			return config, fmt.Errorf("invalid REDIS_DB %q", value)
+		}
+		config.DB = &db
+	}
+
+	if value := os.Getenv("REDIS_SENTINEL_ADDRS"); value != "" {
+		for _, addr := range s.Split(value, ",") {
+			config.SentinelAddrs = append(config.SentinelAddrs, s.TrimSpace(addr))
+		}
+	}
+
+	return config, nil
+}
+
+// tracesEndpoint is where spans are exported over OTLP/HTTP, empty when
+// tracing is off.
+func tracesEndpoint() string {
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		return s.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+
+	return ""
+}
+
+// connect loads .env and builds the clients shared by the server and the
+// commands that run the decision path. It does not write to redis, so the
+// plan command stays read-only.
+func connect(ctx context.Context) (api.Deps, error) {
+	var deps api.Deps
 
-	ctx := context.Background()
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatalf("Error loading .env file")
+		return deps, fmt.Errorf("Error loading .env file")
+	}
+
+	if err := logging.Setup(os.Stderr, envOr("LOG_LEVEL", "info"), os.Getenv("LOG_FORMAT")); err != nil {
+		return deps, err
+	}
+
+	config, err := redisConfig()
+	if err != nil {
+		return deps, err
 	}
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     os.Getenv("REDIS_URL"),
-		Password: "",
-		DB:       0,
-	})
+	rdb, err := red.NewClient(config)
+	if err != nil {
+		return deps, fmt.Errorf("Error configuring redis: %v", err)
+	}
 
 	_, err = rdb.Ping(ctx).Result()
 
 	if err != nil {
-		log.Fatalf("Error connecing to redis %e", err)
-		return
+		return deps, fmt.Errorf("Error connecting to redis %v", err)
+	}
+
+	red.SetKeyPrefix(os.Getenv("REDIS_KEY_PREFIX"))
+
+	if value := os.Getenv("JOURNAL_LENGTH"); value != "" {
+		length, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return deps, fmt.Errorf("invalid JOURNAL_LENGTH %q: %v", value, err)
+		}
+		red.JournalLength = length
+	}
+	// only the server migrates, the commands run next to it
+	if err := red.CheckSchema(ctx, rdb); errors.Is(err, red.ErrSchemaOutdated) {
+		slog.WarnContext(ctx, "redis is not migrated yet", "err", err)
+	} else if err != nil {
+		return deps, err
+	}
+
+	pol, err := loadPolicy(os.Getenv("POLICY_FILE"))
+	if err != nil {
+		return deps, fmt.Errorf("Error loading policy: %v", err)
+	}
+
+	paths, err := pathMappings()
+	if err != nil {
+		return deps, err
+	}
+
+	connection, err := plexConnection()
+	if err != nil {
+		return deps, err
+	}
+
+	servers, err := plexServers(ctx, rdb, connection.Timeout)
+	if err != nil {
+		return deps, err
+	}
+	red.SetSharedFiles(len(servers) > 1)
+
+	var plexClient plex.MetadataClient
+	if len(servers) == 0 {
+		plexClient, err = metadataClient(rdb, connection, "")
+		if err != nil {
+			return deps, err
+		}
+	}
+
+	showLockTTL, err := envDuration("SHOW_LOCK_TTL", time.Minute)
+	if err != nil {
+		return deps, err
+	}
+
+	debounce, err := envDuration("DEBOUNCE_WINDOW", 10*time.Second)
+	if err != nil {
+		return deps, err
+	}
+
+	versions, err := api.ParseVersionPolicy(os.Getenv("MEDIA_VERSIONS"))
+	if err != nil {
+		return deps, err
+	}
+
+	deps = api.Deps{
+		Redis:          rdb,
+		Plex:           plexClient,
+		PlexConnection: connection,
+		Policy:         pol,
+		CacheRoot:      cacheRoot(),
+		Paths:          paths,
+		Servers:        servers,
+		ShowLockTTL:    showLockTTL,
+		Debounce:       debounce,
+		Versions:       versions,
+		HashSources:    os.Getenv("SOURCE_HASH") == "true",
+		DryRun:         os.Getenv("DRY_RUN") == "true",
+		AdminToken:     os.Getenv("ADMIN_TOKEN"),
 	}
 
-	subscriber := red.SubscribeToExpired(rdb)
-	defer subscriber.Close()
+	return deps, nil
+}
 
-	plexApi := plexgo.New(
-		plexgo.WithSecurity(os.Getenv("PLEX_API_KEY")),
-		plexgo.WithIP(os.Getenv("PLEX_IP")),
-		plexgo.WithProtocol("http"),
+// metadataClient builds the Plex client of a server with retries, the
+// circuit breaker and the metadata cache.
+func metadataClient(rdb *redis.Client, connection plex.Connection, server string) (plex.MetadataClient, error) {
+	client, err := plex.NewConnectedClient(connection)
+	if err != nil {
+		return nil, fmt.Errorf("Error configuring plex: %v", err)
+	}
+
+	var plexClient plex.MetadataClient = plex.NewResilientClient(
+		client,
+		3,
+		500*time.Millisecond,
+		&plex.Breaker{Threshold: plex.DefaultBreakerThreshold, Cooldown: 30 * time.Second},
 	)
 
+	metadataTTL, err := envDuration("METADATA_CACHE_TTL", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	if metadataTTL > 0 {
+		var store plex.MetadataStore = plex.NewMemoryStore()
+		if os.Getenv("METADATA_CACHE") == "redis" {
+			store = red.NewMetadataStore(rdb, server)
+		}
+
+		plexClient = plex.NewCachingClient(plexClient, store, metadataTTL)
+	}
+
+	return plexClient, nil
+}
+
+type serverConfig struct {
+	UUID         string `json:"uuid"`
+	Name         string `json:"name"`
+	URL          string `json:"url"`
+	Token        string `json:"token"`
+	CAFile       string `json:"caFile"`
+	CertSHA256   string `json:"certSha256"`
+	PathMappings string `json:"pathMappings"`
+}
+
+// plexServers reads PLEX_SERVERS, a JSON file listing the Plex servers of a
+// multi-server setup. Servers without a uuid are asked for it.
+func plexServers(ctx context.Context, rdb *redis.Client, timeout time.Duration) (map[string]api.Server, error) {
+	path := os.Getenv("PLEX_SERVERS")
+	if path == "" {
+		return nil, nil
+	}
+
+	var configs []serverConfig
+	if err := readJSON(path, &configs); err != nil {
+		return nil, fmt.Errorf("Error loading PLEX_SERVERS: %v", err)
+	}
+
+	servers := map[string]api.Server{}
+	for _, config := range configs {
+		connection := plex.Connection{
+			URL:       config.URL,
+			Token:     config.Token,
+			Timeout:   timeout,
+			CAFile:    config.CAFile,
+			PinSHA256: config.CertSHA256,
+		}
+
+		info, err := plex.CheckConnection(ctx, connection)
+		switch {
+		case err != nil && config.UUID == "":
+			return nil, fmt.Errorf("could not read the uuid of %s, set it in PLEX_SERVERS: %v", config.URL, err)
+		case err != nil:
+			slog.WarnContext(ctx, "Plex is not reachable", "url", config.URL, "err", err)
+		case config.UUID == "":
+			config.UUID = info.MachineIdentifier
+		case config.UUID != info.MachineIdentifier:
+			slog.WarnContext(ctx, "Plex reports another uuid", "url", config.URL, "uuid", info.MachineIdentifier, "configured", config.UUID)
+		}
+
+		if err == nil {
+			slog.InfoContext(ctx, "connected to Plex", "name", info.Name, "version", info.Version, "uuid", config.UUID)
+		}
+
+		if _, ok := servers[config.UUID]; ok {
+			return nil, fmt.Errorf("Plex server %s is listed twice in PLEX_SERVERS", config.UUID)
+		}
+
+		paths, err := parsePathMappings(config.PathMappings)
+		if err != nil {
+			return nil, fmt.Errorf("server %s: %v", config.UUID, err)
+		}
+
+		plexClient, err := metadataClient(rdb, connection, config.UUID)
+		if err != nil {
+			return nil, fmt.Errorf("server %s: %v", config.UUID, err)
+		}
+
+		servers[config.UUID] = api.Server{UUID: config.UUID, Name: config.Name, Plex: plexClient, Paths: paths, Connection: connection}
+	}
+
+	return servers, nil
+}
+
+func newRouter(deps api.Deps, readiness *api.Readiness) *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/", api.WebhookHandler(rdb, plexApi)).Methods("POST")
+	r.HandleFunc("/", api.WebhookHandler(deps)).Methods("POST")
+	r.Handle("/plan", api.AdminAuth(deps.AdminToken)(api.PlanHandler(deps))).Methods("POST")
+	r.HandleFunc("/healthz", api.HealthHandler()).Methods("GET")
+	r.HandleFunc("/readyz", api.ReadyHandler(readiness)).Methods("GET")
+	r.HandleFunc("/metrics", api.MetricsHandler(deps)).Methods("GET")
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(api.AdminAuth(deps.AdminToken))
+	admin.HandleFunc("/stats", api.StatsHandler(deps)).Methods("GET")
+	admin.HandleFunc("/hitrate", api.HitRateHandler(deps)).Methods("GET")
+	admin.HandleFunc("/wasted", api.WastedHandler(deps)).Methods("GET")
+	admin.HandleFunc("/jobs", api.JobsHandler(deps)).Methods("GET")
+	admin.HandleFunc("/jobs/{id}", api.CancelJobHandler(deps)).Methods("DELETE")
+	admin.HandleFunc("/journal", api.JournalHandler(deps)).Methods("GET")
+	admin.HandleFunc("/journal/{id}", api.JournalEntryHandler(deps)).Methods("GET")
+	admin.HandleFunc("/journal/{id}/replay", api.ReplayHandler(deps)).Methods("POST")
+	admin.HandleFunc("/verify", api.VerifyHandler(deps)).Methods("POST")
+	admin.HandleFunc("/verify", api.VerifyReportHandler(deps)).Methods("GET")
+
+	return r
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "policy":
+			os.Exit(runPolicy(os.Args[2:]))
+		case "plan":
+			os.Exit(runPlan(os.Args[2:]))
+		case "simulate":
+			os.Exit(runSimulate(os.Args[2:]))
+		case "journal":
+			os.Exit(runJournal(os.Args[2:]))
+		case "verify":
+			os.Exit(runVerify(os.Args[2:]))
+		}
+	}
+
+	slog.Info("starting")
 
-	if err := http.ListenAndServe(":4001", r); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	deps, err := connect(ctx)
+	if err != nil {
+		fatal("could not start", "err", err)
 	}
 
+	if err := red.Migrate(ctx, deps.Redis); err != nil {
+		fatal("could not migrate redis", "err", err)
+	}
+
+	if len(deps.Servers) == 0 {
+		info, err := plex.CheckConnection(ctx, deps.PlexConnection)
+		if err != nil {
+			slog.WarnContext(ctx, "Plex is not reachable", "err", err)
+		} else {
+			slog.InfoContext(ctx, "connected to Plex", "name", info.Name, "version", info.Version)
+		}
+	}
+
+	stopTracing, err := tracing.Setup(ctx, tracesEndpoint())
+	if err != nil {
+		fatal("could not set up tracing", "err", err)
+	}
+
+	if deps.DryRun {
+		slog.Info("dry-run mode, files will not be copied or removed")
+	}
+
+	deps.Jobs = api.NewJobs()
+	if deps.AdminToken == "" {
+		slog.WarnContext(ctx, "ADMIN_TOKEN is not set, the admin API is off")
+	}
+
+	if os.Getenv("SOURCE_WATCH") != "false" {
+		if watcher, err := api.NewSourceWatcher(); err != nil {
+			slog.Warn("not watching sources, changes are noticed by the periodic check", "err", err)
+		} else {
+			deps.Sources = watcher
+			go watcher.Run(ctx, deps)
+		}
+	}
+
+	sourceCheckInterval, err := envDuration("SOURCE_CHECK_INTERVAL", time.Hour)
+	if err != nil {
+		fatal("invalid SOURCE_CHECK_INTERVAL", "err", err)
+	}
+	if sourceCheckInterval > 0 {
+		go api.RunSourceChecks(ctx, deps, sourceCheckInterval)
+	}
+
+	if !deps.DryRun {
+		if removed, err := utils.RemovePartials(deps.CacheRoot); err != nil {
+			slog.Error("could not look for partial copies", "err", err)
+		} else if removed > 0 {
+			slog.Info("removed partial copies left by an earlier run", "count", removed)
+		}
+	}
+
+	var subscriber *red.Subscriber
+	var alive func(ctx context.Context) error
+	expiry, err := red.CheckNotifications(ctx, deps.Redis, os.Getenv("REDIS_CONFIGURE_NOTIFICATIONS") == "true")
+	if err != nil {
+		if os.Getenv("REDIS_EXPIRY_FALLBACK") != "poll" {
+			fatal("cached files would never be removed, set REDIS_EXPIRY_FALLBACK=poll to poll for expired records instead", "err", err)
+		}
+
+		pollInterval, err := envDuration("REDIS_EXPIRY_POLL_INTERVAL", time.Minute)
+		if err != nil {
+			fatal("invalid REDIS_EXPIRY_POLL_INTERVAL", "err", err)
+		}
+
+		slog.Warn("polling for expired records", "interval", pollInterval, "because", expiry.Error)
+		go red.PollExpired(ctx, deps.Redis, deps.CacheRoot, deps.DryRun, pollInterval)
+	} else {
+		// the subscriber outlives ctx, shutdown closes it
+		subscriber = red.SubscribeToExpired(context.Background(), deps.Redis, deps.CacheRoot, deps.DryRun)
+		alive = subscriber.Alive
+	}
+
+	minFree, err := parseSize(envOr("READY_MIN_FREE_SPACE", "0"))
+	if err != nil {
+		fatal("invalid READY_MIN_FREE_SPACE", "err", err)
+	}
+	readiness := api.NewReadiness(5*time.Second, api.ReadinessChecks(deps, expiry, alive, uint64(minFree))...)
+
+	go api.RunRetries(ctx, deps, 30*time.Second)
+
+	shutdownTimeout, err := envDuration("SHUTDOWN_TIMEOUT", 25*time.Second)
+	if err != nil {
+		fatal("invalid SHUTDOWN_TIMEOUT", "err", err)
+	}
+
+	server := &http.Server{Addr: ":4001", Handler: newRouter(deps, readiness)}
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.ListenAndServe() }()
+
+	clean := true
+	select {
+	case err := <-serverErr:
+		slog.Error("server failed", "err", err)
+		clean = false
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	}
+
+	if !shutdown(server, deps.Jobs, subscriber, shutdownTimeout) {
+		clean = false
+	}
+	deps.Redis.Close()
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := stopTracing(flushCtx); err != nil {
+		slog.Error("could not flush spans", "err", err)
+	}
+	cancel()
+
+	if !clean {
+		os.Exit(1)
+	}
+
+	slog.Info("stopped")
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"plexcache/api"
+	"plexcache/models"
+)
+
+// runPlan implements `plex-cache plan`, which runs the decision path for a
+// recorded payload against the live redis and Plex server and prints the
+// plan without copying anything or writing to redis.
+func runPlan(args []string) int {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	payloadPath := fs.String("payload", "", "recorded webhook payload (the JSON of the payload form field)")
+	fs.Parse(args)
+
+	if *payloadPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: plex-cache plan -payload payload.json")
+		return 2
+	}
+
+	var payload models.Payload
+	if err := readJSON(*payloadPath, &payload); err != nil {
+		fmt.Fprintln(os.Stderr, "could not read payload:", err)
+		return 1
+	}
+
+	deps, err := connect(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	deps, err = deps.ForServer(payload)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	plan, err := api.PreviewCache(context.Background(), deps, payload)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "planning failed:", err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(plan)
+
+	return 0
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"plexcache/models"
+	"plexcache/policy"
+)
+
+func loadPolicy(path string) (*policy.Policy, error) {
+	if path == "" {
+		return policy.Default(), nil
+	}
+
+	return policy.Load(path)
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// runPolicy implements `plex-cache policy test`, which evaluates a recorded
+// webhook payload against a policy and prints the decision.
+func runPolicy(args []string) int {
+	if len(args) == 0 || args[0] != "test" {
+		fmt.Fprintln(os.Stderr, "usage: plex-cache policy test -payload payload.json [-policy policy.json] [-season season.json]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("policy test", flag.ExitOnError)
+	policyPath := fs.String("policy", os.Getenv("POLICY_FILE"), "policy file, defaults to the built-in policy")
+	payloadPath := fs.String("payload", "", "recorded webhook payload (the JSON of the payload form field)")
+	seasonPath := fs.String("season", "", "recorded season metadata, needed to evaluate window rules")
+	plays := fs.Int("plays", 0, "history.plays for the account and show")
+	lastEpisode := fs.Int("last-episode", 0, "history.episode for the account and show")
+	fs.Parse(args[1:])
+
+	if *payloadPath == "" {
+		fmt.Fprintln(os.Stderr, "-payload is required")
+		return 2
+	}
+
+	pol, err := loadPolicy(*policyPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not load policy:", err)
+		return 1
+	}
+
+	var payload models.Payload
+	if err := readJSON(*payloadPath, &payload); err != nil {
+		fmt.Fprintln(os.Stderr, "could not read payload:", err)
+		return 1
+	}
+
+	input := policy.Input{
+		Payload: payload,
+		History: models.ShowHistory{Plays: *plays, LastIndex: *lastEpisode},
+	}
+
+	decision, err := pol.Admit(input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "evaluation failed:", err)
+		return 1
+	}
+
+	verdict := "skip"
+	if decision.Cache {
+		verdict = "cache"
+	}
+	fmt.Printf("decision: %s\nrule: %s\nreason: %s\n", verdict, decision.Rule, decision.Reason)
+
+	if !decision.Cache || *seasonPath == "" {
+		return 0
+	}
+
+	var season models.SeasonMetadataResponse
+	if err := readJSON(*seasonPath, &season); err != nil {
+		fmt.Fprintln(os.Stderr, "could not read season metadata:", err)
+		return 1
+	}
+
+	input.Season = &season
+	window, err := pol.WindowFor(input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "evaluation failed:", err)
+		return 1
+	}
+
+	first := payload.Metadata.Index + window.Offset
+	fmt.Printf("window: episodes %d-%d (rule %s)\n", first, first+window.Count-1, window.Rule)
+
+	return 0
+}
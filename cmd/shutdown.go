@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"plexcache/api"
+	red "plexcache/redis"
+)
+
+// shutdown stops accepting webhooks, gives the caching jobs in progress until
+// timeout to finish and cancels the rest, which removes their partial files,
+// then closes the expiry subscriber. It tells whether everything stopped
+// cleanly.
+func shutdown(server *http.Server, jobs *api.Jobs, subscriber *red.Subscriber, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	clean := true
+
+	serverDone := make(chan error, 1)
+	go func() { serverDone <- server.Shutdown(ctx) }()
+
+	if err := jobs.Shutdown(ctx); err != nil {
+		slog.Warn("cancelled the jobs still in progress", "after", timeout)
+		clean = false
+	}
+
+	if err := <-serverDone; err != nil {
+		slog.Warn("requests still in progress", "after", timeout, "err", err)
+		server.Close()
+		clean = false
+	}
+
+	if subscriber != nil {
+		if err := subscriber.Close(); err != nil {
+			slog.Error("could not close the expiry subscriber", "err", err)
+			clean = false
+		}
+	}
+
+	return clean
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	s "strings"
+	"text/tabwriter"
+
+	"plexcache/simulate"
+)
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return s.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseSize reads sizes like 500G, 1.5T or 2000000000.
+func parseSize(value string) (int64, error) {
+	units := map[byte]float64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	value = s.TrimSuffix(s.ToUpper(s.TrimSpace(value)), "B")
+
+	multiplier := 1.0
+	if n := len(value); n > 0 {
+		if u, ok := units[value[n-1]]; ok {
+			multiplier = u
+			value = value[:n-1]
+		}
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	return int64(f * multiplier), nil
+}
+
+// runSimulate implements `plex-cache simulate`, which replays recorded
+// webhooks through the planner with a virtual cache for each policy.
+func runSimulate(args []string) int {
+	var policies stringList
+
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	eventsPath := fs.String("events", "", "recorded webhooks, one JSON payload or {\"at\", \"payload\"} per line")
+	metadataPath := fs.String("metadata", "", "season metadata snapshot, a JSON object keyed by parentRatingKey")
+	size := fs.String("size", "500G", "virtual cache size")
+	asJSON := fs.Bool("json", false, "print results as JSON")
+	fs.Var(&policies, "policy", "policy file to compare, repeatable, \"default\" for the built-in policy")
+	fs.Parse(args)
+
+	if *eventsPath == "" || *metadataPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: plex-cache simulate -events events.jsonl -metadata seasons.json [-size 500G] [-policy a.json -policy b.json]")
+		return 2
+	}
+
+	capacity, err := parseSize(*size)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if len(policies) == 0 {
+		policies = stringList{"default"}
+	}
+
+	events, err := simulate.LoadEvents(*eventsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not read events:", err)
+		return 1
+	}
+
+	snapshot, err := simulate.LoadSnapshot(*metadataPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not read metadata:", err)
+		return 1
+	}
+
+	var results []simulate.Result
+	for _, path := range policies {
+		name := filepath.Base(path)
+		if path == "default" {
+			path = ""
+		}
+
+		pol, err := loadPolicy(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "could not load policy:", err)
+			return 1
+		}
+
+		results = append(results, simulate.Run(name, pol, events, snapshot, capacity))
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+		return 0
+	}
+
+	printResults(results)
+
+	return 0
+}
+
+func printResults(results []simulate.Result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	row := func(label string, value func(r simulate.Result) string) {
+		fmt.Fprint(w, label, "\t")
+		for _, r := range results {
+			fmt.Fprint(w, value(r), "\t")
+		}
+		fmt.Fprintln(w)
+	}
+
+	row("policy", func(r simulate.Result) string { return r.Policy })
+	row("events", func(r simulate.Result) string { return strconv.Itoa(r.Events) })
+	row("plays", func(r simulate.Result) string { return strconv.Itoa(r.Plays) })
+	row("hits", func(r simulate.Result) string { return strconv.Itoa(r.Hits) })
+	row("hit rate", func(r simulate.Result) string { return fmt.Sprintf("%.1f%%", r.HitRate*100) })
+	row("copies", func(r simulate.Result) string { return strconv.Itoa(r.Copies) })
+	row("bytes copied", func(r simulate.Result) string { return formatBytes(r.BytesCopied) })
+	row("peak usage", func(r simulate.Result) string { return formatBytes(r.PeakBytes) })
+	row("evictions", func(r simulate.Result) string { return strconv.Itoa(r.Evictions) })
+	row("wasted", func(r simulate.Result) string { return strconv.Itoa(r.Wasted) })
+	row("skipped, no space", func(r simulate.Result) string { return strconv.Itoa(r.NoSpace) })
+	row("errors", func(r simulate.Result) string { return strconv.Itoa(r.Errors) })
+
+	w.Flush()
+}
+
+func formatBytes(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", f, units[i])
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"plexcache/api"
+)
+
+// runVerify implements `plex-cache verify`, which rehashes the cached files
+// and evicts the corrupted ones. It exits with 3 when it found any.
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report corrupted copies without evicting them")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	deps, err := connect(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	report, err := api.Verify(ctx, deps, *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+
+	if len(report.Corrupt) > 0 {
+		return 3
+	}
+	return 0
+}
@@ -0,0 +1,64 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestContextAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "debug", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := With(context.Background(), "request", "r1")
+	job := With(ctx, "job", "1-202")
+	other := With(ctx, "job", "2-203")
+
+	logger.DebugContext(job, "copy", "file", "a.mkv")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["request"] != "r1" || record["job"] != "1-202" || record["file"] != "a.mkv" || record["level"] != "DEBUG" {
+		t.Fatalf("got %v", record)
+	}
+
+	if attrs := attrsFrom(other); len(attrs) != 2 || attrs[1].Value.String() != "2-203" {
+		t.Fatalf("sibling contexts should not share attributes, got %v", attrs)
+	}
+}
+
+func TestLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "warn", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Info("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("info logged at warn level: %s", buf.String())
+	}
+
+	logger.Warn("shown")
+	if buf.Len() == 0 {
+		t.Fatal("warn not logged")
+	}
+
+	if _, err := New(&buf, "loud", "text"); err == nil {
+		t.Fatal("unknown level accepted")
+	}
+	if _, err := New(&buf, "info", "xml"); err == nil {
+		t.Fatal("unknown format accepted")
+	}
+
+	if l, _ := ParseLevel("ERROR"); l != slog.LevelError {
+		t.Fatalf("got %v", l)
+	}
+}
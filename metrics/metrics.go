@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	s "strings"
+	"sync"
+)
+
+// A small in-process registry exposed in the Prometheus text format.
+// Counters only grow for the lifetime of the process; gauges hold the last
+// value set.
+
+type series struct {
+	kind   string
+	help   string
+	values map[string]float64
+}
+
+var (
+	mu       sync.Mutex
+	registry = map[string]*series{}
+)
+
+func get(kind, name, help string) *series {
+	m, ok := registry[name]
+	if !ok {
+		m = &series{kind: kind, help: help, values: map[string]float64{}}
+		registry[name] = m
+	}
+	return m
+}
+
+// labelString renders label pairs ("show", "Foo", "user", "bar") as
+// {show="Foo",user="bar"}.
+func labelString(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var parts []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := s.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return "{" + s.Join(parts, ",") + "}"
+}
+
+// Add increases a counter.
+func Add(name, help string, delta float64, labels ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	get("counter", name, help).values[labelString(labels)] += delta
+}
+
+func Inc(name, help string, labels ...string) {
+	Add(name, help, 1, labels...)
+}
+
+// Set sets a gauge.
+func Set(name, help string, value float64, labels ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	get("gauge", name, help).values[labelString(labels)] = value
+}
+
+func Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		names := make([]string, 0, len(registry))
+		for name := range registry {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, name := range names {
+			m := registry[name]
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, m.help, name, m.kind)
+
+			labels := make([]string, 0, len(m.values))
+			for l := range m.values {
+				labels = append(labels, l)
+			}
+			sort.Strings(labels)
+
+			for _, l := range labels {
+				fmt.Fprintf(w, "%s%s %g\n", name, l, m.values[l])
+			}
+		}
+	}
+}
@@ -61,38 +61,61 @@ type SeasonMetadataResponse struct {
 			AddedAt               int64   `json:"addedAt"`
 			UpdatedAt             int64   `json:"updatedAt"`
 			AudienceRatingImage   string  `json:"audienceRatingImage"`
-			Media                 []struct {
-				ID               int     `json:"id"`
-				Duration         int64   `json:"duration"`
-				Bitrate          int     `json:"bitrate"`
-				Width            int     `json:"width"`
-				Height           int     `json:"height"`
-				AspectRatio      float64 `json:"aspectRatio"`
-				AudioChannels    int     `json:"audioChannels"`
-				AudioCodec       string  `json:"audioCodec"`
-				VideoCodec       string  `json:"videoCodec"`
-				VideoResolution  string  `json:"videoResolution"`
-				Container        string  `json:"container"`
-				VideoFrameRate   string  `json:"videoFrameRate"`
-				AudioProfile     string  `json:"audioProfile"`
-				VideoProfile     string  `json:"videoProfile"`
-				HasVoiceActivity bool    `json:"hasVoiceActivity"`
-				Part             []struct {
-					ID           int          `json:"id"`
-					Key          string       `json:"key"`
-					Duration     int64        `json:"duration"`
-					File         string       `json:"file"`
-					Size         int64        `json:"size"`
-					AudioProfile string       `json:"audioProfile"`
-					Container    string       `json:"container"`
-					VideoProfile string       `json:"videoProfile"`
-					Stream       []StreamPart `json:"Stream"`
-				}
-			}
+			Media                 []Media `json:"Media"`
 		}
 	}
 }
 
+// Media is one version of an item, e.g. the 1080p or the 4K file, made of
+// one or more parts.
+type Media struct {
+	ID               int         `json:"id"`
+	Duration         int64       `json:"duration"`
+	Bitrate          int         `json:"bitrate"`
+	Width            int         `json:"width"`
+	Height           int         `json:"height"`
+	AspectRatio      float64     `json:"aspectRatio"`
+	AudioChannels    int         `json:"audioChannels"`
+	AudioCodec       string      `json:"audioCodec"`
+	VideoCodec       string      `json:"videoCodec"`
+	VideoResolution  string      `json:"videoResolution"`
+	Container        string      `json:"container"`
+	VideoFrameRate   string      `json:"videoFrameRate"`
+	AudioProfile     string      `json:"audioProfile"`
+	VideoProfile     string      `json:"videoProfile"`
+	HasVoiceActivity bool        `json:"hasVoiceActivity"`
+	Part             []MediaPart `json:"Part"`
+}
+
+// MediaPart is one file of a Media, episodes split in CD1/CD2 have several.
+type MediaPart struct {
+	ID           int          `json:"id"`
+	Key          string       `json:"key"`
+	Duration     int64        `json:"duration"`
+	File         string       `json:"file"`
+	Size         int64        `json:"size"`
+	AudioProfile string       `json:"audioProfile"`
+	Container    string       `json:"container"`
+	VideoProfile string       `json:"videoProfile"`
+	Stream       []StreamPart `json:"Stream"`
+}
+
+// SessionsResponse is what Plex answers on /status/sessions, trimmed to what
+// tells which version a player is playing.
+type SessionsResponse struct {
+	MediaContainer struct {
+		Size     int `json:"size"`
+		Metadata []struct {
+			RatingKey string  `json:"ratingKey"`
+			Media     []Media `json:"Media"`
+			Player    struct {
+				MachineIdentifier string `json:"machineIdentifier"`
+				Title             string `json:"title"`
+			} `json:"Player"`
+		} `json:"Metadata"`
+	} `json:"MediaContainer"`
+}
+
 type StreamPart struct {
 	ID                   int     `json:"id"`
 	StreamType           int     `json:"streamType"`
@@ -128,18 +151,93 @@ type StreamPart struct {
 	CanAutoSync          bool    `json:"canAutoSync,omitempty"`
 	Format               string  `json:"format,omitempty"`
 	Key                  string  `json:"key,omitempty"`
+	// File is the path of an external stream, when Plex reports it.
+	File string `json:"file,omitempty"`
 }
 
 type EpisodeCache struct {
-	RatingKey            string   `json:"ratingKey"`
-	ParentRatingKey      string   `json:"parentRatingKey"`
-	GrandparentRatingKey string   `json:"grandparentRatingKey"`
-	Title                string   `json:"title"`
-	Index                int      `json:"index"`
-	ParentIndex          int      `json:"parentIndex"`
-	EpisodeFilePath      string   `json:"episodeFilePath"`
-	SrtFilePaths         []string `json:"srtFilePaths"`
-	IsLast               bool     `json:"isLast"`
+	// Version is the redis schema version the record was written with.
+	Version int `json:"version"`
+	// Server is the UUID of the Plex server the rating keys belong to, empty
+	// for a single server setup.
+	Server               string `json:"server,omitempty"`
+	RatingKey            string `json:"ratingKey"`
+	ParentRatingKey      string `json:"parentRatingKey"`
+	GrandparentRatingKey string `json:"grandparentRatingKey"`
+	GrandparentTitle     string `json:"grandparentTitle"`
+	Title                string `json:"title"`
+	Index                int    `json:"index"`
+	ParentIndex          int    `json:"parentIndex"`
+	EpisodeFilePath      string `json:"episodeFilePath"`
+	// SidecarFilePaths are the subtitle files copied with the episode.
+	SidecarFilePaths []string `json:"sidecarFilePaths,omitempty"`
+	// SrtFilePaths are the subtitles recorded by versions before
+	// SidecarFilePaths.
+	SrtFilePaths []string `json:"srtFilePaths,omitempty"`
+	// SidecarSize is the size of the sidecars together.
+	SidecarSize int64 `json:"sidecarSize,omitempty"`
+	// Size is the size of EpisodeFilePath.
+	Size int64 `json:"size"`
+	// Hash is the xxhash of the copy of EpisodeFilePath, see utils.HashFile.
+	Hash string `json:"hash,omitempty"`
+	// Parts are the files cached with EpisodeFilePath: the further parts of
+	// a split episode and, when all versions are cached, the other versions.
+	Parts []CachedFile `json:"parts,omitempty"`
+	// Sources are the media files as they were when they were copied.
+	Sources []SourceStat `json:"sources,omitempty"`
+	IsLast  bool         `json:"isLast"`
+	Copied  bool         `json:"copied"`
+	Played  bool         `json:"played"`
+}
+
+// CachedFile is a media file of an episode, its size as Plex reports it
+// until it was copied and the hash of its copy.
+type CachedFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// SourceStat is what a media file looked like when it was copied, to notice
+// when it was replaced, e.g. by an upgrade.
+type SourceStat struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// ModTime is in Unix nanoseconds.
+	ModTime int64 `json:"modTime"`
+	// Hash is the utils.SampleHash of the file, when SOURCE_HASH is set.
+	Hash string `json:"hash,omitempty"`
+}
+
+// Files returns every media file of the episode, EpisodeFilePath first.
+func (e EpisodeCache) Files() []CachedFile {
+	return append([]CachedFile{{Path: e.EpisodeFilePath, Size: e.Size, Hash: e.Hash}}, e.Parts...)
+}
+
+// SetFiles replaces the media files of the episode, the first being
+// EpisodeFilePath.
+func (e *EpisodeCache) SetFiles(files []CachedFile) {
+	e.EpisodeFilePath, e.Size, e.Hash = files[0].Path, files[0].Size, files[0].Hash
+	e.Parts = nil
+	if len(files) > 1 {
+		e.Parts = files[1:]
+	}
+}
+
+// TotalSize is the size of all files of the episode, media and sidecars, as
+// counted in usage and in the bytes of a plan.
+func (e EpisodeCache) TotalSize() int64 {
+	size := e.Size + e.SidecarSize
+	for _, part := range e.Parts {
+		size += part.Size
+	}
+	return size
+}
+
+// Sidecars returns the subtitle files of the episode, of old and new
+// records alike.
+func (e EpisodeCache) Sidecars() []string {
+	return append(append([]string(nil), e.SrtFilePaths...), e.SidecarFilePaths...)
 }
 
 type Payload struct {
@@ -248,3 +346,91 @@ type Payload struct {
 		} `json:"Producer"`
 	} `json:"Metadata"`
 }
+
+// ShowHistory is what plex-cache remembers about an account watching a show.
+type ShowHistory struct {
+	Plays       int `json:"plays"`
+	LastIndex   int `json:"lastIndex"`
+	ParentIndex int `json:"parentIndex"`
+}
+
+// Usage is the cache size as recorded in redis. In dry-run mode it is the
+// size the cache would have had.
+type Usage struct {
+	Bytes     int64 `json:"bytes"`
+	PeakBytes int64 `json:"peakBytes"`
+	Episodes  int64 `json:"episodes"`
+	Copies    int64 `json:"copies"`
+	Removals  int64 `json:"removals"`
+	// Wasted counts episodes that expired without being played.
+	Wasted      int64 `json:"wasted"`
+	WastedBytes int64 `json:"wastedBytes"`
+}
+
+type HitCounts struct {
+	Hits   int64   `json:"hits"`
+	Misses int64   `json:"misses"`
+	Rate   float64 `json:"rate"`
+}
+
+// HitRate is the share of episode plays served from the cache over the
+// last Hours hours.
+type HitRate struct {
+	Hours     int                  `json:"hours"`
+	All       HitCounts            `json:"all"`
+	Shows     map[string]HitCounts `json:"shows"`
+	Users     map[string]HitCounts `json:"users"`
+	Libraries map[string]HitCounts `json:"libraries"`
+}
+
+// WastedCopy is a cached episode that expired without being played.
+type WastedCopy struct {
+	Server    string `json:"server,omitempty"`
+	RatingKey string `json:"ratingKey"`
+	Show      string `json:"show"`
+	Title     string `json:"title"`
+	Size      int64  `json:"size"`
+	EvictedAt int64  `json:"evictedAt"`
+}
+
+// PathMapping translates a path as Plex sees it to the same path as seen by
+// plex-cache.
+type PathMapping struct {
+	Plex  string `json:"plex"`
+	Local string `json:"local"`
+}
+
+// RetryItem is a webhook whose processing failed because Plex was
+// unavailable, queued to be processed again later.
+type RetryItem struct {
+	ID        string  `json:"id"`
+	Payload   Payload `json:"payload"`
+	Attempts  int     `json:"attempts"`
+	LastError string  `json:"lastError"`
+	QueuedAt  int64   `json:"queuedAt"`
+}
+
+// JournalEntry is a webhook as received and what was decided for it, kept
+// in the journal so it can be inspected and replayed.
+type JournalEntry struct {
+	ID        string            `json:"id"`
+	Time      int64             `json:"time"`
+	RequestID string            `json:"requestId,omitempty"`
+	ReplayOf  string            `json:"replayOf,omitempty"`
+	DryRun    bool              `json:"dryRun,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Payload   Payload           `json:"payload"`
+	Decision  string            `json:"decision"`
+	Reason    string            `json:"reason"`
+	Episodes  int               `json:"episodes"`
+}
+
+// ExpiryState is how expired cache records are noticed: through redis
+// keyspace notifications or by polling for records without an expirer.
+type ExpiryState struct {
+	Mode                 string `json:"mode"`
+	NotifyKeyspaceEvents string `json:"notifyKeyspaceEvents"`
+	// Configured is set when plex-cache enabled the notifications itself.
+	Configured bool   `json:"configured"`
+	Error      string `json:"error,omitempty"`
+}
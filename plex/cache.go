@@ -0,0 +1,139 @@
+package plex
+
+import (
+	"context"
+	"log/slog"
+	"plexcache/metrics"
+	"plexcache/models"
+	"sync"
+	"time"
+)
+
+// MetadataStore keeps season metadata for a while, keyed by ParentRatingKey.
+type MetadataStore interface {
+	Get(ctx context.Context, parentRatingKey string) (models.SeasonMetadataResponse, bool)
+	Set(ctx context.Context, parentRatingKey string, season models.SeasonMetadataResponse, ttl time.Duration)
+	Delete(ctx context.Context, parentRatingKey string)
+	Clear(ctx context.Context)
+}
+
+// Invalidator is implemented by clients that cache metadata.
+type Invalidator interface {
+	Invalidate(ctx context.Context, payload models.Payload)
+}
+
+// Peeker is implemented by clients that can read season metadata without
+// caching it.
+type Peeker interface {
+	PeekSeasonMetadata(ctx context.Context, payload models.Payload) (models.SeasonMetadataResponse, error)
+}
+
+// CachingClient answers repeated season reads from a store. Plays and
+// resumes of a season tend to arrive in bursts.
+type CachingClient struct {
+	client MetadataClient
+	store  MetadataStore
+	ttl    time.Duration
+}
+
+func NewCachingClient(client MetadataClient, store MetadataStore, ttl time.Duration) *CachingClient {
+	return &CachingClient{client: client, store: store, ttl: ttl}
+}
+
+func (c *CachingClient) GetSeasonMetadata(ctx context.Context, payload models.Payload) (models.SeasonMetadataResponse, error) {
+	key := payload.Metadata.ParentRatingKey
+
+	if season, ok := c.store.Get(ctx, key); ok {
+		slog.DebugContext(ctx, "season metadata from cache", "parentRatingKey", key)
+		metrics.Inc("plexcache_metadata_cache_total", "Season metadata reads by cache result.", "result", "hit")
+		return season, nil
+	}
+
+	metrics.Inc("plexcache_metadata_cache_total", "Season metadata reads by cache result.", "result", "miss")
+	season, err := c.client.GetSeasonMetadata(ctx, payload)
+	if err != nil {
+		return season, err
+	}
+
+	c.store.Set(ctx, key, season, c.ttl)
+
+	return season, nil
+}
+
+// PeekSeasonMetadata reads season metadata like GetSeasonMetadata but does
+// not store what Plex returns, for planning which must not write.
+func (c *CachingClient) PeekSeasonMetadata(ctx context.Context, payload models.Payload) (models.SeasonMetadataResponse, error) {
+	if season, ok := c.store.Get(ctx, payload.Metadata.ParentRatingKey); ok {
+		return season, nil
+	}
+
+	return c.client.GetSeasonMetadata(ctx, payload)
+}
+
+// PlayingMedia is never cached, sessions change with every play.
+func (c *CachingClient) PlayingMedia(ctx context.Context, payload models.Payload) (models.Media, bool, error) {
+	reader, ok := c.client.(SessionReader)
+	if !ok {
+		return models.Media{}, false, nil
+	}
+	return reader.PlayingMedia(ctx, payload)
+}
+
+// Invalidate drops what a library.new or library.on.deck event may have
+// changed: the season of an episode, a season, or everything for a show.
+func (c *CachingClient) Invalidate(ctx context.Context, payload models.Payload) {
+	switch payload.Metadata.Type {
+	case "episode":
+		c.store.Delete(ctx, payload.Metadata.ParentRatingKey)
+	case "season":
+		c.store.Delete(ctx, payload.Metadata.RatingKey)
+	default:
+		c.store.Clear(ctx)
+	}
+}
+
+type memoryEntry struct {
+	season    models.SeasonMetadataResponse
+	expiresAt time.Time
+}
+
+// MemoryStore is an in-process MetadataStore.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: map[string]memoryEntry{}}
+}
+
+func (m *MemoryStore) Get(ctx context.Context, key string) (models.SeasonMetadataResponse, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		delete(m.entries, key)
+		return models.SeasonMetadataResponse{}, false
+	}
+
+	return entry.season, true
+}
+
+func (m *MemoryStore) Set(ctx context.Context, key string, season models.SeasonMetadataResponse, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = memoryEntry{season: season, expiresAt: time.Now().Add(ttl)}
+}
+
+func (m *MemoryStore) Delete(ctx context.Context, key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+}
+
+func (m *MemoryStore) Clear(ctx context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = map[string]memoryEntry{}
+}
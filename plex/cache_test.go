@@ -0,0 +1,76 @@
+package plex
+
+import (
+	"testing"
+	"time"
+
+	"plexcache/plex/plextest"
+	redisH "plexcache/redis"
+	"plexcache/redis/redistest"
+
+	"github.com/LukeHagar/plexgo"
+)
+
+func newCachingClient(t *testing.T, srv *plextest.Server, store MetadataStore, ttl time.Duration) *CachingClient {
+	return NewCachingClient(NewClient(plexgo.New(
+		plexgo.WithSecurity(plextest.Token),
+		plexgo.WithServerURL(srv.URL),
+	)), store, ttl)
+}
+
+func TestCachingClient(t *testing.T) {
+	stores := map[string]func(t *testing.T) MetadataStore{
+		"memory": func(t *testing.T) MetadataStore { return NewMemoryStore() },
+		"redis": func(t *testing.T) MetadataStore {
+			return redisH.NewMetadataStore(redistest.NewServer(t).Client(t), "")
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			srv := plextest.NewServer(t)
+			client := newCachingClient(t, srv, newStore(t), time.Minute)
+			play := plextest.Payload(t, "media.play")
+
+			for i := 0; i < 3; i++ {
+				season, err := client.GetSeasonMetadata(t.Context(), play)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(season.MediaContainer.Metadata) != 8 {
+					t.Fatalf("got %d episodes from the cache", len(season.MediaContainer.Metadata))
+				}
+			}
+
+			if got := srv.Requests("/library/metadata/200/children"); got != 1 {
+				t.Fatalf("got %d requests, want 1", got)
+			}
+
+			// a new episode in the season invalidates it
+			added := play
+			added.Event = "library.new"
+			client.Invalidate(t.Context(), added)
+
+			if _, err := client.GetSeasonMetadata(t.Context(), play); err != nil {
+				t.Fatal(err)
+			}
+			if got := srv.Requests("/library/metadata/200/children"); got != 2 {
+				t.Fatalf("got %d requests after invalidation, want 2", got)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreExpires(t *testing.T) {
+	srv := plextest.NewServer(t)
+	client := newCachingClient(t, srv, NewMemoryStore(), time.Millisecond)
+	play := plextest.Payload(t, "media.play")
+
+	client.GetSeasonMetadata(t.Context(), play)
+	time.Sleep(5 * time.Millisecond)
+	client.GetSeasonMetadata(t.Context(), play)
+
+	if got := srv.Requests("/library/metadata/200/children"); got != 2 {
+		t.Fatalf("got %d requests, want 2", got)
+	}
+}
@@ -4,22 +4,62 @@ import (
 	"context"
 	"encoding/json"
 	"io"
+	"log/slog"
 	"plexcache/models"
+	"plexcache/tracing"
 	"strconv"
+	"time"
 
 	"github.com/LukeHagar/plexgo"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func GetSeasonMetadata(s *plexgo.PlexAPI, payload models.Payload) (models.SeasonMetadataResponse, error) {
-	ctx := context.Background()
-	var fullEpisodeResponse models.SeasonMetadataResponse
+// MetadataClient is the part of Plex the webhook handler depends on.
+type MetadataClient interface {
+	GetSeasonMetadata(ctx context.Context, payload models.Payload) (models.SeasonMetadataResponse, error)
+}
+
+// Client is the MetadataClient backed by a plexgo API.
+type Client struct {
+	api *plexgo.PlexAPI
+	// connection reaches Plex for what plexgo cannot read, nil when not
+	// known.
+	connection *Connection
+}
+
+func NewClient(api *plexgo.PlexAPI) *Client {
+	return &Client{api: api}
+}
+
+// NewConnectedClient is NewClient for the API of a connection, also able to
+// read sessions.
+func NewConnectedClient(c Connection) (*Client, error) {
+	api, err := NewAPI(c)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{api: api, connection: &c}, nil
+}
+
+func (c *Client) GetSeasonMetadata(ctx context.Context, payload models.Payload) (models.SeasonMetadataResponse, error) {
+	return GetSeasonMetadata(ctx, c.api, payload)
+}
+
+func GetSeasonMetadata(ctx context.Context, s *plexgo.PlexAPI, payload models.Payload) (fullEpisodeResponse models.SeasonMetadataResponse, err error) {
+	ctx, span := tracing.Start(ctx, "GetSeasonMetadata", attribute.String("parentRatingKey", payload.Metadata.ParentRatingKey))
+	defer func() {
+		span.SetAttributes(attribute.Int("episodes", len(fullEpisodeResponse.MediaContainer.Metadata)))
+		tracing.End(span, err)
+	}()
 
 	parentRatingKey, err := strconv.ParseFloat(payload.Metadata.ParentRatingKey, 64)
 	if err != nil {
 		return fullEpisodeResponse, err
 	}
 
+	start := time.Now()
 	metadataChildren, err := s.Library.GetMetadataChildren(ctx, parentRatingKey, plexgo.String("Stream"))
+	slog.DebugContext(ctx, "plex season metadata", "parentRatingKey", payload.Metadata.ParentRatingKey, "duration", time.Since(start), "err", err)
 	if err != nil {
 		return fullEpisodeResponse, err
 	}
@@ -36,3 +76,40 @@ func GetSeasonMetadata(s *plexgo.PlexAPI, payload models.Payload) (models.Season
 
 	return fullEpisodeResponse, nil
 }
+
+// SessionReader is implemented by clients that can tell which version of an
+// item a player is playing.
+type SessionReader interface {
+	PlayingMedia(ctx context.Context, payload models.Payload) (models.Media, bool, error)
+}
+
+// PlayingMedia returns the version of the payload's item the payload's
+// player is playing, from the sessions Plex reports. Clients made without a
+// Connection do not know.
+func (c *Client) PlayingMedia(ctx context.Context, payload models.Payload) (media models.Media, found bool, err error) {
+	if c.connection == nil {
+		return media, false, nil
+	}
+
+	ctx, span := tracing.Start(ctx, "PlayingMedia", attribute.String("ratingKey", payload.Metadata.RatingKey))
+	defer func() {
+		span.SetAttributes(attribute.Bool("found", found))
+		tracing.End(span, err)
+	}()
+
+	// read without plexgo, whose session model does not decode Plex's
+	// numeric ids
+	var sessions models.SessionsResponse
+	if err := c.connection.getJSON(ctx, "/status/sessions", &sessions); err != nil {
+		return media, false, err
+	}
+
+	for _, session := range sessions.MediaContainer.Metadata {
+		if session.RatingKey != payload.Metadata.RatingKey || session.Player.MachineIdentifier != payload.Player.UUID || len(session.Media) == 0 {
+			continue
+		}
+		return session.Media[0], true, nil
+	}
+
+	return media, false, nil
+}
@@ -0,0 +1,84 @@
+package plex
+
+import (
+	"testing"
+
+	"plexcache/plex/plextest"
+
+	"github.com/LukeHagar/plexgo"
+)
+
+func TestClientGetSeasonMetadata(t *testing.T) {
+	srv := plextest.NewServer(t)
+	client := NewClient(plexgo.New(
+		plexgo.WithSecurity(plextest.Token),
+		plexgo.WithServerURL(srv.URL),
+	))
+
+	season, err := client.GetSeasonMetadata(t.Context(), plextest.Payload(t, "media.play"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(season.MediaContainer.Metadata); got != 8 {
+		t.Fatalf("got %d episodes, want 8", got)
+	}
+
+	part := season.MediaContainer.Metadata[2].Media[0].Part[0]
+	if part.File != "/data/tvshows/Test Show/Season 02/Test Show - S02E03.mkv" || part.Size != 1203 {
+		t.Fatalf("unexpected part %s (%d bytes)", part.File, part.Size)
+	}
+
+	if got := srv.Requests("/library/metadata/200/children"); got != 1 {
+		t.Fatalf("got %d requests for the season, want 1", got)
+	}
+}
+
+func TestClientUnauthorized(t *testing.T) {
+	srv := plextest.NewServer(t)
+	client := NewClient(plexgo.New(
+		plexgo.WithSecurity("wrong"),
+		plexgo.WithServerURL(srv.URL),
+	))
+
+	if _, err := client.GetSeasonMetadata(t.Context(), plextest.Payload(t, "media.play")); err == nil {
+		t.Fatal("expected an error for a bad token")
+	}
+}
+
+func TestClientPlayingMedia(t *testing.T) {
+	srv := plextest.NewServer(t)
+	client, err := NewConnectedClient(Connection{URL: srv.URL, Token: plextest.Token})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := plextest.Payload(t, "media.play")
+	media, found, err := client.PlayingMedia(t.Context(), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || media.ID != 5202 || len(media.Part) != 1 || media.VideoResolution != "1080" {
+		t.Fatalf("got %+v (found %v), want version 5202", media, found)
+	}
+
+	payload.Player.UUID = "other-player"
+	if _, found, err := client.PlayingMedia(t.Context(), payload); err != nil || found {
+		t.Fatalf("got found %v, err %v for another player", found, err)
+	}
+}
+
+func TestClientPlayingMediaWithoutConnection(t *testing.T) {
+	srv := plextest.NewServer(t)
+	client := NewClient(plexgo.New(
+		plexgo.WithSecurity(plextest.Token),
+		plexgo.WithServerURL(srv.URL),
+	))
+
+	if _, found, err := client.PlayingMedia(t.Context(), plextest.Payload(t, "media.play")); err != nil || found {
+		t.Fatalf("got found %v, err %v", found, err)
+	}
+	if got := srv.Requests("/status/sessions"); got != 0 {
+		t.Fatalf("got %d session requests, want none", got)
+	}
+}
@@ -0,0 +1,322 @@
+package plex
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	s "strings"
+	"sync"
+	"time"
+
+	"github.com/LukeHagar/plexgo"
+	"github.com/LukeHagar/plexgo/models/sdkerrors"
+)
+
+// Connection describes how to reach a Plex server. URL wins over Protocol,
+// IP and Port when set.
+type Connection struct {
+	URL      string
+	Protocol string
+	IP       string
+	Port     string
+	Token    string
+	Timeout  time.Duration
+	// CAFile is a PEM bundle trusted in addition to the system roots.
+	CAFile string
+	// PinSHA256 is the hex SHA-256 of the server's leaf certificate. When set
+	// the certificate chain is not verified, only the pin.
+	PinSHA256 string
+}
+
+var errPinMismatch = errors.New("certificate does not match PLEX_CERT_SHA256")
+
+func (c Connection) BaseURL() (string, error) {
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return "", fmt.Errorf("invalid Plex URL %q", c.URL)
+		}
+		return s.TrimSuffix(u.String(), "/"), nil
+	}
+
+	protocol := c.Protocol
+	if protocol == "" {
+		protocol = "http"
+	}
+	if protocol != "http" && protocol != "https" {
+		return "", fmt.Errorf("invalid Plex protocol %q", protocol)
+	}
+
+	port := c.Port
+	if port == "" {
+		port = "32400"
+	}
+
+	return fmt.Sprintf("%s://%s", protocol, net.JoinHostPort(c.IP, port)), nil
+}
+
+// plexDirectIP returns the address encoded in a plex.direct hostname, e.g.
+// 192.168.1.10 for 192-168-1-10.<hash>.plex.direct. Dialing it directly
+// keeps working when a router's DNS rebinding protection blocks the name.
+func plexDirectIP(host string) (net.IP, bool) {
+	if !s.HasSuffix(host, ".plex.direct") {
+		return nil, false
+	}
+
+	label, _, _ := s.Cut(host, ".")
+	if ip := net.ParseIP(s.ReplaceAll(label, "-", ".")); ip != nil {
+		return ip, true
+	}
+	if ip := net.ParseIP(s.ReplaceAll(label, "-", ":")); ip != nil {
+		return ip, true
+	}
+
+	return nil, false
+}
+
+func (c Connection) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if c.PinSHA256 != "" {
+		pin, err := hex.DecodeString(s.ReplaceAll(s.ToLower(c.PinSHA256), ":", ""))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate pin %q", c.PinSHA256)
+		}
+
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errPinMismatch
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if string(sum[:]) != string(pin) {
+				return fmt.Errorf("%w: got %s", errPinMismatch, hex.EncodeToString(sum[:]))
+			}
+			return nil
+		}
+	}
+
+	return config, nil
+}
+
+// clients holds the HTTP client of each TLS setup, so connections to Plex
+// are kept alive and reused instead of building a transport per request.
+var clients sync.Map
+
+type clientKey struct {
+	caFile string
+	pin    string
+}
+
+// HTTPClient returns the client used for Plex, with the TLS settings and the
+// plex.direct dialing applied. It is built once per TLS setup.
+func (c Connection) HTTPClient() (*http.Client, error) {
+	key := clientKey{caFile: c.CAFile, pin: c.PinSHA256}
+	if client, ok := clients.Load(key); ok {
+		return client.(*http.Client), nil
+	}
+
+	client, err := c.newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	actual, _ := clients.LoadOrStore(key, client)
+	return actual.(*http.Client), nil
+}
+
+func (c Connection) newHTTPClient() (*http.Client, error) {
+	config, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil {
+			if ip, ok := plexDirectIP(host); ok {
+				addr = net.JoinHostPort(ip.String(), port)
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+func NewAPI(c Connection) (*plexgo.PlexAPI, error) {
+	baseURL, err := c.BaseURL()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := c.HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []plexgo.SDKOption{
+		plexgo.WithSecurity(c.Token),
+		plexgo.WithServerURL(baseURL),
+		plexgo.WithClient(client),
+	}
+	if c.Timeout > 0 {
+		opts = append(opts, plexgo.WithTimeout(c.Timeout))
+	}
+
+	return plexgo.New(opts...), nil
+}
+
+type ServerInfo struct {
+	Name              string `json:"friendlyName"`
+	Version           string `json:"version"`
+	MachineIdentifier string `json:"machineIdentifier"`
+}
+
+// CheckConnection asks the server for its name and version. TLS failures
+// are explained in terms of the settings that fix them.
+func CheckConnection(ctx context.Context, c Connection) (ServerInfo, error) {
+	var info ServerInfo
+
+	baseURL, err := c.BaseURL()
+	if err != nil {
+		return info, err
+	}
+
+	client, err := c.HTTPClient()
+	if err != nil {
+		return info, err
+	}
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/", nil)
+	if err != nil {
+		return info, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Plex-Token", c.Token)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return info, describeConnectionError(baseURL, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return info, fmt.Errorf("%s rejected the token, check PLEX_API_KEY", baseURL)
+	}
+	if res.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("%s answered %s", baseURL, res.Status)
+	}
+
+	var body struct {
+		MediaContainer ServerInfo `json:"MediaContainer"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return info, fmt.Errorf("%s did not answer like a Plex server: %w", baseURL, err)
+	}
+
+	return body.MediaContainer, nil
+}
+
+// getJSON decodes the answer of Plex to a GET of path. Failed requests
+// answer SDK errors, so IsRetryable treats them like plexgo's.
+func (c Connection) getJSON(ctx context.Context, path string, out any) error {
+	baseURL, err := c.BaseURL()
+	if err != nil {
+		return err
+	}
+
+	client, err := c.HTTPClient()
+	if err != nil {
+		return err
+	}
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Plex-Token", c.Token)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return sdkerrors.NewSDKError("API error occurred", res.StatusCode, string(body), res)
+	}
+
+	return json.Unmarshal(body, out)
+}
+
+func describeConnectionError(baseURL string, err error) error {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var recordHeader tls.RecordHeaderError
+
+	switch {
+	case errors.Is(err, errPinMismatch):
+		return fmt.Errorf("TLS error connecting to %s: %w", baseURL, err)
+	case errors.As(err, &unknownAuthority):
+		return fmt.Errorf("TLS error connecting to %s: certificate signed by unknown authority %q, set PLEX_CA_FILE or PLEX_CERT_SHA256: %w",
+			baseURL, unknownAuthority.Cert.Issuer.CommonName, err)
+	case errors.As(err, &hostname):
+		return fmt.Errorf("TLS error connecting to %s: certificate is for %s, use the matching *.plex.direct PLEX_URL: %w",
+			baseURL, s.Join(hostname.Certificate.DNSNames, ", "), err)
+	case errors.As(err, &invalid):
+		return fmt.Errorf("TLS error connecting to %s: certificate is invalid (expired or not yet valid?): %w", baseURL, err)
+	case errors.As(err, &recordHeader), s.Contains(err.Error(), "HTTP response to HTTPS client"):
+		return fmt.Errorf("TLS error connecting to %s: the server did not answer with TLS, check PLEX_PROTOCOL and PLEX_PORT: %w", baseURL, err)
+	}
+
+	return fmt.Errorf("could not connect to %s: %w", baseURL, err)
+}
@@ -0,0 +1,135 @@
+package plex
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"plexcache/plex/plextest"
+)
+
+func TestConnectionBaseURL(t *testing.T) {
+	cases := []struct {
+		connection Connection
+		want       string
+	}{
+		{Connection{IP: "10.0.0.2"}, "http://10.0.0.2:32400"},
+		{Connection{Protocol: "https", IP: "10.0.0.2", Port: "443"}, "https://10.0.0.2:443"},
+		{Connection{URL: "https://10-0-0-2.abc123.plex.direct:32400/", IP: "ignored"}, "https://10-0-0-2.abc123.plex.direct:32400"},
+	}
+
+	for _, c := range cases {
+		got, err := c.connection.BaseURL()
+		if err != nil || got != c.want {
+			t.Errorf("BaseURL() = %q, %v, want %q", got, err, c.want)
+		}
+	}
+
+	if _, err := (Connection{Protocol: "ftp", IP: "10.0.0.2"}).BaseURL(); err == nil {
+		t.Error("expected an error for an unknown protocol")
+	}
+}
+
+func TestPlexDirectIP(t *testing.T) {
+	ip, ok := plexDirectIP("192-168-1-10.0123abcd.plex.direct")
+	if !ok || ip.String() != "192.168.1.10" {
+		t.Fatalf("got %v %v", ip, ok)
+	}
+
+	if _, ok := plexDirectIP("plex.example.com"); ok {
+		t.Fatal("only plex.direct hosts carry an address")
+	}
+}
+
+func tlsConnection(srv *plextest.Server) Connection {
+	return Connection{URL: srv.URL, Token: plextest.Token}
+}
+
+func TestCheckConnectionTLS(t *testing.T) {
+	srv := plextest.NewTLSServer(t)
+	ctx := context.Background()
+
+	_, err := CheckConnection(ctx, tlsConnection(srv))
+	if err == nil || !strings.Contains(err.Error(), "PLEX_CA_FILE") {
+		t.Fatalf("expected an unknown authority error, got %v", err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	withCA := tlsConnection(srv)
+	withCA.CAFile = caFile
+	info, err := CheckConnection(ctx, withCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "Test Server" || info.Version == "" {
+		t.Fatalf("unexpected server info %+v", info)
+	}
+
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	pinned := tlsConnection(srv)
+	pinned.PinSHA256 = hex.EncodeToString(sum[:])
+	if _, err := CheckConnection(ctx, pinned); err != nil {
+		t.Fatalf("pinned connection failed: %v", err)
+	}
+
+	pinned.PinSHA256 = strings.Repeat("00", 32)
+	if _, err := CheckConnection(ctx, pinned); err == nil || !strings.Contains(err.Error(), "PLEX_CERT_SHA256") {
+		t.Fatalf("expected a pin mismatch, got %v", err)
+	}
+}
+
+func TestCheckConnectionPlainServer(t *testing.T) {
+	srv := plextest.NewServer(t)
+
+	https := Connection{URL: strings.Replace(srv.URL, "http://", "https://", 1), Token: plextest.Token}
+	_, err := CheckConnection(context.Background(), https)
+	if err == nil || !strings.Contains(err.Error(), "PLEX_PROTOCOL") {
+		t.Fatalf("expected a protocol hint, got %v", err)
+	}
+}
+
+func TestNewAPIOverTLS(t *testing.T) {
+	srv := plextest.NewTLSServer(t)
+	sum := sha256.Sum256(srv.Certificate().Raw)
+
+	connection := tlsConnection(srv)
+	connection.PinSHA256 = hex.EncodeToString(sum[:])
+
+	api, err := NewAPI(connection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewClient(api).GetSeasonMetadata(t.Context(), plextest.Payload(t, "media.play")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPClientIsReused(t *testing.T) {
+	plain := Connection{URL: "http://10.0.0.2:32400"}
+
+	first, err := plain.HTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another server with the same TLS settings
+	second, _ := Connection{URL: "http://10.0.0.3:32400"}.HTTPClient()
+	if first != second {
+		t.Fatal("built a client per call")
+	}
+
+	pinned, _ := Connection{PinSHA256: strings.Repeat("00", 32)}.HTTPClient()
+	if pinned == first {
+		t.Fatal("a pinned connection shares the client of an unpinned one")
+	}
+}
@@ -0,0 +1,235 @@
+// Package plextest runs an in-process fake Plex server that answers with
+// recorded JSON fixtures, so the webhook flow can be tested without Plex.
+package plextest
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	s "strings"
+	"sync"
+	"testing"
+
+	"plexcache/models"
+)
+
+//go:embed testdata
+var fixtures embed.FS
+
+const Token = "test-token"
+
+// Server serves:
+//
+//	/                                  testdata/root.json
+//	/library/metadata/{key}/children   testdata/children/{key}.json
+//	/library/metadata/{key}/allLeaves  testdata/leaves/{key}.json
+//	/status/sessions                   testdata/sessions.json
+//	/identity                          testdata/identity.json
+//
+// Requests without the X-Plex-Token of Token are rejected.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests map[string]int
+	failures []int
+}
+
+func NewServer(t testing.TB) *Server {
+	srv := &Server{requests: map[string]int{}}
+	srv.Server = httptest.NewServer(http.HandlerFunc(srv.serve))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// NewTLSServer is NewServer over HTTPS with a self-signed certificate, see
+// httptest.NewTLSServer.
+func NewTLSServer(t testing.TB) *Server {
+	srv := &Server{requests: map[string]int{}}
+	srv.Server = httptest.NewTLSServer(http.HandlerFunc(srv.serve))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// Requests returns how many requests were made for a path.
+func (srv *Server) Requests(path string) int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.requests[path]
+}
+
+// FailNext makes the next n requests answer with status.
+func (srv *Server) FailNext(n int, status int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for i := 0; i < n; i++ {
+		srv.failures = append(srv.failures, status)
+	}
+}
+
+func (srv *Server) serve(w http.ResponseWriter, r *http.Request) {
+	srv.mu.Lock()
+	srv.requests[r.URL.Path]++
+	var status int
+	if len(srv.failures) > 0 {
+		status, srv.failures = srv.failures[0], srv.failures[1:]
+	}
+	srv.mu.Unlock()
+
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	token := r.Header.Get("X-Plex-Token")
+	if token == "" {
+		token = r.URL.Query().Get("X-Plex-Token")
+	}
+	if token != Token {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	name, ok := fixtureName(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := fixtures.ReadFile(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func fixtureName(urlPath string) (string, bool) {
+	switch urlPath {
+	case "/":
+		return "testdata/root.json", true
+	case "/status/sessions":
+		return "testdata/sessions.json", true
+	case "/identity":
+		return "testdata/identity.json", true
+	}
+
+	parts := s.Split(s.Trim(urlPath, "/"), "/")
+	if len(parts) != 4 || parts[0] != "library" || parts[1] != "metadata" {
+		return "", false
+	}
+
+	switch parts[3] {
+	case "children":
+		return path.Join("testdata/children", parts[2]+".json"), true
+	case "allLeaves":
+		return path.Join("testdata/leaves", parts[2]+".json"), true
+	}
+
+	return "", false
+}
+
+// Fixture returns a file from testdata, e.g. "children/200.json".
+func Fixture(t testing.TB, name string) []byte {
+	data, err := fixtures.ReadFile(path.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("fixture %s: %v", name, err)
+	}
+	return data
+}
+
+// Season returns the recorded season metadata for a ParentRatingKey.
+func Season(t testing.TB, parentRatingKey string) models.SeasonMetadataResponse {
+	var season models.SeasonMetadataResponse
+	if err := json.Unmarshal(Fixture(t, "children/"+parentRatingKey+".json"), &season); err != nil {
+		t.Fatalf("season %s: %v", parentRatingKey, err)
+	}
+	return season
+}
+
+// Payload returns a recorded webhook payload, e.g. "media.play".
+func Payload(t testing.TB, name string) models.Payload {
+	var payload models.Payload
+	if err := json.Unmarshal(Fixture(t, "webhooks/"+name+".json"), &payload); err != nil {
+		t.Fatalf("webhook %s: %v", name, err)
+	}
+	return payload
+}
+
+// WebhookRequest builds the multipart request Plex sends for a payload.
+func WebhookRequest(t testing.TB, url string, payload models.Payload) *http.Request {
+	body, contentType := WebhookBody(t, payload)
+
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	return req
+}
+
+// WebhookBody encodes a payload as the multipart body of a Plex webhook.
+func WebhookBody(t testing.TB, payload models.Payload) (io.Reader, string) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.WriteField("payload", string(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &body, mw.FormDataContentType()
+}
+
+// CreateMedia writes every file of a season fixture below root, at the size
+// Plex reports, and returns the path mapping from Plex paths to root.
+func CreateMedia(t testing.TB, root string, parentRatingKey string) []models.PathMapping {
+	season := Season(t, parentRatingKey)
+	paths := []models.PathMapping{{Plex: "/data/tvshows", Local: root}}
+
+	for _, item := range season.MediaContainer.Metadata {
+		for _, media := range item.Media {
+			for _, part := range media.Part {
+				local := root + s.TrimPrefix(part.File, "/data/tvshows")
+				writeFile(t, local, part.Size)
+
+				for _, stream := range part.Stream {
+					if stream.Format == "srt" {
+						writeFile(t, s.Replace(local, part.Container, stream.LanguageTag+"."+stream.Format, 1), 64)
+					}
+				}
+			}
+		}
+	}
+
+	return paths
+}
+
+func writeFile(t testing.TB, name string, size int64) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte(filepath.Base(name)), int(size)/len(filepath.Base(name))+1)
+	if err := os.WriteFile(name, data[:size], 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,203 @@
+package plex
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"plexcache/metrics"
+	"plexcache/models"
+	"sync"
+	"time"
+
+	"github.com/LukeHagar/plexgo/models/sdkerrors"
+)
+
+// ErrCircuitOpen is returned without calling Plex while the breaker is open.
+var ErrCircuitOpen = errors.New("plex circuit breaker is open")
+
+// IsRetryable tells whether a failed Plex call may succeed later: network
+// errors, timeouts, 5xx and 429 responses and an open breaker. Certificate
+// and TLS handshake failures are network errors too, but come from the TLS
+// setup and fail the same way every time.
+func IsRetryable(err error) bool {
+	if err == nil || isTLSError(err) {
+		return false
+	}
+
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var sdkErr *sdkerrors.SDKError
+	if errors.As(err, &sdkErr) {
+		return sdkErr.StatusCode >= 500 || sdkErr.StatusCode == 429
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func isTLSError(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		invalid          x509.CertificateInvalidError
+		hostname         x509.HostnameError
+		systemRoots      x509.SystemRootsError
+		verification     *tls.CertificateVerificationError
+		recordHeader     tls.RecordHeaderError
+		alert            tls.AlertError
+	)
+
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname) ||
+		errors.As(err, &systemRoots) || errors.As(err, &verification) || errors.As(err, &recordHeader) ||
+		errors.As(err, &alert)
+}
+
+// DefaultBreakerThreshold is the Threshold of a Breaker that sets none.
+const DefaultBreakerThreshold = 5
+
+// Breaker opens after Threshold consecutive failures and rejects calls for
+// Cooldown, then lets a single call through to probe Plex. A zero Threshold
+// means DefaultBreakerThreshold.
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *Breaker) threshold() int {
+	if b.Threshold <= 0 {
+		return DefaultBreakerThreshold
+	}
+	return b.Threshold
+}
+
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold() {
+		return nil
+	}
+
+	if time.Since(b.openedAt) < b.Cooldown || b.probing {
+		return ErrCircuitOpen
+	}
+
+	b.probing = true
+	return nil
+}
+
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+
+	// a cancelled caller says nothing about Plex
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if !IsRetryable(err) {
+		b.failures = 0
+		metrics.Set("plexcache_plex_breaker_open", "1 while the Plex circuit breaker is open.", 0)
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold() {
+		b.openedAt = time.Now()
+		metrics.Set("plexcache_plex_breaker_open", "1 while the Plex circuit breaker is open.", 1)
+	}
+}
+
+// Open tells whether calls are currently rejected.
+func (b *Breaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold() && time.Since(b.openedAt) < b.Cooldown
+}
+
+// ResilientClient retries idempotent metadata reads with jittered
+// exponential backoff behind a circuit breaker.
+type ResilientClient struct {
+	client   MetadataClient
+	breaker  *Breaker
+	attempts int
+	backoff  time.Duration
+}
+
+// minBackoff is the backoff of a ResilientClient given none.
+const minBackoff = time.Millisecond
+
+func NewResilientClient(client MetadataClient, attempts int, backoff time.Duration, breaker *Breaker) *ResilientClient {
+	return &ResilientClient{client: client, breaker: breaker, attempts: max(attempts, 1), backoff: max(backoff, minBackoff)}
+}
+
+func (c *ResilientClient) Breaker() *Breaker {
+	return c.breaker
+}
+
+func (c *ResilientClient) GetSeasonMetadata(ctx context.Context, payload models.Payload) (models.SeasonMetadataResponse, error) {
+	var season models.SeasonMetadataResponse
+	var err error
+
+	for attempt := 0; attempt < c.attempts; attempt++ {
+		if attempt > 0 {
+			// full jitter: sleep a random time up to backoff * 2^attempt
+			select {
+			case <-time.After(rand.N(c.backoff << attempt)):
+			case <-ctx.Done():
+				return season, ctx.Err()
+			}
+		}
+
+		if err = c.breaker.allow(); err != nil {
+			metrics.Inc("plexcache_plex_requests_total", "Plex metadata requests by result.", "result", "short_circuit")
+			return season, err
+		}
+
+		season, err = c.client.GetSeasonMetadata(ctx, payload)
+		c.breaker.record(err)
+
+		if err == nil {
+			metrics.Inc("plexcache_plex_requests_total", "Plex metadata requests by result.", "result", "ok")
+			return season, nil
+		}
+
+		metrics.Inc("plexcache_plex_requests_total", "Plex metadata requests by result.", "result", "error")
+		if !IsRetryable(err) {
+			return season, err
+		}
+		slog.WarnContext(ctx, "plex request failed", "attempt", attempt+1, "of", c.attempts, "err", err)
+	}
+
+	return season, err
+}
+
+// PlayingMedia reads the sessions once through the breaker: a player's
+// session is only worth asking for while the webhook is handled.
+func (c *ResilientClient) PlayingMedia(ctx context.Context, payload models.Payload) (models.Media, bool, error) {
+	reader, ok := c.client.(SessionReader)
+	if !ok {
+		return models.Media{}, false, nil
+	}
+
+	if err := c.breaker.allow(); err != nil {
+		return models.Media{}, false, err
+	}
+
+	media, found, err := reader.PlayingMedia(ctx, payload)
+	c.breaker.record(err)
+
+	return media, found, err
+}
@@ -0,0 +1,152 @@
+package plex
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"plexcache/plex/plextest"
+
+	"github.com/LukeHagar/plexgo"
+)
+
+func newTestClient(t *testing.T, srv *plextest.Server, token string, breaker *Breaker) *ResilientClient {
+	return NewResilientClient(NewClient(plexgo.New(
+		plexgo.WithSecurity(token),
+		plexgo.WithServerURL(srv.URL),
+	)), 3, time.Millisecond, breaker)
+}
+
+func TestResilientClientRetries(t *testing.T) {
+	srv := plextest.NewServer(t)
+	srv.FailNext(2, http.StatusServiceUnavailable)
+	client := newTestClient(t, srv, plextest.Token, &Breaker{Threshold: 5, Cooldown: time.Minute})
+
+	if _, err := client.GetSeasonMetadata(t.Context(), plextest.Payload(t, "media.play")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := srv.Requests("/library/metadata/200/children"); got != 3 {
+		t.Fatalf("got %d requests, want 3", got)
+	}
+}
+
+func TestResilientClientWithoutBackoff(t *testing.T) {
+	srv := plextest.NewServer(t)
+	srv.FailNext(1, http.StatusServiceUnavailable)
+	client := NewResilientClient(NewClient(plexgo.New(
+		plexgo.WithSecurity(plextest.Token),
+		plexgo.WithServerURL(srv.URL),
+	)), 2, 0, &Breaker{Threshold: 5, Cooldown: time.Minute})
+
+	if _, err := client.GetSeasonMetadata(t.Context(), plextest.Payload(t, "media.play")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResilientClientDoesNotRetryClientErrors(t *testing.T) {
+	srv := plextest.NewServer(t)
+	client := newTestClient(t, srv, "wrong", &Breaker{Threshold: 1, Cooldown: time.Minute})
+
+	_, err := client.GetSeasonMetadata(t.Context(), plextest.Payload(t, "media.play"))
+	if err == nil || IsRetryable(err) {
+		t.Fatalf("expected a permanent error, got %v", err)
+	}
+
+	if got := srv.Requests("/library/metadata/200/children"); got != 1 {
+		t.Fatalf("got %d requests, want 1", got)
+	}
+	if client.Breaker().Open() {
+		t.Fatal("a rejected token must not open the breaker")
+	}
+}
+
+func TestBreakerShortCircuits(t *testing.T) {
+	srv := plextest.NewServer(t)
+	srv.FailNext(3, http.StatusBadGateway)
+	breaker := &Breaker{Threshold: 3, Cooldown: 50 * time.Millisecond}
+	client := newTestClient(t, srv, plextest.Token, breaker)
+
+	_, err := client.GetSeasonMetadata(t.Context(), plextest.Payload(t, "media.play"))
+	if !IsRetryable(err) || !breaker.Open() {
+		t.Fatalf("expected the breaker to open, got %v", err)
+	}
+
+	_, err = client.GetSeasonMetadata(t.Context(), plextest.Payload(t, "media.play"))
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if got := srv.Requests("/library/metadata/200/children"); got != 3 {
+		t.Fatalf("got %d requests, want 3", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if _, err := client.GetSeasonMetadata(t.Context(), plextest.Payload(t, "media.play")); err != nil {
+		t.Fatalf("probe after cooldown failed: %v", err)
+	}
+	if breaker.Open() {
+		t.Fatal("breaker should close after a successful probe")
+	}
+}
+
+func TestZeroBreakerUsesDefaultThreshold(t *testing.T) {
+	srv := plextest.NewServer(t)
+	srv.FailNext(DefaultBreakerThreshold, http.StatusBadGateway)
+	breaker := &Breaker{Cooldown: time.Minute}
+	client := newTestClient(t, srv, plextest.Token, breaker)
+
+	if _, err := client.GetSeasonMetadata(t.Context(), plextest.Payload(t, "media.play")); !IsRetryable(err) {
+		t.Fatalf("got %v, want the failure from Plex", err)
+	}
+	// 3 failed attempts
+	if breaker.Open() {
+		t.Fatal("opened before the default threshold")
+	}
+
+	client.GetSeasonMetadata(t.Context(), plextest.Payload(t, "media.play"))
+	if !breaker.Open() {
+		t.Fatal("did not open at the default threshold")
+	}
+}
+
+func TestTLSErrorsAreNotRetryable(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(srv.Close)
+
+	// the test server's certificate is not trusted by the default client
+	_, err := http.Get(srv.URL)
+	var netErr net.Error
+	if !errors.As(err, &netErr) {
+		t.Fatalf("expected a net.Error, got %v", err)
+	}
+
+	for _, err := range []error{
+		err,
+		&url.Error{Op: "Get", URL: srv.URL, Err: x509.HostnameError{Host: "plex.local"}},
+		&url.Error{Op: "Get", URL: srv.URL, Err: tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}},
+	} {
+		if IsRetryable(err) {
+			t.Errorf("%v must not be retried", err)
+		}
+	}
+
+	if !IsRetryable(&url.Error{Op: "Get", URL: srv.URL, Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}) {
+		t.Error("a refused connection must be retried")
+	}
+}
+
+func TestBreakerIgnoresTLSErrors(t *testing.T) {
+	breaker := &Breaker{Threshold: 1, Cooldown: time.Minute}
+	breaker.record(&url.Error{Op: "Get", URL: "https://plex.local", Err: x509.UnknownAuthorityError{}})
+
+	if breaker.Open() {
+		t.Fatal("a certificate failure must not open the breaker")
+	}
+}
@@ -0,0 +1,522 @@
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	s "strings"
+	"unicode"
+)
+
+// Expr is a compiled policy expression.
+//
+// The language is intentionally small:
+//
+//	literals     1, 2.5, "text", 'text', true, false, ["a", "b"]
+//	variables    event, show.title, episode.index, history.plays, ...
+//	operators    ! && || == != < <= > >= in matches
+//	grouping     ( ... )
+//
+// `x in [..]` tests list membership, `x matches "re"` tests a regular
+// expression against a string.
+type Expr struct {
+	src  string
+	root node
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Compile parses src and checks that every variable it references is in vars.
+func Compile(src string, vars map[string]bool) (*Expr, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens, vars: vars}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.peek().text, p.peek().pos)
+	}
+
+	return &Expr{src: src, root: root}, nil
+}
+
+// Bool evaluates the expression against env and requires a boolean result.
+func (e *Expr) Bool(env map[string]any) (bool, error) {
+	v, err := e.root.eval(env)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q is not boolean", e.src)
+	}
+
+	return b, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lex(src string) ([]token, error) {
+	var tokens []token
+	i := 0
+
+	for i < len(src) {
+		c := rune(src[i])
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(src) && (isIdentChar(rune(src[i])) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[start:i], pos: start})
+
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[start:i], pos: start})
+
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			var b s.Builder
+			for i < len(src) && rune(src[i]) != c {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				b.WriteByte(src[i])
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string at offset %d", start)
+			}
+			i++
+			tokens = append(tokens, token{kind: tokString, text: b.String(), pos: start})
+
+		default:
+			start := i
+			two := ""
+			if i+1 < len(src) {
+				two = src[i : i+2]
+			}
+
+			switch two {
+			case "==", "!=", "<=", ">=", "&&", "||":
+				i += 2
+				tokens = append(tokens, token{kind: tokOp, text: two, pos: start})
+				continue
+			}
+
+			if !s.ContainsRune("!<>()[],", c) {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", c, start)
+			}
+			i++
+			tokens = append(tokens, token{kind: tokOp, text: string(c), pos: start})
+		}
+	}
+
+	return append(tokens, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+func isIdentChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_'
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	vars   map[string]bool
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(kind tokenKind, text string) bool {
+	t := p.peek()
+	if t.kind == kind && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(tokOp, text) {
+		t := p.peek()
+		return fmt.Errorf("expected %q at offset %d", text, t.pos)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept(tokOp, "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicNode{op: "||", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseCompare()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept(tokOp, "&&") {
+		right, err := p.parseCompare()
+		if err != nil {
+			return nil, err
+		}
+		left = logicNode{op: "&&", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseCompare() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if !isCompareOp(t) {
+		return left, nil
+	}
+	p.next()
+
+	right, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.text == "matches" {
+		lit, ok := right.(literalNode)
+		pattern, isString := lit.value.(string)
+		if !ok || !isString {
+			return nil, fmt.Errorf("matches at offset %d needs a string literal pattern", t.pos)
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		return matchNode{left: left, re: re}, nil
+	}
+
+	return compareNode{op: t.text, left: left, right: right}, nil
+}
+
+func isCompareOp(t token) bool {
+	switch t.kind {
+	case tokOp:
+		switch t.text {
+		case "==", "!=", "<", "<=", ">", ">=":
+			return true
+		}
+	case tokIdent:
+		return t.text == "in" || t.text == "matches"
+	}
+	return false
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.accept(tokOp, "!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", t.text, t.pos)
+		}
+		return literalNode{value: f}, nil
+
+	case tokString:
+		return literalNode{value: t.text}, nil
+
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literalNode{value: true}, nil
+		case "false":
+			return literalNode{value: false}, nil
+		}
+
+		if !p.vars[t.text] {
+			return nil, fmt.Errorf("unknown variable %q at offset %d", t.text, t.pos)
+		}
+		return varNode{name: t.text}, nil
+
+	case tokOp:
+		switch t.text {
+		case "(":
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+
+		case "[":
+			var items []node
+			for !p.accept(tokOp, "]") {
+				if len(items) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				item, err := p.parseUnary()
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+			return listNode{items: items}, nil
+		}
+	}
+
+	if t.kind == tokEOF {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+}
+
+type node interface {
+	eval(env map[string]any) (any, error)
+}
+
+type literalNode struct {
+	value any
+}
+
+func (n literalNode) eval(map[string]any) (any, error) {
+	return n.value, nil
+}
+
+type varNode struct {
+	name string
+}
+
+func (n varNode) eval(env map[string]any) (any, error) {
+	v, ok := env[n.name]
+	if !ok {
+		return nil, fmt.Errorf("variable %q is not available here", n.name)
+	}
+	return v, nil
+}
+
+type listNode struct {
+	items []node
+}
+
+func (n listNode) eval(env map[string]any) (any, error) {
+	values := make([]any, 0, len(n.items))
+	for _, item := range n.items {
+		v, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n notNode) eval(env map[string]any) (any, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("! needs a boolean, got %T", v)
+	}
+	return !b, nil
+}
+
+type logicNode struct {
+	op          string
+	left, right node
+}
+
+func (n logicNode) eval(env map[string]any) (any, error) {
+	l, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	lb, ok := l.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%s needs booleans, got %T", n.op, l)
+	}
+
+	if n.op == "||" && lb {
+		return true, nil
+	}
+	if n.op == "&&" && !lb {
+		return false, nil
+	}
+
+	r, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	rb, ok := r.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%s needs booleans, got %T", n.op, r)
+	}
+	return rb, nil
+}
+
+type matchNode struct {
+	left node
+	re   *regexp.Regexp
+}
+
+func (n matchNode) eval(env map[string]any) (any, error) {
+	v, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	str, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("matches needs a string, got %T", v)
+	}
+	return n.re.MatchString(str), nil
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+func (n compareNode) eval(env map[string]any) (any, error) {
+	l, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "in":
+		list, ok := r.([]any)
+		if !ok {
+			return nil, fmt.Errorf("in needs a list, got %T", r)
+		}
+		for _, item := range list {
+			if equal(l, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	lf, lok := l.(float64)
+	rf, rok := r.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("%s needs numbers, got %T and %T", n.op, l, r)
+	}
+
+	switch n.op {
+	case "<":
+		return lf < rf, nil
+	case "<=":
+		return lf <= rf, nil
+	case ">":
+		return lf > rf, nil
+	default:
+		return lf >= rf, nil
+	}
+}
+
+func equal(a, b any) bool {
+	switch av := a.(type) {
+	case float64, string, bool:
+		return a == b
+	case []any:
+		bv, ok := b.([]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equal(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
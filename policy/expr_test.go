@@ -0,0 +1,172 @@
+package policy
+
+import (
+	s "strings"
+	"testing"
+)
+
+var testVars = map[string]bool{
+	"event":         true,
+	"show.title":    true,
+	"episode.index": true,
+	"player.local":  true,
+	"missing":       true,
+}
+
+var testEnv = map[string]any{
+	"event":         "media.play",
+	"show.title":    "The Expanse",
+	"episode.index": float64(3),
+	"player.local":  true,
+}
+
+func TestLex(t *testing.T) {
+	tokens, err := lex(`show.title != 'a\'b' && episode.index >= 2.5 || !(x in [1])`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []token{
+		{tokIdent, "show.title", 0},
+		{tokOp, "!=", 11},
+		{tokString, "a'b", 14},
+		{tokOp, "&&", 21},
+		{tokIdent, "episode.index", 24},
+		{tokOp, ">=", 38},
+		{tokNumber, "2.5", 41},
+		{tokOp, "||", 45},
+		{tokOp, "!", 48},
+		{tokOp, "(", 49},
+		{tokIdent, "x", 50},
+		{tokIdent, "in", 52},
+		{tokOp, "[", 55},
+		{tokNumber, "1", 56},
+		{tokOp, "]", 57},
+		{tokOp, ")", 58},
+		{tokEOF, "", 59},
+	}
+	if len(tokens) != len(want) {
+		t.Fatalf("got %d tokens %+v, want %d", len(tokens), tokens, len(want))
+	}
+	for i := range want {
+		if tokens[i] != want[i] {
+			t.Fatalf("token %d is %+v, want %+v", i, tokens[i], want[i])
+		}
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want bool
+	}{
+		{`true`, true},
+		{`!true`, false},
+		{`!!true`, true},
+
+		// && binds tighter than ||, ! tighter than both
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`false && false || true`, true},
+		{`!false && false`, false},
+		{`!(false && false)`, true},
+
+		{`episode.index == 3`, true},
+		{`episode.index != 3`, false},
+		{`episode.index < 3`, false},
+		{`episode.index <= 3`, true},
+		{`episode.index > 2.5`, true},
+		{`episode.index >= 4`, false},
+		{`event == "media.play"`, true},
+		{`event == 'media.play' && player.local`, true},
+		{`player.local == true`, true},
+		{`episode.index == "3"`, false},
+		{`[1, "a"] == [1, "a"]`, true},
+		{`[1, "a"] == [1]`, false},
+
+		{`event in ["media.play", "media.resume"]`, true},
+		{`event in ["media.stop"]`, false},
+		{`episode.index in [1, 2, 3]`, true},
+		{`episode.index in []`, false},
+		{`!(event in ["media.play"])`, false},
+
+		{`show.title matches "^The "`, true},
+		{`show.title matches "(?i)expanse$"`, true},
+		{`show.title matches "^Expanse"`, false},
+		{`show.title matches "\\s"`, true},
+
+		// short-circuiting skips the unavailable variable
+		{`true || missing`, true},
+		{`false && missing`, false},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			expr, err := Compile(tc.src, testVars)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := expr.Bool(testEnv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`season.index == 1`, `unknown variable "season.index" at offset 0`},
+		{`"open`, "unterminated string at offset 0"},
+		{`event = "a"`, `unexpected character '=' at offset 6`},
+		{`episode.index == 1.2.3`, `invalid number "1.2.3" at offset 17`},
+		{`(true`, `expected ")" at offset 5`},
+		{`[1 2]`, `expected "," at offset 3`},
+		{`true false`, `unexpected "false" at offset 5`},
+		{`episode.index < 2 < 3`, `unexpected "<" at offset 18`},
+		{`true &&`, "unexpected end of expression"},
+		{`show.title matches event`, "needs a string literal pattern"},
+		{`show.title matches "("`, "missing closing )"},
+		{``, "unexpected end of expression"},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			_, err := Compile(tc.src, testVars)
+			if err == nil || !s.Contains(err.Error(), tc.want) {
+				t.Fatalf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`episode.index`, "is not boolean"},
+		{`event < 2`, "< needs numbers, got string and float64"},
+		{`!event`, "! needs a boolean, got string"},
+		{`episode.index && true`, "&& needs booleans, got float64"},
+		{`false || event`, "|| needs booleans, got string"},
+		{`episode.index matches "3"`, "matches needs a string, got float64"},
+		{`event in "media.play"`, "in needs a list, got string"},
+		{`missing == 1`, `variable "missing" is not available here`},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			expr, err := Compile(tc.src, testVars)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = expr.Bool(testEnv)
+			if err == nil || !s.Contains(err.Error(), tc.want) {
+				t.Fatalf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
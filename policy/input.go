@@ -0,0 +1,93 @@
+package policy
+
+import (
+	"plexcache/models"
+)
+
+// Input is everything a rule can look at. Season is only known after the
+// season metadata has been fetched, so it is nil during admission.
+type Input struct {
+	Payload models.Payload
+	History models.ShowHistory
+	Season  *models.SeasonMetadataResponse
+}
+
+var admissionVars = map[string]bool{
+	"event":           true,
+	"account.id":      true,
+	"account.title":   true,
+	"server.title":    true,
+	"server.uuid":     true,
+	"player.title":    true,
+	"player.local":    true,
+	"library.id":      true,
+	"library.title":   true,
+	"library.type":    true,
+	"show.title":      true,
+	"show.key":        true,
+	"show.rating":     true,
+	"show.year":       true,
+	"season.index":    true,
+	"season.key":      true,
+	"episode.index":   true,
+	"episode.key":     true,
+	"episode.title":   true,
+	"history.plays":   true,
+	"history.episode": true,
+}
+
+var windowVars = withVars(admissionVars, "season.episodes", "season.remaining")
+
+func withVars(base map[string]bool, names ...string) map[string]bool {
+	vars := make(map[string]bool, len(base)+len(names))
+	for name := range base {
+		vars[name] = true
+	}
+	for _, name := range names {
+		vars[name] = true
+	}
+	return vars
+}
+
+func (in Input) env() map[string]any {
+	m := in.Payload.Metadata
+
+	env := map[string]any{
+		"event":           in.Payload.Event,
+		"account.id":      float64(in.Payload.Account.ID),
+		"account.title":   in.Payload.Account.Title,
+		"server.title":    in.Payload.Server.Title,
+		"server.uuid":     in.Payload.Server.UUID,
+		"player.title":    in.Payload.Player.Title,
+		"player.local":    in.Payload.Player.Local,
+		"library.id":      float64(m.LibrarySectionID),
+		"library.title":   m.LibrarySectionTitle,
+		"library.type":    m.LibrarySectionType,
+		"show.title":      m.GrandparentTitle,
+		"show.key":        m.GrandparentRatingKey,
+		"show.rating":     m.ContentRating,
+		"show.year":       float64(m.Year),
+		"season.index":    float64(m.ParentIndex),
+		"season.key":      m.ParentRatingKey,
+		"episode.index":   float64(m.Index),
+		"episode.key":     m.RatingKey,
+		"episode.title":   m.Title,
+		"history.plays":   float64(in.History.Plays),
+		"history.episode": float64(in.History.LastIndex),
+	}
+
+	if in.Season != nil {
+		episodes := len(in.Season.MediaContainer.Metadata)
+		remaining := 0
+		for _, item := range in.Season.MediaContainer.Metadata {
+			if item.Index > m.Index {
+				remaining++
+			}
+		}
+
+		env["season.episodes"] = float64(episodes)
+		env["season.remaining"] = float64(remaining)
+	}
+
+	return env
+}
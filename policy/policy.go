@@ -0,0 +1,188 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const (
+	ActionCache = "cache"
+	ActionSkip  = "skip"
+)
+
+// Rule is an admission rule. The first rule whose `when` expression is true
+// decides whether the episodes after the playing one are cached.
+type Rule struct {
+	Name   string `json:"name"`
+	When   string `json:"when"`
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+
+	expr *Expr
+}
+
+// WindowRule decides which episodes are cached once a webhook is admitted:
+// `count` episodes starting `offset` episodes after the playing one.
+type WindowRule struct {
+	Name   string `json:"name"`
+	When   string `json:"when"`
+	Offset int    `json:"offset"`
+	Count  int    `json:"count"`
+
+	expr *Expr
+}
+
+type Policy struct {
+	Admission []Rule       `json:"admission"`
+	Window    []WindowRule `json:"window"`
+}
+
+type Decision struct {
+	Cache  bool   `json:"cache"`
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+type Window struct {
+	Rule   string `json:"rule"`
+	Offset int    `json:"offset"`
+	Count  int    `json:"count"`
+}
+
+// Default mirrors the behaviour plex-cache had before policies existed:
+// cache the next 4 episodes when a show outside season 1 starts playing.
+func Default() *Policy {
+	p := &Policy{
+		Admission: []Rule{
+			{
+				Name:   "playback-events",
+				When:   `!(event in ["media.play", "media.resume"])`,
+				Action: ActionSkip,
+				Reason: "event is not a playback start",
+			},
+			{
+				Name:   "shows-only",
+				When:   `library.type != "show"`,
+				Action: ActionSkip,
+				Reason: "item is not in a show library",
+			},
+			{
+				// skipping first episode of season 1 to be sure user likes serie
+				Name:   "skip-first-episode",
+				When:   `season.index == 1 || episode.index == 1`,
+				Action: ActionSkip,
+				Reason: "first season or first episode",
+			},
+			{
+				Name:   "default",
+				When:   `true`,
+				Action: ActionCache,
+				Reason: "default",
+			},
+		},
+		Window: []WindowRule{
+			{Name: "default", When: `true`, Offset: 1, Count: 4},
+		},
+	}
+
+	if err := p.compile(); err != nil {
+		panic(err)
+	}
+
+	return p
+}
+
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse policy %s: %w", path, err)
+	}
+
+	if err := p.compile(); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", path, err)
+	}
+
+	return &p, nil
+}
+
+func (p *Policy) compile() error {
+	if len(p.Admission) == 0 {
+		return fmt.Errorf("no admission rules")
+	}
+
+	if len(p.Window) == 0 {
+		return fmt.Errorf("no window rules")
+	}
+
+	for i := range p.Admission {
+		rule := &p.Admission[i]
+		if rule.Action != ActionCache && rule.Action != ActionSkip {
+			return fmt.Errorf("admission rule %q: action must be %q or %q", rule.Name, ActionCache, ActionSkip)
+		}
+
+		expr, err := Compile(rule.When, admissionVars)
+		if err != nil {
+			return fmt.Errorf("admission rule %q: %w", rule.Name, err)
+		}
+		rule.expr = expr
+	}
+
+	for i := range p.Window {
+		rule := &p.Window[i]
+		if rule.Count <= 0 {
+			return fmt.Errorf("window rule %q: count must be positive", rule.Name)
+		}
+
+		expr, err := Compile(rule.When, windowVars)
+		if err != nil {
+			return fmt.Errorf("window rule %q: %w", rule.Name, err)
+		}
+		rule.expr = expr
+	}
+
+	return nil
+}
+
+// Admit evaluates the admission rules in order. When no rule matches the
+// webhook is not cached.
+func (p *Policy) Admit(in Input) (Decision, error) {
+	env := in.env()
+
+	for _, rule := range p.Admission {
+		ok, err := rule.expr.Bool(env)
+		if err != nil {
+			return Decision{}, fmt.Errorf("admission rule %q: %w", rule.Name, err)
+		}
+
+		if ok {
+			return Decision{Cache: rule.Action == ActionCache, Rule: rule.Name, Reason: rule.Reason}, nil
+		}
+	}
+
+	return Decision{Cache: false, Rule: "", Reason: "no rule matched"}, nil
+}
+
+// WindowFor picks the first matching window rule. Season metadata must be set
+// on the input so rules can use season.episodes and season.remaining.
+func (p *Policy) WindowFor(in Input) (Window, error) {
+	env := in.env()
+
+	for _, rule := range p.Window {
+		ok, err := rule.expr.Bool(env)
+		if err != nil {
+			return Window{}, fmt.Errorf("window rule %q: %w", rule.Name, err)
+		}
+
+		if ok {
+			return Window{Rule: rule.Name, Offset: rule.Offset, Count: rule.Count}, nil
+		}
+	}
+
+	return Window{}, fmt.Errorf("no window rule matched")
+}
@@ -0,0 +1,174 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	s "strings"
+	"testing"
+
+	"plexcache/models"
+)
+
+// legacyCanCache is the admission plex-cache had before policies: playback
+// starts of shows outside the first season and first episode.
+func legacyCanCache(payload models.Payload) bool {
+	isCacheableEvent := payload.Event == "media.resume" || payload.Event == "media.play"
+	isShow := payload.Metadata.LibrarySectionType == "show"
+	isCacheableEpisode := payload.Metadata.ParentIndex != 1 && payload.Metadata.Index != 1
+
+	return isCacheableEvent && isShow && isCacheableEpisode
+}
+
+// seasonOf is a season of episodes 1 to n.
+func seasonOf(t *testing.T, n int) *models.SeasonMetadataResponse {
+	t.Helper()
+
+	var items []string
+	for i := 1; i <= n; i++ {
+		items = append(items, fmt.Sprintf(`{"index": %d}`, i))
+	}
+
+	var season models.SeasonMetadataResponse
+	if err := json.Unmarshal([]byte(`{"MediaContainer": {"Metadata": [`+s.Join(items, ",")+`]}}`), &season); err != nil {
+		t.Fatal(err)
+	}
+
+	return &season
+}
+
+func TestDefaultMatchesLegacyBehaviour(t *testing.T) {
+	pol := Default()
+
+	season := seasonOf(t, 10)
+
+	for _, event := range []string{"media.play", "media.resume", "media.pause", "media.stop", "media.scrobble", "library.new"} {
+		for _, library := range []string{"show", "movie", "artist"} {
+			for _, seasonIndex := range []int{0, 1, 2, 5} {
+				for _, episodeIndex := range []int{0, 1, 2, 9} {
+					var payload models.Payload
+					payload.Event = event
+					payload.Metadata.LibrarySectionType = library
+					payload.Metadata.ParentIndex = seasonIndex
+					payload.Metadata.Index = episodeIndex
+
+					for _, history := range []models.ShowHistory{{}, {Plays: 3, LastIndex: 8}} {
+						in := Input{Payload: payload, History: history}
+
+						decision, err := pol.Admit(in)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if want := legacyCanCache(payload); decision.Cache != want {
+							t.Fatalf("%s of %s S%02dE%02d: got cache %v by rule %q, want %v", event, library, seasonIndex, episodeIndex, decision.Cache, decision.Rule, want)
+						}
+
+						in.Season = season
+						window, err := pol.WindowFor(in)
+						if err != nil {
+							t.Fatal(err)
+						}
+						// the next 4 episodes
+						if window.Offset != 1 || window.Count != 4 {
+							t.Fatalf("got window %+v", window)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestAdmitReasons(t *testing.T) {
+	pol := Default()
+
+	for _, tc := range []struct {
+		event   string
+		library string
+		rule    string
+		reason  string
+	}{
+		{"media.stop", "show", "playback-events", "event is not a playback start"},
+		{"media.play", "movie", "shows-only", "item is not in a show library"},
+		{"media.play", "show", "default", "default"},
+	} {
+		var payload models.Payload
+		payload.Event = tc.event
+		payload.Metadata.LibrarySectionType = tc.library
+		payload.Metadata.ParentIndex = 2
+		payload.Metadata.Index = 3
+
+		decision, err := pol.Admit(Input{Payload: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.Rule != tc.rule || decision.Reason != tc.reason {
+			t.Fatalf("%s of %s: got %+v", tc.event, tc.library, decision)
+		}
+	}
+}
+
+func TestWindowRules(t *testing.T) {
+	pol := &Policy{
+		Admission: []Rule{{Name: "all", When: `true`, Action: ActionCache}},
+		Window: []WindowRule{
+			{Name: "season-end", When: `season.remaining <= 2`, Offset: 1, Count: 2},
+			{Name: "default", When: `true`, Offset: 1, Count: 4},
+		},
+	}
+	if err := pol.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	season := seasonOf(t, 10)
+
+	for index, want := range map[int]string{3: "default", 7: "default", 8: "season-end", 10: "season-end"} {
+		var payload models.Payload
+		payload.Metadata.Index = index
+
+		window, err := pol.WindowFor(Input{Payload: payload, Season: season})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if window.Rule != want {
+			t.Fatalf("episode %d: got rule %q, want %q", index, window.Rule, want)
+		}
+	}
+
+	// without season metadata season.remaining is not available
+	if _, err := pol.WindowFor(Input{}); err == nil {
+		t.Fatal("expected an error without season metadata")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy string
+		want   string
+	}{
+		{"valid", `{"admission": [{"name": "all", "when": "true", "action": "cache"}], "window": [{"name": "next", "when": "true", "offset": 1, "count": 2}]}`, ""},
+		{"not json", `{`, "parse policy"},
+		{"no admission", `{"window": [{"name": "next", "when": "true", "count": 2}]}`, "no admission rules"},
+		{"no window", `{"admission": [{"name": "all", "when": "true", "action": "cache"}]}`, "no window rules"},
+		{"bad action", `{"admission": [{"name": "all", "when": "true", "action": "maybe"}], "window": [{"name": "next", "when": "true", "count": 2}]}`, `admission rule "all": action must be`},
+		{"window variable in admission", `{"admission": [{"name": "end", "when": "season.remaining < 2", "action": "cache"}], "window": [{"name": "next", "when": "true", "count": 2}]}`, `admission rule "end": unknown variable "season.remaining"`},
+		{"zero count", `{"admission": [{"name": "all", "when": "true", "action": "cache"}], "window": [{"name": "next", "when": "true"}]}`, `window rule "next": count must be positive`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policy.json")
+			if err := os.WriteFile(path, []byte(tc.policy), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := Load(path)
+			if tc.want == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.want != "" && (err == nil || !s.Contains(err.Error(), tc.want)) {
+				t.Fatalf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package redisH
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	s "strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Config describes how to reach redis. URL is either host:port or a
+// redis:// or rediss:// URL with credentials and DB, the other fields
+// override what the URL says.
+type Config struct {
+	URL      string
+	Username string
+	Password string
+	// DB overrides the DB of the URL when set.
+	DB *int
+	// TLS enables TLS for a host:port URL, rediss:// always uses it.
+	TLS bool
+	// CAFile is a PEM bundle trusted in addition to the system roots.
+	CAFile             string
+	InsecureSkipVerify bool
+	// SentinelMaster connects through Sentinel to the master of this name.
+	// SentinelAddrs defaults to the address of the URL.
+	SentinelMaster   string
+	SentinelAddrs    []string
+	SentinelPassword string
+}
+
+func (c Config) options() (*redis.Options, error) {
+	opts := &redis.Options{Addr: c.URL}
+
+	if s.Contains(c.URL, "://") {
+		parsed, err := redis.ParseURL(c.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %v", err)
+		}
+		opts = parsed
+	}
+
+	if c.Username != "" {
+		opts.Username = c.Username
+	}
+	if c.Password != "" {
+		opts.Password = c.Password
+	}
+	if c.DB != nil {
+		opts.DB = *c.DB
+	}
+
+	if c.TLS || c.CAFile != "" || c.InsecureSkipVerify {
+		if opts.TLSConfig == nil {
+			host, _, _ := net.SplitHostPort(opts.Addr)
+			opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: host}
+		}
+		opts.TLSConfig.InsecureSkipVerify = c.InsecureSkipVerify
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		opts.TLSConfig.RootCAs = pool
+	}
+
+	return opts, nil
+}
+
+// NewClient builds the client for a Config, a failover client when
+// SentinelMaster is set.
+func NewClient(c Config) (*redis.Client, error) {
+	opts, err := c.options()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.SentinelMaster == "" {
+		return redis.NewClient(opts), nil
+	}
+
+	addrs := c.SentinelAddrs
+	if len(addrs) == 0 {
+		addrs = []string{opts.Addr}
+	}
+
+	return redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:       c.SentinelMaster,
+		SentinelAddrs:    addrs,
+		SentinelPassword: c.SentinelPassword,
+		Username:         opts.Username,
+		Password:         opts.Password,
+		DB:               opts.DB,
+		TLSConfig:        opts.TLSConfig,
+	}), nil
+}
+
+// expiredChannel is the keyevent channel of expired keys in the DB of rdb.
+func expiredChannel(rdb *redis.Client) string {
+	return fmt.Sprintf("__keyevent@%d__:expired", rdb.Options().DB)
+}
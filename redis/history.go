@@ -0,0 +1,51 @@
+package redisH
+
+import (
+	"context"
+	"plexcache/models"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// historyRetention is how long the history of a show is kept after the
+// account last played it.
+const historyRetention = 180 * 24 * time.Hour
+
+func historyKey(server string, accountID int, showKey string) string {
+	if server == "" {
+		return key("history", strconv.Itoa(accountID), showKey)
+	}
+
+	return key("history", server, strconv.Itoa(accountID), showKey)
+}
+
+func GetShowHistory(ctx context.Context, rdb *redis.Client, server string, payload models.Payload) (models.ShowHistory, error) {
+	var history models.ShowHistory
+
+	values, err := rdb.HGetAll(ctx, historyKey(server, payload.Account.ID, payload.Metadata.GrandparentRatingKey)).Result()
+	if err != nil {
+		return history, err
+	}
+
+	history.Plays, _ = strconv.Atoi(values["plays"])
+	history.LastIndex, _ = strconv.Atoi(values["lastIndex"])
+	history.ParentIndex, _ = strconv.Atoi(values["parentIndex"])
+
+	return history, nil
+}
+
+// RecordShowPlay counts a media.play of a show episode for the account. The
+// history of shows the account stopped watching expires.
+func RecordShowPlay(ctx context.Context, rdb *redis.Client, server string, payload models.Payload) error {
+	key := historyKey(server, payload.Account.ID, payload.Metadata.GrandparentRatingKey)
+
+	pipe := rdb.Pipeline()
+	pipe.HIncrBy(ctx, key, "plays", 1)
+	pipe.HSet(ctx, key, "lastIndex", payload.Metadata.Index, "parentIndex", payload.Metadata.ParentIndex)
+	pipe.Expire(ctx, key, historyRetention)
+	_, err := pipe.Exec(ctx)
+
+	return err
+}
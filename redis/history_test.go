@@ -0,0 +1,34 @@
+package redisH
+
+import (
+	"testing"
+
+	"plexcache/redis/redistest"
+)
+
+func TestRecordShowPlay(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	payload := show(1, "100")
+	payload.Metadata.Index = 3
+	payload.Metadata.ParentIndex = 2
+
+	for range 2 {
+		if err := RecordShowPlay(t.Context(), rdb, "", payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := GetShowHistory(t.Context(), rdb, "", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.Plays != 2 || history.LastIndex != 3 || history.ParentIndex != 2 {
+		t.Fatalf("got %+v", history)
+	}
+
+	if ttl := mr.TTL("plex-cache:history:1:100"); ttl != historyRetention {
+		t.Fatalf("history has ttl %v, want %v", ttl, historyRetention)
+	}
+}
@@ -0,0 +1,78 @@
+package redisH
+
+import (
+	"context"
+	"encoding/json"
+	"plexcache/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// JournalLength is about how many webhooks the journal keeps, older ones
+// are trimmed. 0 turns the journal off.
+var JournalLength int64 = 10000
+
+func journalKey() string {
+	return key("journal")
+}
+
+// AppendJournal adds a webhook to the journal stream and returns its id.
+func AppendJournal(ctx context.Context, rdb *redis.Client, entry models.JournalEntry) (string, error) {
+	if JournalLength <= 0 {
+		return "", nil
+	}
+
+	marshaled, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+
+	return rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: journalKey(),
+		MaxLen: JournalLength,
+		Approx: true,
+		Values: map[string]any{"entry": marshaled},
+	}).Result()
+}
+
+// ListJournal returns up to count webhooks from the journal, newest first.
+func ListJournal(ctx context.Context, rdb *redis.Client, count int64) ([]models.JournalEntry, error) {
+	messages, err := rdb.XRevRangeN(ctx, journalKey(), "+", "-", count).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]models.JournalEntry, 0, len(messages))
+	for _, message := range messages {
+		entry, err := journalEntry(message)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// GetJournalEntry returns the webhook with the given id, if still kept.
+func GetJournalEntry(ctx context.Context, rdb *redis.Client, id string) (models.JournalEntry, bool, error) {
+	messages, err := rdb.XRangeN(ctx, journalKey(), id, id, 1).Result()
+	if err != nil || len(messages) == 0 {
+		return models.JournalEntry{}, false, err
+	}
+
+	entry, err := journalEntry(messages[0])
+	return entry, err == nil, err
+}
+
+func journalEntry(message redis.XMessage) (models.JournalEntry, error) {
+	var entry models.JournalEntry
+
+	stored, _ := message.Values["entry"].(string)
+	if err := json.Unmarshal([]byte(stored), &entry); err != nil {
+		return entry, err
+	}
+	entry.ID = message.ID
+
+	return entry, nil
+}
@@ -0,0 +1,299 @@
+package redisH
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	s "strings"
+	"time"
+
+	"plexcache/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultKeyPrefix is the prefix of every key unless REDIS_KEY_PREFIX says
+// otherwise.
+const DefaultKeyPrefix = "plex-cache"
+
+// SchemaVersion is the layout of the keys and records written by this
+// version. Version 1 stored cache records and their expirers under the bare
+// rating key, version 2 kept no references from cached files to records.
+const SchemaVersion = 3
+
+const expirerSuffix = ":plex-expirer"
+
+var keyPrefix = DefaultKeyPrefix
+
+// SetKeyPrefix sets the prefix of every key, it is called once on startup.
+func SetKeyPrefix(prefix string) {
+	if prefix == "" {
+		prefix = DefaultKeyPrefix
+	}
+
+	keyPrefix = s.TrimSuffix(prefix, ":")
+}
+
+func key(parts ...string) string {
+	return keyPrefix + ":" + s.Join(parts, ":")
+}
+
+func schemaKey() string {
+	return key("schema")
+}
+
+// recordKey is the key of the cache record of a rating key, namespaced by
+// the server UUID in a multi-server setup. Its expirer is the same key with
+// expirerSuffix.
+func recordKey(server string, ratingKey string) string {
+	if server == "" {
+		return key("episode", ratingKey)
+	}
+
+	return key("episode", server, ratingKey)
+}
+
+// ErrSchemaOutdated is returned by CheckSchema for a redis that was not
+// migrated to SchemaVersion yet.
+var ErrSchemaOutdated = errors.New("redis holds an older schema, start the server once to migrate it")
+
+// schemaVersion reads the stored schema version, 1 when none is stored.
+func schemaVersion(ctx context.Context, rdb *redis.Client) (int, error) {
+	version, err := rdb.Get(ctx, schemaKey()).Int()
+	if err == redis.Nil {
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if version > SchemaVersion {
+		return version, fmt.Errorf("redis holds schema version %d, this version of plex-cache only knows %d", version, SchemaVersion)
+	}
+
+	return version, nil
+}
+
+// CheckSchema tells whether redis holds SchemaVersion without writing
+// anything, for the commands that run next to the server.
+func CheckSchema(ctx context.Context, rdb *redis.Client) error {
+	version, err := schemaVersion(ctx, rdb)
+	if err != nil {
+		return err
+	}
+
+	if version < SchemaVersion {
+		return ErrSchemaOutdated
+	}
+
+	return nil
+}
+
+// Migrate upgrades the keys written by older versions to SchemaVersion and
+// stores the version. Cache records keep their expirers and TTLs, so the
+// cached files are still removed when they expire.
+func Migrate(ctx context.Context, rdb *redis.Client) error {
+	version, err := schemaVersion(ctx, rdb)
+	if err != nil {
+		return err
+	}
+
+	if version < 2 {
+		if err := migrateV1(ctx, rdb); err != nil {
+			return fmt.Errorf("migrating to schema version 2: %w", err)
+		}
+	}
+	if version < 3 {
+		if err := migrateV2(ctx, rdb); err != nil {
+			return fmt.Errorf("migrating to schema version 3: %w", err)
+		}
+	}
+
+	return rdb.Set(ctx, schemaKey(), SchemaVersion, 0).Err()
+}
+
+// orphanExpiry is the TTL of the expirer given to a version 1 record whose
+// expirer already expired, so it is expired shortly after the server runs.
+const orphanExpiry = time.Minute
+
+// migrateV1 moves the records version 1 stored under the bare rating key and
+// their <ratingKey>:plex-expirer keys to <prefix>:episode:<ratingKey>. Only
+// numeric rating keys are moved, other keys belong to other applications.
+// Records whose expirer expired while the server was down are moved with an
+// expirer of orphanExpiry, so their files are still removed.
+func migrateV1(ctx context.Context, rdb *redis.Client) error {
+	var records int
+
+	err := scanKeys(ctx, rdb, "*"+expirerSuffix, func(expirer string) error {
+		dataKey := s.TrimSuffix(expirer, expirerSuffix)
+		if !isRatingKey(dataKey) {
+			return nil
+		}
+
+		newKey := key("episode", dataKey)
+
+		episodeCache, found, err := readV1Record(ctx, rdb, dataKey)
+		if err != nil {
+			return err
+		}
+		if found {
+			if err := stampRecord(ctx, rdb, dataKey, episodeCache); err != nil {
+				return err
+			}
+		}
+		if err := renameIfExists(ctx, rdb, dataKey, newKey); err != nil {
+			return err
+		}
+		if err := renameIfExists(ctx, rdb, expirer, newKey+expirerSuffix); err != nil {
+			return err
+		}
+
+		records++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var orphans int
+
+	// the records left are the ones without an expirer
+	err = scanKeys(ctx, rdb, "[0-9]*", func(dataKey string) error {
+		if !isRatingKey(dataKey) {
+			return nil
+		}
+
+		// a record only when it reads as one of its rating key, other
+		// applications may use numeric keys too
+		episodeCache, found, err := readV1Record(ctx, rdb, dataKey)
+		if err != nil || !found || episodeCache.RatingKey != dataKey {
+			return err
+		}
+		if err := stampRecord(ctx, rdb, dataKey, episodeCache); err != nil {
+			return err
+		}
+
+		newKey := key("episode", dataKey)
+
+		pipe := rdb.TxPipeline()
+		pipe.Rename(ctx, dataKey, newKey)
+		pipe.Set(ctx, newKey+expirerSuffix, "", orphanExpiry)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+
+		orphans++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if records > 0 || orphans > 0 {
+		slog.InfoContext(ctx, "migrated to schema version 2", "records", records, "expired", orphans)
+	}
+
+	return nil
+}
+
+// migrateV2 adds the records of every server to the references of the
+// files they cache.
+func migrateV2(ctx context.Context, rdb *redis.Client) error {
+	episodes, err := ListCachedEpisodes(ctx, rdb)
+	if err != nil || len(episodes) == 0 {
+		return err
+	}
+
+	pipe := rdb.Pipeline()
+	for _, episode := range episodes {
+		updateRefs(ctx, pipe, recordKey(episode.Server, episode.RatingKey), nil, recordPaths(episode))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "migrated to schema version 3", "records", len(episodes))
+	return nil
+}
+
+func isRatingKey(k string) bool {
+	if k == "" {
+		return false
+	}
+
+	for _, c := range k {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// scanKeys collects the keys first, renaming while scanning could return a
+// key twice.
+func scanKeys(ctx context.Context, rdb *redis.Client, pattern string, fn func(string) error) error {
+	var keys []string
+
+	iter := rdb.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renameIfExists renames a key keeping its TTL. Unlike letting it expire, a
+// rename does not trigger SubscribeToExpired.
+func renameIfExists(ctx context.Context, rdb *redis.Client, from string, to string) error {
+	n, err := rdb.Exists(ctx, from).Result()
+	if err != nil || n == 0 {
+		return err
+	}
+
+	return rdb.Rename(ctx, from, to).Err()
+}
+
+// readV1Record reads the version 1 record under dataKey, found is false
+// when dataKey holds none.
+func readV1Record(ctx context.Context, rdb *redis.Client, dataKey string) (episodeCache models.EpisodeCache, found bool, err error) {
+	kind, err := rdb.Type(ctx, dataKey).Result()
+	if err != nil || kind != "string" {
+		return episodeCache, false, err
+	}
+
+	storedValue, err := rdb.Get(ctx, dataKey).Result()
+	if err == redis.Nil {
+		return episodeCache, false, nil
+	} else if err != nil {
+		return episodeCache, false, err
+	}
+
+	if err := json.Unmarshal([]byte(storedValue), &episodeCache); err != nil {
+		slog.WarnContext(ctx, "leaving unreadable record", "key", dataKey, "err", err)
+		return episodeCache, false, nil
+	}
+
+	return episodeCache, true, nil
+}
+
+// stampRecord writes the schema version into a version 1 record.
+func stampRecord(ctx context.Context, rdb *redis.Client, dataKey string, episodeCache models.EpisodeCache) error {
+	episodeCache.Version = SchemaVersion
+	marshaled, err := json.Marshal(episodeCache)
+	if err != nil {
+		return err
+	}
+
+	return rdb.Set(ctx, dataKey, marshaled, redis.KeepTTL).Err()
+}
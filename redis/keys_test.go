@@ -0,0 +1,185 @@
+package redisH
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"plexcache/models"
+	"plexcache/redis/redistest"
+)
+
+func TestMigrateV1(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	record, _ := json.Marshal(models.EpisodeCache{RatingKey: "203", EpisodeFilePath: "/media/tvshows/a.mkv", Copied: true})
+	mr.Set("203", string(record))
+	mr.Set("203:plex-expirer", "")
+	mr.SetTTL("203:plex-expirer", time.Hour)
+	mr.Set("not-plex-cache", "left alone")
+	mr.Set("session:plex-expirer", "left alone")
+	mr.HSet("history:1:100", "plays", "2")
+	mr.HSet("plex-cache:usage", "bytes", "1203")
+
+	if err := Migrate(t.Context(), rdb); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, old := range []string{"203", "203:plex-expirer"} {
+		if mr.Exists(old) {
+			t.Fatalf("%s was not migrated", old)
+		}
+	}
+
+	if ttl := mr.TTL("plex-cache:episode:203:plex-expirer"); ttl != time.Hour {
+		t.Fatalf("expirer has ttl %v, want 1h", ttl)
+	}
+
+	episode, found, err := GetCachedEpisode(t.Context(), rdb, "", "203")
+	if err != nil || !found {
+		t.Fatalf("record not found: %v", err)
+	}
+	if episode.Version != SchemaVersion || !episode.Copied {
+		t.Fatalf("unexpected record %+v", episode)
+	}
+
+	if v, _ := mr.Get("plex-cache:schema"); v != "3" {
+		t.Fatalf("schema version %q, want 3", v)
+	}
+	for _, other := range []string{"not-plex-cache", "session:plex-expirer", "history:1:100", "plex-cache:usage"} {
+		if !mr.Exists(other) {
+			t.Fatalf("%s should be left alone", other)
+		}
+	}
+
+	if err := Migrate(t.Context(), rdb); err != nil {
+		t.Fatalf("migrating twice: %v", err)
+	}
+}
+
+func TestMigrateV2(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	mr.Set("plex-cache:schema", "2")
+	for _, server := range []string{"first", "second"} {
+		record, _ := json.Marshal(models.EpisodeCache{Server: server, RatingKey: "204", EpisodeFilePath: "/S02E04.mkv", SrtFilePaths: []string{"/S02E04.srt"}, Version: 2})
+		mr.Set("plex-cache:episode:"+server+":204", string(record))
+	}
+
+	if err := Migrate(t.Context(), rdb); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/S02E04.mkv", "/S02E04.srt"} {
+		members, err := mr.Members("plex-cache:refs:" + path)
+		if err != nil || !slices.Equal(members, []string{"plex-cache:episode:first:204", "plex-cache:episode:second:204"}) {
+			t.Fatalf("got references %v, %v for %s", members, err, path)
+		}
+	}
+}
+
+func TestMigrateV1Orphans(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	// the expirer of 204 expired while the server was down
+	record, _ := json.Marshal(models.EpisodeCache{RatingKey: "204", EpisodeFilePath: "/media/tvshows/b.mkv", Copied: true})
+	mr.Set("204", string(record))
+	// the expirer of 205 is left without its record
+	mr.Set("205:plex-expirer", "")
+	mr.Set("42", "left alone")
+	mr.Set("43", `{"ratingKey":"7"}`)
+	mr.HSet("44", "field", "left alone")
+
+	if err := Migrate(t.Context(), rdb); err != nil {
+		t.Fatal(err)
+	}
+
+	if mr.Exists("204") {
+		t.Fatal("204 was not migrated")
+	}
+	episode, found, err := GetCachedEpisode(t.Context(), rdb, "", "204")
+	if err != nil || !found || episode.Version != SchemaVersion {
+		t.Fatalf("got %+v, %v, %v", episode, found, err)
+	}
+	if ttl := mr.TTL("plex-cache:episode:204:plex-expirer"); ttl != orphanExpiry {
+		t.Fatalf("expirer has ttl %v, want %v", ttl, orphanExpiry)
+	}
+
+	if !mr.Exists("plex-cache:episode:205:plex-expirer") || mr.Exists("plex-cache:episode:205") {
+		t.Fatal("the expirer of 205 should be moved alone")
+	}
+
+	for _, other := range []string{"42", "43", "44"} {
+		if !mr.Exists(other) || mr.Exists("plex-cache:episode:"+other) {
+			t.Fatalf("%s should be left alone", other)
+		}
+	}
+}
+
+func TestMigrateCustomPrefix(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	SetKeyPrefix("tv")
+	t.Cleanup(func() { SetKeyPrefix("") })
+
+	mr.Set("203", "{}")
+	mr.Set("203:plex-expirer", "")
+	mr.HSet("plex-cache:usage", "bytes", "1203")
+
+	if err := Migrate(t.Context(), rdb); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"tv:episode:203", "tv:episode:203:plex-expirer", "tv:schema"} {
+		if !mr.Exists(k) {
+			t.Fatalf("%s missing after migration", k)
+		}
+	}
+
+	// the keys of another instance using the default prefix
+	if !mr.Exists("plex-cache:usage") || mr.Exists("tv:usage") {
+		t.Fatal("plex-cache:usage should be left alone")
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	mr.Set("203", "{}")
+	mr.Set("203:plex-expirer", "")
+
+	if err := CheckSchema(t.Context(), rdb); !errors.Is(err, ErrSchemaOutdated) {
+		t.Fatalf("got %v before migrating", err)
+	}
+	if !mr.Exists("203") || mr.Exists("plex-cache:schema") {
+		t.Fatal("checking the schema wrote to redis")
+	}
+
+	if err := Migrate(t.Context(), rdb); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchema(t.Context(), rdb); err != nil {
+		t.Fatalf("got %v after migrating", err)
+	}
+
+	mr.Set("plex-cache:schema", "99")
+	if err := CheckSchema(t.Context(), rdb); err == nil || errors.Is(err, ErrSchemaOutdated) {
+		t.Fatalf("got %v for a newer schema", err)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	mr := redistest.NewServer(t)
+	mr.Set("plex-cache:schema", "99")
+
+	if err := Migrate(t.Context(), mr.Client(t)); err == nil {
+		t.Fatal("expected an error for a newer schema")
+	}
+}
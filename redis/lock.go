@@ -0,0 +1,113 @@
+package redisH
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"plexcache/models"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrLocked is returned by AcquireShowLock while another webhook holds the
+// lock of the show.
+var ErrLocked = errors.New("show is locked by another webhook")
+
+// only the holder may extend or release a lock, which matters once a lock
+// expired and was taken by someone else
+var (
+	extendLock  = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`)
+	releaseLock = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`)
+)
+
+func showLockKey(server string, showKey string) string {
+	if server == "" {
+		return key("lock", showKey)
+	}
+
+	return key("lock", server, showKey)
+}
+
+func debounceKey(server string, accountID int, showKey string) string {
+	if server == "" {
+		return key("debounce", strconv.Itoa(accountID), showKey)
+	}
+
+	return key("debounce", server, strconv.Itoa(accountID), showKey)
+}
+
+// Lock is a show lock held by this process. It is extended every third of
+// its TTL until released, so a long copy keeps it, while the lock of a
+// process that died expires.
+type Lock struct {
+	rdb   *redis.Client
+	key   string
+	token string
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// AcquireShowLock takes the lock of the show of payload with SET NX, or
+// returns ErrLocked.
+func AcquireShowLock(ctx context.Context, rdb *redis.Client, server string, payload models.Payload, ttl time.Duration) (*Lock, error) {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	l := &Lock{
+		rdb:   rdb,
+		key:   showLockKey(server, payload.Metadata.GrandparentRatingKey),
+		token: hex.EncodeToString(b),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	ok, err := rdb.SetNX(ctx, l.key, l.token, ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrLocked
+	}
+
+	go l.extend(ttl)
+
+	return l, nil
+}
+
+func (l *Lock) extend(ttl time.Duration) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			extendLock.Run(context.Background(), l.rdb, []string{l.key}, l.token, ttl.Milliseconds())
+		}
+	}
+}
+
+// Release stops extending the lock and deletes it if still held.
+func (l *Lock) Release(ctx context.Context) error {
+	close(l.stop)
+	<-l.done
+
+	return releaseLock.Run(ctx, l.rdb, []string{l.key}, l.token).Err()
+}
+
+// Debounce tells whether the account already sent an event for the show of
+// payload within window, and starts a window when it did not.
+func Debounce(ctx context.Context, rdb *redis.Client, server string, payload models.Payload, window time.Duration) (bool, error) {
+	first, err := rdb.SetNX(ctx, debounceKey(server, payload.Account.ID, payload.Metadata.GrandparentRatingKey), "", window).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return !first, nil
+}
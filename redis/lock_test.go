@@ -0,0 +1,100 @@
+package redisH
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"plexcache/models"
+	"plexcache/redis/redistest"
+)
+
+func show(account int, showKey string) models.Payload {
+	var payload models.Payload
+	payload.Account.ID = account
+	payload.Metadata.GrandparentRatingKey = showKey
+	return payload
+}
+
+func TestShowLock(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	first, err := AcquireShowLock(t.Context(), rdb, "", show(1, "100"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := AcquireShowLock(t.Context(), rdb, "", show(2, "100"), time.Minute); !errors.Is(err, ErrLocked) {
+		t.Fatalf("got %v while locked", err)
+	}
+
+	other, err := AcquireShowLock(t.Context(), rdb, "", show(1, "300"), time.Minute)
+	if err != nil {
+		t.Fatalf("other shows should not be locked: %v", err)
+	}
+	other.Release(t.Context())
+
+	if err := first.Release(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("plex-cache:lock:100") {
+		t.Fatal("released lock still in redis")
+	}
+
+	// a lock that expired and was taken over is not released by its old holder
+	stale, err := AcquireShowLock(t.Context(), rdb, "", show(1, "100"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.FastForward(time.Minute)
+
+	current, err := AcquireShowLock(t.Context(), rdb, "", show(1, "100"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer current.Release(t.Context())
+
+	stale.Release(t.Context())
+	if !mr.Exists("plex-cache:lock:100") {
+		t.Fatal("the old holder released the new holder's lock")
+	}
+}
+
+func TestShowLockIsExtended(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	lock, err := AcquireShowLock(t.Context(), rdb, "", show(1, "100"), 30*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release(t.Context())
+
+	mr.FastForward(20 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	if ttl := mr.TTL("plex-cache:lock:100"); ttl <= 10*time.Millisecond {
+		t.Fatalf("got TTL %s, the lock was not extended", ttl)
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	for i, want := range []bool{false, true} {
+		if seen, err := Debounce(t.Context(), rdb, "", show(1, "100"), 10*time.Second); err != nil || seen != want {
+			t.Fatalf("event %d: got %v, %v", i, seen, err)
+		}
+	}
+
+	if seen, _ := Debounce(t.Context(), rdb, "", show(2, "100"), 10*time.Second); seen {
+		t.Fatal("other accounts should not be debounced")
+	}
+
+	mr.FastForward(10 * time.Second)
+	if seen, _ := Debounce(t.Context(), rdb, "", show(1, "100"), 10*time.Second); seen {
+		t.Fatal("debounced after the window")
+	}
+}
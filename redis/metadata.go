@@ -0,0 +1,78 @@
+package redisH
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"plexcache/models"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MetadataStore keeps season metadata in redis so it survives restarts and
+// is shared between instances. It satisfies plex.MetadataStore.
+type MetadataStore struct {
+	rdb    *redis.Client
+	prefix string
+}
+
+// NewMetadataStore stores the metadata of a server, server is empty for a
+// single server setup.
+func NewMetadataStore(rdb *redis.Client, server string) *MetadataStore {
+	prefix := key("metadata") + ":"
+	if server != "" {
+		prefix += server + ":"
+	}
+
+	return &MetadataStore{rdb: rdb, prefix: prefix}
+}
+
+func (m *MetadataStore) Get(ctx context.Context, key string) (models.SeasonMetadataResponse, bool) {
+	var season models.SeasonMetadataResponse
+
+	storedValue, err := m.rdb.Get(ctx, m.prefix+key).Result()
+	if err != nil {
+		if err != redis.Nil {
+			slog.ErrorContext(ctx, "could not read metadata from redis", "err", err)
+		}
+		return season, false
+	}
+
+	if err := json.Unmarshal([]byte(storedValue), &season); err != nil {
+		return season, false
+	}
+
+	return season, true
+}
+
+func (m *MetadataStore) Set(ctx context.Context, key string, season models.SeasonMetadataResponse, ttl time.Duration) {
+
+	marshaled, err := json.Marshal(season)
+	if err != nil {
+		return
+	}
+
+	if err := m.rdb.Set(ctx, m.prefix+key, marshaled, ttl).Err(); err != nil {
+		slog.ErrorContext(ctx, "could not store metadata in redis", "err", err)
+	}
+}
+
+func (m *MetadataStore) Delete(ctx context.Context, key string) {
+
+	if err := m.rdb.Del(ctx, m.prefix+key).Err(); err != nil {
+		slog.ErrorContext(ctx, "could not delete metadata from redis", "err", err)
+	}
+}
+
+func (m *MetadataStore) Clear(ctx context.Context) {
+
+	iter := m.rdb.Scan(ctx, 0, m.prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		m.rdb.Del(ctx, iter.Val())
+	}
+
+	if err := iter.Err(); err != nil {
+		slog.ErrorContext(ctx, "could not clear metadata in redis", "err", err)
+	}
+}
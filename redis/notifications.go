@@ -0,0 +1,124 @@
+package redisH
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	s "strings"
+	"time"
+
+	"plexcache/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const notifyKeyspaceEvents = "notify-keyspace-events"
+
+const (
+	ExpiryNotifications = "notifications"
+	ExpiryPolling       = "polling"
+)
+
+// publishesExpired tells whether notify-keyspace-events flags make redis
+// publish __keyevent@<db>__:expired.
+func publishesExpired(flags string) bool {
+	return s.Contains(flags, "E") && (s.Contains(flags, "x") || s.Contains(flags, "A"))
+}
+
+// CheckNotifications reads notify-keyspace-events and, when configure is
+// set, adds Ex to it when expired events are not published. The error tells
+// why expiry notifications can't be relied on, the state then says polling.
+func CheckNotifications(ctx context.Context, rdb *redis.Client, configure bool) (models.ExpiryState, error) {
+	state, err := checkNotifications(ctx, rdb, configure)
+	if err != nil {
+		state.Mode = ExpiryPolling
+		state.Error = err.Error()
+	}
+
+	return state, err
+}
+
+func checkNotifications(ctx context.Context, rdb *redis.Client, configure bool) (models.ExpiryState, error) {
+	state := models.ExpiryState{Mode: ExpiryNotifications}
+
+	values, err := rdb.ConfigGet(ctx, notifyKeyspaceEvents).Result()
+	if err != nil {
+		return state, fmt.Errorf("could not read %s, CONFIG may be disabled on this redis: %w", notifyKeyspaceEvents, err)
+	}
+
+	flags := values[notifyKeyspaceEvents]
+	state.NotifyKeyspaceEvents = flags
+
+	if publishesExpired(flags) {
+		return state, nil
+	}
+
+	if !configure {
+		return state, fmt.Errorf("%s is %q, redis does not publish expired keys, set it to Ex or set REDIS_CONFIGURE_NOTIFICATIONS=true", notifyKeyspaceEvents, flags)
+	}
+
+	for _, flag := range "Ex" {
+		if !s.ContainsRune(flags, flag) {
+			flags += string(flag)
+		}
+	}
+
+	if err := rdb.ConfigSet(ctx, notifyKeyspaceEvents, flags).Err(); err != nil {
+		return state, fmt.Errorf("could not set %s to %q: %w", notifyKeyspaceEvents, flags, err)
+	}
+
+	slog.InfoContext(ctx, "configured keyspace notifications", notifyKeyspaceEvents, flags)
+	state.NotifyKeyspaceEvents = flags
+	state.Configured = true
+
+	return state, nil
+}
+
+// expireOrphans expires the cache records whose expirer is gone.
+func expireOrphans(ctx context.Context, rdb *redis.Client, location string, dryRun bool) error {
+	var orphans []string
+
+	iter := rdb.Scan(ctx, 0, key("episode", "*"), 100).Iterator()
+	for iter.Next(ctx) {
+		dataKey := iter.Val()
+		if s.HasSuffix(dataKey, expirerSuffix) {
+			continue
+		}
+
+		n, err := rdb.Exists(ctx, dataKey+expirerSuffix).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			orphans = append(orphans, dataKey)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	for _, dataKey := range orphans {
+		expireRecord(ctx, rdb, location, dryRun, dataKey)
+	}
+
+	return nil
+}
+
+// PollExpired is the fallback of SubscribeToExpired for a redis without
+// keyspace notifications: every interval it expires the records whose
+// expirer is gone, until ctx is done.
+func PollExpired(ctx context.Context, rdb *redis.Client, location string, dryRun bool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := expireOrphans(ctx, rdb, location, dryRun); err != nil {
+				slog.ErrorContext(ctx, "could not poll for expired records", "err", err)
+			}
+		}
+	}
+}
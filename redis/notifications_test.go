@@ -0,0 +1,65 @@
+package redisH
+
+import (
+	"context"
+	"testing"
+
+	"plexcache/models"
+	"plexcache/redis/redistest"
+)
+
+func TestCheckNotifications(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	state, err := CheckNotifications(t.Context(), rdb, false)
+	if err != nil || state.Mode != ExpiryNotifications || state.NotifyKeyspaceEvents != "Ex" {
+		t.Fatalf("got %+v, %v", state, err)
+	}
+
+	mr.SetNotifyKeyspaceEvents("g")
+	if state, err := CheckNotifications(t.Context(), rdb, false); err == nil || state.Mode != ExpiryPolling {
+		t.Fatalf("expected polling without notifications, got %+v", state)
+	}
+
+	state, err = CheckNotifications(t.Context(), rdb, true)
+	if err != nil || !state.Configured || state.NotifyKeyspaceEvents != "gEx" {
+		t.Fatalf("got %+v, %v", state, err)
+	}
+
+	mr.DisableConfig()
+	if state, err := CheckNotifications(t.Context(), rdb, true); err == nil || state.Mode != ExpiryPolling {
+		t.Fatalf("expected polling when CONFIG is disabled, got %+v", state)
+	}
+}
+
+func TestPollingExpiresRecords(t *testing.T) {
+	mr := redistest.NewServer(t)
+	mr.SetNotifyKeyspaceEvents("")
+	rdb := mr.Client(t)
+
+	if _, err := SaveEpisodeCacheToRedis(t.Context(), rdb, []models.EpisodeCache{{RatingKey: "203", Size: 10}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := expireOrphans(context.Background(), rdb, t.TempDir(), true); err != nil {
+		t.Fatal(err)
+	}
+	if !mr.Exists("plex-cache:episode:203") {
+		t.Fatal("record removed before it expired")
+	}
+
+	mr.FastForward(CacheTTL)
+
+	if err := expireOrphans(context.Background(), rdb, t.TempDir(), true); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("plex-cache:episode:203") {
+		t.Fatal("expired record was not removed")
+	}
+
+	usage, _ := GetUsage(t.Context(), rdb)
+	if usage.Episodes != 0 || usage.Wasted != 1 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+}
@@ -0,0 +1,123 @@
+// Package redistest runs an in-process redis stand-in for tests.
+package redistest
+
+import (
+	"fmt"
+	s "strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/redis/go-redis/v9"
+)
+
+// Server is miniredis with the expired keyevent notifications redis sends
+// when configured with `notify-keyspace-events Ex`. Keys only expire when
+// time is moved with FastForward. CONFIG GET and CONFIG SET are answered
+// for notify-keyspace-events, which starts as "Ex".
+type Server struct {
+	*miniredis.Miniredis
+
+	mu             sync.Mutex
+	notify         string
+	configDisabled bool
+}
+
+func NewServer(t testing.TB) *Server {
+	srv := &Server{Miniredis: miniredis.RunT(t), notify: "Ex"}
+	if err := srv.Server().Register("CONFIG", srv.config); err != nil {
+		t.Fatal(err)
+	}
+
+	return srv
+}
+
+// SetNotifyKeyspaceEvents changes notify-keyspace-events, FastForward only
+// publishes expired events when it has E and x or A.
+func (srv *Server) SetNotifyKeyspaceEvents(flags string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.notify = flags
+}
+
+// DisableConfig makes CONFIG fail like it does on managed redis services
+// that rename or block it.
+func (srv *Server) DisableConfig() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.configDisabled = true
+}
+
+func (srv *Server) config(c *server.Peer, cmd string, args []string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.configDisabled {
+		c.WriteError("ERR unknown command 'CONFIG'")
+		return
+	}
+
+	switch {
+	case len(args) == 2 && s.EqualFold(args[0], "GET") && args[1] == "notify-keyspace-events":
+		if c.Resp3 {
+			c.WriteMapLen(1)
+		} else {
+			c.WriteLen(2)
+		}
+		c.WriteBulk(args[1])
+		c.WriteBulk(srv.notify)
+	case len(args) == 2 && s.EqualFold(args[0], "GET"):
+		if c.Resp3 {
+			c.WriteMapLen(0)
+		} else {
+			c.WriteLen(0)
+		}
+	case len(args) == 3 && s.EqualFold(args[0], "SET") && args[1] == "notify-keyspace-events":
+		srv.notify = args[2]
+		c.WriteOK()
+	default:
+		c.WriteError("ERR unsupported CONFIG call")
+	}
+}
+
+func (srv *Server) publishesExpired() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return s.Contains(srv.notify, "E") && (s.Contains(srv.notify, "x") || s.Contains(srv.notify, "A"))
+}
+
+// Client returns a client for DB 0, closed when the test ends.
+func (srv *Server) Client(t testing.TB) *redis.Client {
+	rdb := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	return rdb
+}
+
+// FastForward moves time forward and publishes __keyevent@<db>__:expired
+// for every key that expired.
+func (srv *Server) FastForward(d time.Duration) {
+	expired := map[int][]string{}
+
+	for db := 0; db < 16; db++ {
+		for _, key := range srv.DB(db).Keys() {
+			if ttl := srv.DB(db).TTL(key); ttl > 0 && ttl <= d {
+				expired[db] = append(expired[db], key)
+			}
+		}
+	}
+
+	srv.Miniredis.FastForward(d)
+
+	if !srv.publishesExpired() {
+		return
+	}
+
+	for db, keys := range expired {
+		for _, key := range keys {
+			srv.Publish(fmt.Sprintf("__keyevent@%d__:expired", db), key)
+		}
+	}
+}
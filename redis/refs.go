@@ -0,0 +1,108 @@
+package redisH
+
+import (
+	"context"
+	"slices"
+
+	"plexcache/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sharedFiles is set when several servers are configured, whose records can
+// cache the same files.
+var sharedFiles bool
+
+// SetSharedFiles tells whether records of several servers can share cached
+// files, it is called once on startup. With a single server the references
+// are still kept, but never read.
+func SetSharedFiles(shared bool) {
+	sharedFiles = shared
+}
+
+// refsKey is the set of the keys of the records caching path. Servers
+// reading the same media cache the same files, each under a record of its
+// own, and a file stays in the cache until its last record is gone.
+func refsKey(path string) string {
+	return key("refs", path)
+}
+
+// recordPaths are the cache paths of the files and sidecars of a record.
+func recordPaths(episode models.EpisodeCache) []string {
+	var paths []string
+	for _, file := range episode.Files() {
+		paths = append(paths, file.Path)
+	}
+
+	return append(paths, episode.Sidecars()...)
+}
+
+// sharedPaths watches the references of paths in a WATCH transaction and
+// returns the ones cached by other records than the given ones.
+func sharedPaths(ctx context.Context, tx *redis.Tx, paths []string, except ...string) (map[string]bool, error) {
+	shared := make(map[string]bool)
+	if !sharedFiles || len(paths) == 0 {
+		return shared, nil
+	}
+
+	paths = slices.Compact(slices.Sorted(slices.Values(paths)))
+
+	refs := make([]string, len(paths))
+	for i, path := range paths {
+		refs[i] = refsKey(path)
+	}
+	if err := tx.Watch(ctx, refs...).Err(); err != nil {
+		return nil, err
+	}
+
+	pipe := tx.Pipeline()
+	members := make([]*redis.StringSliceCmd, len(refs))
+	for i, ref := range refs {
+		members[i] = pipe.SMembers(ctx, ref)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	for i, path := range paths {
+		for _, dataKey := range members[i].Val() {
+			if !slices.Contains(except, dataKey) {
+				shared[path] = true
+				break
+			}
+		}
+	}
+
+	return shared, nil
+}
+
+// updateRefs moves the references of a record from the paths it cached to
+// the ones it caches now, in the transaction of its update.
+func updateRefs(ctx context.Context, pipe redis.Pipeliner, dataKey string, before, after []string) {
+	for _, path := range before {
+		if !slices.Contains(after, path) {
+			pipe.SRem(ctx, refsKey(path), dataKey)
+		}
+	}
+
+	for _, path := range after {
+		pipe.SAdd(ctx, refsKey(path), dataKey)
+	}
+}
+
+// ownedSize is the size of the files of a record no other record shares,
+// what it adds to the cache and what removing it frees.
+func ownedSize(episode models.EpisodeCache, shared map[string]bool) int64 {
+	var size int64
+	for _, file := range episode.Files() {
+		if !shared[file.Path] {
+			size += file.Size
+		}
+	}
+
+	if !slices.ContainsFunc(episode.Sidecars(), func(path string) bool { return shared[path] }) {
+		size += episode.SidecarSize
+	}
+
+	return size
+}
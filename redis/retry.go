@@ -0,0 +1,93 @@
+package redisH
+
+import (
+	"context"
+	"encoding/json"
+	"plexcache/models"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const deadLimit = 500
+
+func retryKey() string {
+	return key("retry")
+}
+
+func retryDeadKey() string {
+	return key("retry", "dead")
+}
+
+// EnqueueRetry schedules a webhook to be processed again at due.
+func EnqueueRetry(ctx context.Context, rdb *redis.Client, item models.RetryItem, due time.Time) error {
+
+	marshaled, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	return rdb.ZAdd(ctx, retryKey(), redis.Z{Score: float64(due.Unix()), Member: marshaled}).Err()
+}
+
+// ClaimDueRetries removes and returns up to limit queued webhooks that are
+// due. An item is only returned to the caller that removed it.
+func ClaimDueRetries(ctx context.Context, rdb *redis.Client, now time.Time, limit int64) ([]models.RetryItem, error) {
+
+	members, err := rdb.ZRangeByScore(ctx, retryKey(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.Unix(), 10),
+		Count: limit,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var items []models.RetryItem
+	for _, member := range members {
+		removed, err := rdb.ZRem(ctx, retryKey(), member).Result()
+		if err != nil {
+			return items, err
+		}
+		if removed == 0 {
+			continue
+		}
+
+		var item models.RetryItem
+		if err := json.Unmarshal([]byte(member), &item); err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// DeadLetter keeps a webhook that ran out of retries for inspection.
+func DeadLetter(ctx context.Context, rdb *redis.Client, item models.RetryItem) error {
+
+	marshaled, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	pipe := rdb.Pipeline()
+	pipe.LPush(ctx, retryDeadKey(), marshaled)
+	pipe.LTrim(ctx, retryDeadKey(), 0, deadLimit-1)
+	_, err = pipe.Exec(ctx)
+
+	return err
+}
+
+func RetryQueueLength(ctx context.Context, rdb *redis.Client) (queued int64, dead int64, err error) {
+
+	pipe := rdb.Pipeline()
+	q := pipe.ZCard(ctx, retryKey())
+	d := pipe.LLen(ctx, retryDeadKey())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, 0, err
+	}
+
+	return q.Val(), d.Val(), nil
+}
@@ -0,0 +1,411 @@
+package redisH
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"plexcache/models"
+	"slices"
+	"strconv"
+	s "strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	hitsRetention = 8 * 24 * time.Hour
+	wastedLimit   = 500
+)
+
+// GetCachedEpisode returns the cache record stored for a rating key of a
+// server.
+func GetCachedEpisode(ctx context.Context, rdb *redis.Client, server string, ratingKey string) (models.EpisodeCache, bool, error) {
+	var episodeCache models.EpisodeCache
+
+	storedValue, err := rdb.Get(ctx, recordKey(server, ratingKey)).Result()
+	if err == redis.Nil {
+		return episodeCache, false, nil
+	} else if err != nil {
+		return episodeCache, false, err
+	}
+
+	if err := json.Unmarshal([]byte(storedValue), &episodeCache); err != nil {
+		return episodeCache, false, err
+	}
+
+	return episodeCache, true, nil
+}
+
+// watchRetries bounds the attempts of an optimistic transaction on records
+// written concurrently.
+const watchRetries = 10
+
+// watchKeys runs fn in a WATCH transaction on keys, again when one of them
+// changed before it committed.
+func watchKeys(ctx context.Context, rdb *redis.Client, fn func(tx *redis.Tx) error, keys ...string) error {
+	for range watchRetries {
+		err := rdb.Watch(ctx, fn, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+
+	return redis.TxFailedErr
+}
+
+// storedRecord reads a record inside a WATCH transaction.
+func storedRecord(ctx context.Context, tx *redis.Tx, key string) (models.EpisodeCache, bool, error) {
+	var episodeCache models.EpisodeCache
+
+	storedValue, err := tx.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return episodeCache, false, nil
+	} else if err != nil {
+		return episodeCache, false, err
+	}
+
+	return episodeCache, json.Unmarshal([]byte(storedValue), &episodeCache) == nil, nil
+}
+
+// ErrRecordChanged is returned when a record to update expired, was
+// dropped or planned with other files since it was read.
+var ErrRecordChanged = errors.New("cache record is gone or caches other files")
+
+// UpdateCachedEpisode writes the sources, sizes and hashes of the files of
+// a record read earlier back, leaving the rest of the stored record and its
+// expirer alone.
+func UpdateCachedEpisode(ctx context.Context, rdb *redis.Client, episodeCache models.EpisodeCache) error {
+	_, err := updateRecord(ctx, rdb, episodeCache)
+	return err
+}
+
+// UpdateCopiedEpisode flags the record of an episode as copied once its
+// files were, see UpdateCachedEpisode, and counts a change in size towards
+// usage.
+func UpdateCopiedEpisode(ctx context.Context, rdb *redis.Client, episodeCache models.EpisodeCache) error {
+	episodeCache.Copied = true
+
+	delta, err := updateRecord(ctx, rdb, episodeCache)
+	if err != nil || delta == 0 {
+		return err
+	}
+
+	return addUsage(ctx, rdb, delta, 0)
+}
+
+// updateRecord is UpdateCachedEpisode, returning how many bytes the update
+// adds to the cache. A missing record is not created again, as it would
+// lack its expirer.
+func updateRecord(ctx context.Context, rdb *redis.Client, episodeCache models.EpisodeCache) (int64, error) {
+	dataKey := recordKey(episodeCache.Server, episodeCache.RatingKey)
+
+	var delta int64
+	err := watchKeys(ctx, rdb, func(tx *redis.Tx) error {
+		stored, found, err := storedRecord(ctx, tx, dataKey)
+		if err != nil {
+			return err
+		}
+		if !found || !samePaths(stored.Files(), episodeCache.Files()) || !slices.Equal(stored.Sidecars(), episodeCache.Sidecars()) {
+			return ErrRecordChanged
+		}
+
+		update := stored
+		update.Version = SchemaVersion
+		update.SetFiles(episodeCache.Files())
+		update.Sources = episodeCache.Sources
+		update.SidecarSize = episodeCache.SidecarSize
+		update.Copied = stored.Copied || episodeCache.Copied
+		marshaled, err := json.Marshal(update)
+		if err != nil {
+			return err
+		}
+
+		shared, err := sharedPaths(ctx, tx, recordPaths(update), dataKey)
+		if err != nil {
+			return err
+		}
+		delta = ownedSize(update, shared) - ownedSize(stored, shared)
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, dataKey, marshaled, redis.KeepTTL)
+			return nil
+		})
+		return err
+	}, dataKey)
+
+	return delta, err
+}
+
+// MarkPlayed flags a cache record as played, so its eviction is not counted
+// as wasted. It does nothing when the episode is not cached.
+func MarkPlayed(ctx context.Context, rdb *redis.Client, server string, ratingKey string) error {
+	dataKey := recordKey(server, ratingKey)
+
+	return watchKeys(ctx, rdb, func(tx *redis.Tx) error {
+		stored, found, err := storedRecord(ctx, tx, dataKey)
+		if err != nil || !found || stored.Played {
+			return err
+		}
+
+		stored.Played = true
+		marshaled, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, dataKey, marshaled, redis.KeepTTL)
+			return nil
+		})
+		return err
+	}, dataKey)
+}
+
+// ListCachedEpisodes returns the cache records of all servers.
+func ListCachedEpisodes(ctx context.Context, rdb *redis.Client) ([]models.EpisodeCache, error) {
+	var keys []string
+	err := scanKeys(ctx, rdb, key("episode", "*"), func(k string) error {
+		if !s.HasSuffix(k, expirerSuffix) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	values, err := rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	episodes := make([]models.EpisodeCache, 0, len(values))
+	for _, value := range values {
+		stored, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var episode models.EpisodeCache
+		if err := json.Unmarshal([]byte(stored), &episode); err != nil {
+			continue
+		}
+		episodes = append(episodes, episode)
+	}
+
+	return episodes, nil
+}
+
+func hitsBucket(t time.Time) string {
+	return key("hits", t.UTC().Format("2006010215"))
+}
+
+// RecordPlayResult counts a play as a cache hit or miss in the current hour,
+// overall and per show, user and library.
+func RecordPlayResult(ctx context.Context, rdb *redis.Client, payload models.Payload, hit bool) error {
+	key := hitsBucket(time.Now())
+
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+
+	pipe := rdb.Pipeline()
+	pipe.HIncrBy(ctx, key, "all|"+result, 1)
+	pipe.HIncrBy(ctx, key, "show|"+payload.Metadata.GrandparentTitle+"|"+result, 1)
+	pipe.HIncrBy(ctx, key, "user|"+payload.Account.Title+"|"+result, 1)
+	pipe.HIncrBy(ctx, key, "library|"+payload.Metadata.LibrarySectionTitle+"|"+result, 1)
+	pipe.Expire(ctx, key, hitsRetention)
+	_, err := pipe.Exec(ctx)
+
+	return err
+}
+
+func addHit(counts map[string]models.HitCounts, name string, result string, n int64) {
+	c := counts[name]
+	if result == "hit" {
+		c.Hits += n
+	} else {
+		c.Misses += n
+	}
+	counts[name] = c
+}
+
+func withRates(counts map[string]models.HitCounts) {
+	for name, c := range counts {
+		counts[name] = rate(c)
+	}
+}
+
+func rate(c models.HitCounts) models.HitCounts {
+	if total := c.Hits + c.Misses; total > 0 {
+		c.Rate = float64(c.Hits) / float64(total)
+	}
+	return c
+}
+
+// GetHitRate sums the hourly hit counters of the last hours hours.
+func GetHitRate(ctx context.Context, rdb *redis.Client, hours int) (models.HitRate, error) {
+	hitRate := models.HitRate{
+		Hours:     hours,
+		Shows:     map[string]models.HitCounts{},
+		Users:     map[string]models.HitCounts{},
+		Libraries: map[string]models.HitCounts{},
+	}
+
+	now := time.Now()
+	pipe := rdb.Pipeline()
+	buckets := make([]*redis.MapStringStringCmd, 0, hours)
+	for i := 0; i < hours; i++ {
+		buckets = append(buckets, pipe.HGetAll(ctx, hitsBucket(now.Add(-time.Duration(i)*time.Hour))))
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return hitRate, err
+	}
+
+	all := map[string]models.HitCounts{}
+	for _, bucket := range buckets {
+		for field, value := range bucket.Val() {
+			n, _ := strconv.ParseInt(value, 10, 64)
+			parts := s.Split(field, "|")
+			if len(parts) < 2 {
+				continue
+			}
+
+			result := parts[len(parts)-1]
+			name := s.Join(parts[1:len(parts)-1], "|")
+
+			switch parts[0] {
+			case "all":
+				addHit(all, "all", result, n)
+			case "show":
+				addHit(hitRate.Shows, name, result, n)
+			case "user":
+				addHit(hitRate.Users, name, result, n)
+			case "library":
+				addHit(hitRate.Libraries, name, result, n)
+			}
+		}
+	}
+
+	hitRate.All = rate(all["all"])
+	withRates(hitRate.Shows)
+	withRates(hitRate.Users)
+	withRates(hitRate.Libraries)
+
+	return hitRate, nil
+}
+
+func wastedKey() string {
+	return key("wasted")
+}
+
+func recordWasted(ctx context.Context, rdb *redis.Client, episodeCache models.EpisodeCache) error {
+	marshaled, err := json.Marshal(models.WastedCopy{
+		Server:    episodeCache.Server,
+		RatingKey: episodeCache.RatingKey,
+		Show:      episodeCache.GrandparentTitle,
+		Title:     episodeCache.Title,
+		Size:      episodeCache.TotalSize(),
+		EvictedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	pipe := rdb.Pipeline()
+	pipe.LPush(ctx, wastedKey(), marshaled)
+	pipe.LTrim(ctx, wastedKey(), 0, wastedLimit-1)
+	pipe.HIncrBy(ctx, usageKey(), "wasted", 1)
+	pipe.HIncrBy(ctx, usageKey(), "wastedBytes", episodeCache.TotalSize())
+	_, err = pipe.Exec(ctx)
+
+	return err
+}
+
+// GetWasted returns the most recent copies that expired without being played.
+func GetWasted(ctx context.Context, rdb *redis.Client, limit int64) ([]models.WastedCopy, error) {
+
+	values, err := rdb.LRange(ctx, wastedKey(), 0, limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	wasted := make([]models.WastedCopy, 0, len(values))
+	for _, value := range values {
+		var w models.WastedCopy
+		if err := json.Unmarshal([]byte(value), &w); err != nil {
+			continue
+		}
+		wasted = append(wasted, w)
+	}
+
+	return wasted, nil
+}
+
+// ForgetCachedEpisodes removes the records and expirers of episodes that
+// were recorded but never copied, or whose copies were dropped, without
+// treating them as expired. It returns the paths of their files no other
+// record shares, which can be removed from the cache.
+func ForgetCachedEpisodes(ctx context.Context, rdb *redis.Client, episodes []models.EpisodeCache) ([]string, error) {
+	if len(episodes) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(episodes))
+	for i, item := range episodes {
+		keys[i] = recordKey(item.Server, item.RatingKey)
+	}
+
+	var paths []string
+	var bytes, count int64
+	err := watchKeys(ctx, rdb, func(tx *redis.Tx) error {
+		paths, bytes, count = nil, 0, 0
+
+		stored := make([]models.EpisodeCache, len(episodes))
+		found := make([]bool, len(episodes))
+		var all []string
+		for i, item := range episodes {
+			var err error
+			stored[i], found[i], err = storedRecord(ctx, tx, keys[i])
+			if err != nil {
+				return err
+			}
+			all = append(all, recordPaths(item)...)
+			all = append(all, recordPaths(stored[i])...)
+		}
+
+		shared, err := sharedPaths(ctx, tx, all, keys...)
+		if err != nil {
+			return err
+		}
+
+		for i, item := range episodes {
+			for _, path := range recordPaths(item) {
+				if !shared[path] {
+					paths = append(paths, path)
+				}
+			}
+			if found[i] {
+				bytes += ownedSize(stored[i], shared)
+				count++
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, item := range episodes {
+				pipe.Del(ctx, keys[i]+expirerSuffix, keys[i])
+				updateRefs(ctx, pipe, keys[i], append(recordPaths(item), recordPaths(stored[i])...), nil)
+			}
+			return nil
+		})
+		return err
+	}, keys...)
+	if err != nil || count == 0 {
+		return paths, err
+	}
+
+	return paths, addUsage(ctx, rdb, -bytes, -count)
+}
@@ -0,0 +1,158 @@
+package redisH
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"plexcache/models"
+	"plexcache/redis/redistest"
+)
+
+func TestPlayedSurvivesRewrites(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	planned := models.EpisodeCache{RatingKey: "203", EpisodeFilePath: "/media/tvshows/a.mkv", Size: 1203}
+	if _, err := SaveEpisodeCacheToRedis(t.Context(), rdb, []models.EpisodeCache{planned}); err != nil {
+		t.Fatal(err)
+	}
+
+	// played while the copy runs
+	if err := MarkPlayed(t.Context(), rdb, "", "203"); err != nil {
+		t.Fatal(err)
+	}
+
+	copied := planned
+	copied.Copied, copied.Hash = true, "abc"
+	if err := UpdateCopiedEpisode(t.Context(), rdb, copied); err != nil {
+		t.Fatal(err)
+	}
+
+	episode, _, _ := GetCachedEpisode(t.Context(), rdb, "", "203")
+	if !episode.Played || !episode.Copied || episode.Hash != "abc" {
+		t.Fatalf("marking copied lost the play: %+v", episode)
+	}
+
+	// planned again by a later webhook
+	if _, err := SaveEpisodeCacheToRedis(t.Context(), rdb, []models.EpisodeCache{planned}); err != nil {
+		t.Fatal(err)
+	}
+
+	episode, _, _ = GetCachedEpisode(t.Context(), rdb, "", "203")
+	if !episode.Played || !episode.Copied || episode.Hash != "abc" {
+		t.Fatalf("planning again reset the record: %+v", episode)
+	}
+
+	usage, _ := GetUsage(t.Context(), rdb)
+	if usage.Bytes != 1203 || usage.Episodes != 1 {
+		t.Fatalf("got usage %+v", usage)
+	}
+}
+
+func TestPlanningOtherFilesResetsCopied(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	copied := models.EpisodeCache{RatingKey: "203", EpisodeFilePath: "/media/tvshows/a.mkv", Size: 1203, Copied: true}
+	if _, err := SaveEpisodeCacheToRedis(t.Context(), rdb, []models.EpisodeCache{copied}); err != nil {
+		t.Fatal(err)
+	}
+
+	// another version
+	planned := models.EpisodeCache{RatingKey: "203", EpisodeFilePath: "/media/tvshows/a 4K.mkv", Size: 4000}
+	if _, err := SaveEpisodeCacheToRedis(t.Context(), rdb, []models.EpisodeCache{planned}); err != nil {
+		t.Fatal(err)
+	}
+
+	episode, _, _ := GetCachedEpisode(t.Context(), rdb, "", "203")
+	if episode.Copied || episode.Size != 4000 {
+		t.Fatalf("got %+v", episode)
+	}
+
+	usage, _ := GetUsage(t.Context(), rdb)
+	if usage.Bytes != 4000 || usage.Episodes != 1 {
+		t.Fatalf("got usage %+v", usage)
+	}
+}
+
+func TestMarkPlayedWithoutRecord(t *testing.T) {
+	mr := redistest.NewServer(t)
+
+	if err := MarkPlayed(t.Context(), mr.Client(t), "", "203"); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("plex-cache:episode:203") {
+		t.Fatal("marking an uncached episode played created a record")
+	}
+}
+
+func TestForgettingKeepsReferencesOfOtherServers(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	SetSharedFiles(true)
+	t.Cleanup(func() { SetSharedFiles(false) })
+
+	first := models.EpisodeCache{Server: "first", RatingKey: "204", EpisodeFilePath: "/S02E04.mkv", Size: 10}
+	second := first
+	second.Server = "second"
+	second.SrtFilePaths = []string{"/S02E04.srt"}
+
+	for _, episode := range []models.EpisodeCache{first, second} {
+		if _, err := SaveEpisodeCacheToRedis(t.Context(), rdb, []models.EpisodeCache{episode}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if members, _ := mr.Members("plex-cache:refs:/S02E04.mkv"); len(members) != 2 {
+		t.Fatalf("got references %v", members)
+	}
+
+	paths, err := ForgetCachedEpisodes(t.Context(), rdb, []models.EpisodeCache{second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(paths, []string{"/S02E04.srt"}) {
+		t.Fatalf("got %v, want only the subtitle of the second server", paths)
+	}
+	if mr.Exists("plex-cache:refs:/S02E04.srt") {
+		t.Fatal("the references of a forgotten file are kept")
+	}
+	if members, _ := mr.Members("plex-cache:refs:/S02E04.mkv"); !slices.Equal(members, []string{"plex-cache:episode:first:204"}) {
+		t.Fatalf("got references %v", members)
+	}
+	if usage, _ := GetUsage(t.Context(), rdb); usage.Bytes != 10 || usage.Episodes != 1 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+}
+
+func TestUpdateLeavesChangedRecordsAlone(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	read := models.EpisodeCache{RatingKey: "203", EpisodeFilePath: "/media/tvshows/a.mkv", Size: 1203, Copied: true}
+	touched := read
+	touched.Sources = []models.SourceStat{{Path: read.EpisodeFilePath, Size: 1203, ModTime: 2}}
+
+	// expired since it was read
+	if err := UpdateCachedEpisode(t.Context(), rdb, touched); !errors.Is(err, ErrRecordChanged) {
+		t.Fatalf("got %v, want ErrRecordChanged", err)
+	}
+	if mr.Exists("plex-cache:episode:203") {
+		t.Fatal("an expired record was created again")
+	}
+
+	// planned with another version since it was read
+	planned := models.EpisodeCache{RatingKey: "203", EpisodeFilePath: "/media/tvshows/a 4K.mkv", Size: 4000}
+	if _, err := SaveEpisodeCacheToRedis(t.Context(), rdb, []models.EpisodeCache{planned}); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateCachedEpisode(t.Context(), rdb, touched); !errors.Is(err, ErrRecordChanged) {
+		t.Fatalf("got %v, want ErrRecordChanged", err)
+	}
+
+	episode, _, _ := GetCachedEpisode(t.Context(), rdb, "", "203")
+	if episode.EpisodeFilePath != planned.EpisodeFilePath || episode.Copied || len(episode.Sources) != 0 {
+		t.Fatalf("the new plan was overwritten: %+v", episode)
+	}
+}
@@ -3,97 +3,272 @@ package redisH
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
+	"log/slog"
+	"plexcache/logging"
 	"plexcache/models"
+	"plexcache/tracing"
 	"plexcache/utils"
 	s "strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func SubscribeToExpired(rdb *redis.Client) *redis.PubSub {
-	ctx := context.Background()
-	plexExpirerKey := ":plex-expirer"
-	location := "/cache"
+// CacheTTL is how long cached episodes are kept.
+const CacheTTL = 20 * 24 * time.Hour
 
-	subscriber := rdb.PSubscribe(ctx, "__keyevent@0__:expired")
+// Subscriber is the subscription to expired keyevents started by
+// SubscribeToExpired.
+type Subscriber struct {
+	pubsub     *redis.PubSub
+	subscribed atomic.Bool
+	done       chan struct{}
+}
+
+// Close unsubscribes and waits for the record being expired, if any.
+func (sub *Subscriber) Close() error {
+	err := sub.pubsub.Close()
+	<-sub.done
+	return err
+}
+
+// Alive tells whether the subscription is established and its connection
+// answers a ping.
+func (sub *Subscriber) Alive(ctx context.Context) error {
+	if !sub.subscribed.Load() {
+		return errors.New("not subscribed to expired events")
+	}
+
+	return sub.pubsub.Ping(ctx)
+}
+
+// SubscribeToExpired removes cached files when their expirer key expires. In
+// dry-run mode only the redis records are removed.
+func SubscribeToExpired(ctx context.Context, rdb *redis.Client, location string, dryRun bool) *Subscriber {
+
+	sub := &Subscriber{pubsub: rdb.PSubscribe(ctx, expiredChannel(rdb)), done: make(chan struct{})}
 	go func() {
-		defer subscriber.Close()
+		defer close(sub.done)
+		defer sub.subscribed.Store(false)
 
-		for msg := range subscriber.Channel() {
+		for msg := range sub.pubsub.ChannelWithSubscriptions() {
+			switch msg := msg.(type) {
+			case *redis.Subscription:
+				sub.subscribed.Store(msg.Kind == "psubscribe")
 
-			if !s.HasSuffix(msg.Payload, plexExpirerKey) {
-				continue
+			case *redis.Message:
+				if !s.HasPrefix(msg.Payload, key("episode")+":") || !s.HasSuffix(msg.Payload, expirerSuffix) {
+					continue
+				}
+
+				expireRecord(ctx, rdb, location, dryRun, s.TrimSuffix(msg.Payload, expirerSuffix))
 			}
+		}
+	}()
 
-			dataKey := s.Split(msg.Payload, plexExpirerKey)[0]
-			log.Println("Time to remove", dataKey)
-			storedValue, err := rdb.Get(ctx, dataKey).Result()
+	return sub
+}
 
-			if err == redis.Nil {
-				log.Println("redis.Nil", err)
-				continue
-			} else if err != nil {
-				log.Println("Error retriving key to delete from redis", err)
+// expireRecord removes the record and the cached files no other record
+// shares.
+func expireRecord(ctx context.Context, rdb *redis.Client, location string, dryRun bool, dataKey string) {
+	ctx = logging.With(ctx, "key", dataKey)
+	slog.DebugContext(ctx, "record expired")
+
+	var episodeCache models.EpisodeCache
+	var found bool
+	var shared map[string]bool
+	err := watchKeys(ctx, rdb, func(tx *redis.Tx) error {
+		var err error
+		episodeCache, found, err = storedRecord(ctx, tx, dataKey)
+		if err != nil || !found {
+			return err
+		}
+
+		shared, err = sharedPaths(ctx, tx, recordPaths(episodeCache), dataKey)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, dataKey)
+			updateRefs(ctx, pipe, dataKey, recordPaths(episodeCache), nil)
+			return nil
+		})
+		return err
+	}, dataKey)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to remove the record", "err", err)
+		return
+	} else if !found {
+		slog.DebugContext(ctx, "record already gone")
+		return
+	}
+
+	if dryRun {
+		for _, file := range episodeCache.Files() {
+			if !shared[file.Path] {
+				slog.InfoContext(ctx, "dry-run: would remove", "file", location+file.Path)
+			}
+		}
+		for _, sidecar := range episodeCache.Sidecars() {
+			if !shared[sidecar] {
+				slog.InfoContext(ctx, "dry-run: would remove sidecar", "file", location+sidecar)
+			}
+		}
+	} else {
+		for _, file := range episodeCache.Files() {
+			if shared[file.Path] {
+				slog.InfoContext(ctx, "kept, still cached for another server", "file", file.Path)
 				continue
 			}
 
-			var episodeCache models.EpisodeCache
-			if err := json.Unmarshal([]byte(storedValue), &episodeCache); err != nil {
+			if err := utils.RemoveFile(location + file.Path); err != nil {
+				slog.ErrorContext(ctx, "failed to remove file", "file", file.Path, "err", err)
 				continue
 			}
+			slog.InfoContext(ctx, "removed", "file", file.Path)
+		}
 
-			err = utils.RemoveFile(location + episodeCache.EpisodeFilePath)
-			log.Println("Removed", episodeCache.EpisodeFilePath)
+		for _, sidecar := range episodeCache.Sidecars() {
+			if shared[sidecar] {
+				continue
+			}
 
-			if err != nil {
-				log.Println("failed to remove file", err)
+			if err := utils.RemoveFile(location + sidecar); err != nil {
+				slog.ErrorContext(ctx, "failed to remove sidecar", "file", sidecar, "err", err)
 				continue
 			}
+			slog.InfoContext(ctx, "removed sidecar", "file", sidecar)
+		}
+	}
+
+	if err := addUsage(ctx, rdb, -ownedSize(episodeCache, shared), -1); err != nil {
+		slog.ErrorContext(ctx, "failed to update usage", "err", err)
+	}
 
-			for _, srtPath := range episodeCache.SrtFilePaths {
-				err = utils.RemoveFile(location + srtPath)
-				log.Println("Removed srt", srtPath)
+	if !episodeCache.Played {
+		slog.InfoContext(ctx, "expired without being played", "show", episodeCache.GrandparentTitle, "episode", episodeCache.Title)
+		if err := recordWasted(ctx, rdb, episodeCache); err != nil {
+			slog.ErrorContext(ctx, "failed to record wasted copy", "err", err)
+		}
+	}
+}
 
-				if err != nil {
-					log.Println("failed to remove srt", err)
-					continue
-				}
-			}
+// SaveEpisodeCacheToRedis records the planned episodes with a fresh expirer
+// and returns the records as saved, merged with the stored ones, so an
+// episode already copied with the same files stays Copied.
+func SaveEpisodeCacheToRedis(ctx context.Context, rdb *redis.Client, episodesToCache []models.EpisodeCache) (saved []models.EpisodeCache, err error) {
+	ctx, span := tracing.Start(ctx, "SaveEpisodeCacheToRedis", attribute.Int("episodes", len(episodesToCache)))
+	defer func() { tracing.End(span, err) }()
+
+	if len(episodesToCache) == 0 {
+		return nil, nil
+	}
 
-			err = rdb.Del(ctx, dataKey).Err()
+	keys := make([]string, len(episodesToCache))
+	for i, item := range episodesToCache {
+		keys[i] = recordKey(item.Server, item.RatingKey)
+	}
+
+	var addedBytes, addedEpisodes int64
+	err = watchKeys(ctx, rdb, func(tx *redis.Tx) error {
+		addedBytes, addedEpisodes = 0, 0
 
+		stored := make([]models.EpisodeCache, len(episodesToCache))
+		found := make([]bool, len(episodesToCache))
+		records := make([]models.EpisodeCache, len(episodesToCache))
+		var paths []string
+		for i, item := range episodesToCache {
+			var err error
+			stored[i], found[i], err = storedRecord(ctx, tx, keys[i])
 			if err != nil {
-				log.Println("failed to remove dataKey from redis", err)
-				continue
+				return err
 			}
 
+			if found[i] {
+				item = mergeRecord(stored[i], item)
+			}
+			records[i] = item
+			paths = append(paths, recordPaths(stored[i])...)
+			paths = append(paths, recordPaths(item)...)
 		}
-	}()
 
-	return subscriber
-}
+		saved = records
 
-func SaveEpisodeCacheToRedis(rdb *redis.Client, episodesToCache []models.EpisodeCache) error {
-	ctx := context.Background()
-	pipe := rdb.Pipeline()
-	ttl := 20 * 24 * time.Hour
-	for _, item := range episodesToCache {
-		marshaled, err := json.Marshal(item)
+		shared, err := sharedPaths(ctx, tx, paths, keys...)
 		if err != nil {
-			fmt.Println("could not marshal episode")
+			return err
 		}
 
-		pipe.Set(ctx, item.RatingKey, marshaled, -1)
-		pipe.Set(ctx, fmt.Sprintf("%s%s", item.RatingKey, ":plex-expirer"), "", ttl)
-	}
-	_, err := pipe.Exec(ctx)
+		for i, item := range records {
+			if found[i] {
+				addedBytes += ownedSize(item, shared) - ownedSize(stored[i], shared)
+			} else {
+				addedBytes += ownedSize(item, shared)
+				addedEpisodes++
+			}
+		}
 
-	if err != nil {
+		// a transaction, so PollExpired never sees a record without its
+		// expirer
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, item := range records {
+				item.Version = SchemaVersion
+				marshaled, err := json.Marshal(item)
+				if err != nil {
+					return err
+				}
+
+				pipe.Set(ctx, keys[i], marshaled, -1)
+				pipe.Set(ctx, keys[i]+expirerSuffix, "", CacheTTL)
+				updateRefs(ctx, pipe, keys[i], recordPaths(stored[i]), recordPaths(item))
+			}
+			return nil
+		})
 		return err
+	}, keys...)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int64("addedBytes", addedBytes), attribute.Int64("addedEpisodes", addedEpisodes))
+
+	if addedEpisodes > 0 || addedBytes != 0 {
+		return saved, addUsage(ctx, rdb, addedBytes, addedEpisodes)
+	}
+
+	return saved, nil
+}
+
+// mergeRecord keeps what a new plan of a cached episode does not know: that
+// it was played and, while its files are the same, that they were copied.
+func mergeRecord(stored, planned models.EpisodeCache) models.EpisodeCache {
+	planned.Played = planned.Played || stored.Played
+
+	if stored.Copied && samePaths(stored.Files(), planned.Files()) {
+		planned.SetFiles(stored.Files())
+		planned.Sources = stored.Sources
+		planned.SidecarSize = stored.SidecarSize
+		planned.Copied = true
+	}
+
+	return planned
+}
+
+func samePaths(a, b []models.CachedFile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Path != b[i].Path {
+			return false
+		}
 	}
 
-	return nil
+	return true
 }
@@ -0,0 +1,92 @@
+package redisH
+
+import (
+	"os"
+	"testing"
+
+	"plexcache/models"
+	"plexcache/redis/redistest"
+)
+
+func TestExpiringRemovesEveryPart(t *testing.T) {
+	mr := redistest.NewServer(t)
+	mr.SetNotifyKeyspaceEvents("")
+	rdb := mr.Client(t)
+	root := t.TempDir()
+
+	episode := models.EpisodeCache{
+		RatingKey:       "204",
+		EpisodeFilePath: "/S02E04 - pt1.mkv",
+		Size:            10,
+		Parts:           []models.CachedFile{{Path: "/S02E04 - pt2.mkv", Size: 5}},
+	}
+	for _, file := range episode.Files() {
+		if err := os.WriteFile(root+file.Path, make([]byte, file.Size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := SaveEpisodeCacheToRedis(t.Context(), rdb, []models.EpisodeCache{episode}); err != nil {
+		t.Fatal(err)
+	}
+	if usage, _ := GetUsage(t.Context(), rdb); usage.Bytes != 15 {
+		t.Fatalf("got %d bytes in use, want both parts", usage.Bytes)
+	}
+
+	mr.FastForward(CacheTTL)
+	if err := expireOrphans(t.Context(), rdb, root, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range episode.Files() {
+		if _, err := os.Stat(root + file.Path); !os.IsNotExist(err) {
+			t.Fatalf("%s was not removed", file.Path)
+		}
+	}
+	if usage, _ := GetUsage(t.Context(), rdb); usage.Bytes != 0 || usage.WastedBytes != 15 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+}
+
+func TestExpiringKeepsFilesOfOtherServers(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+	root := t.TempDir()
+
+	SetSharedFiles(true)
+	t.Cleanup(func() { SetSharedFiles(false) })
+
+	first := models.EpisodeCache{Server: "first", RatingKey: "204", EpisodeFilePath: "/S02E04.mkv", Size: 10}
+	second := first
+	second.Server = "second"
+
+	if err := os.WriteFile(root+first.EpisodeFilePath, make([]byte, first.Size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, episode := range []models.EpisodeCache{first, second} {
+		if _, err := SaveEpisodeCacheToRedis(t.Context(), rdb, []models.EpisodeCache{episode}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if usage, _ := GetUsage(t.Context(), rdb); usage.Bytes != 10 || usage.Episodes != 2 {
+		t.Fatalf("got %+v, want the shared file counted once", usage)
+	}
+
+	expireRecord(t.Context(), rdb, root, false, recordKey(first.Server, first.RatingKey))
+
+	if _, err := os.Stat(root + first.EpisodeFilePath); err != nil {
+		t.Fatalf("file of the second server was removed: %v", err)
+	}
+	if usage, _ := GetUsage(t.Context(), rdb); usage.Bytes != 10 || usage.Episodes != 1 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+
+	expireRecord(t.Context(), rdb, root, false, recordKey(second.Server, second.RatingKey))
+
+	if _, err := os.Stat(root + first.EpisodeFilePath); !os.IsNotExist(err) {
+		t.Fatal("file was not removed with its last record")
+	}
+	if usage, _ := GetUsage(t.Context(), rdb); usage.Bytes != 0 || usage.Episodes != 0 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+}
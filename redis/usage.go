@@ -0,0 +1,54 @@
+package redisH
+
+import (
+	"context"
+	"plexcache/models"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func usageKey() string {
+	return key("usage")
+}
+
+// updateUsage adds to the byte and episode counters and raises the peak in
+// one step, so concurrent webhooks and expiries never lower it.
+var updateUsage = redis.NewScript(`
+local bytes = redis.call("hincrby", KEYS[1], "bytes", ARGV[1])
+local episodes = tonumber(ARGV[2])
+redis.call("hincrby", KEYS[1], "episodes", episodes)
+if episodes > 0 then
+	redis.call("hincrby", KEYS[1], "copies", episodes)
+elseif episodes < 0 then
+	redis.call("hincrby", KEYS[1], "removals", -episodes)
+end
+if bytes > tonumber(redis.call("hget", KEYS[1], "peakBytes") or "0") then
+	redis.call("hset", KEYS[1], "peakBytes", bytes)
+end
+return bytes`)
+
+// addUsage adjusts the cache usage counters when episodes are cached or
+// expire, keeping track of the peak number of bytes.
+func addUsage(ctx context.Context, rdb *redis.Client, bytes int64, episodes int64) error {
+	return updateUsage.Run(ctx, rdb, []string{usageKey()}, bytes, episodes).Err()
+}
+
+func GetUsage(ctx context.Context, rdb *redis.Client) (models.Usage, error) {
+	var usage models.Usage
+
+	values, err := rdb.HGetAll(ctx, usageKey()).Result()
+	if err != nil {
+		return usage, err
+	}
+
+	usage.Bytes, _ = strconv.ParseInt(values["bytes"], 10, 64)
+	usage.PeakBytes, _ = strconv.ParseInt(values["peakBytes"], 10, 64)
+	usage.Episodes, _ = strconv.ParseInt(values["episodes"], 10, 64)
+	usage.Copies, _ = strconv.ParseInt(values["copies"], 10, 64)
+	usage.Removals, _ = strconv.ParseInt(values["removals"], 10, 64)
+	usage.Wasted, _ = strconv.ParseInt(values["wasted"], 10, 64)
+	usage.WastedBytes, _ = strconv.ParseInt(values["wastedBytes"], 10, 64)
+
+	return usage, nil
+}
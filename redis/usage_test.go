@@ -0,0 +1,57 @@
+package redisH
+
+import (
+	"sync"
+	"testing"
+
+	"plexcache/redis/redistest"
+)
+
+func TestAddUsage(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	for _, change := range []struct{ bytes, episodes int64 }{
+		{100, 2},
+		{50, 1},
+		{-120, -2},
+		{10, 0},
+	} {
+		if err := addUsage(t.Context(), rdb, change.bytes, change.episodes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage, err := GetUsage(t.Context(), rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes != 40 || usage.PeakBytes != 150 || usage.Episodes != 1 || usage.Copies != 3 || usage.Removals != 2 {
+		t.Fatalf("got %+v", usage)
+	}
+}
+
+func TestAddUsageConcurrently(t *testing.T) {
+	mr := redistest.NewServer(t)
+	rdb := mr.Client(t)
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := addUsage(t.Context(), rdb, 10, 1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	usage, err := GetUsage(t.Context(), rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes != 500 || usage.PeakBytes != 500 || usage.Copies != 50 {
+		t.Fatalf("got %+v", usage)
+	}
+}
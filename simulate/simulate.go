@@ -0,0 +1,225 @@
+package simulate
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"plexcache/api"
+	"plexcache/models"
+	"plexcache/policy"
+	redisH "plexcache/redis"
+)
+
+// Event is one recorded webhook. Log lines are either an Event or a bare
+// payload, bare payloads are spaced a minute apart.
+type Event struct {
+	At      time.Time      `json:"at"`
+	Payload models.Payload `json:"payload"`
+}
+
+// Snapshot maps a season's ParentRatingKey to its recorded metadata.
+type Snapshot map[string]models.SeasonMetadataResponse
+
+type Result struct {
+	Policy      string  `json:"policy"`
+	Events      int     `json:"events"`
+	Plays       int     `json:"plays"`
+	Hits        int     `json:"hits"`
+	HitRate     float64 `json:"hitRate"`
+	Copies      int     `json:"copies"`
+	BytesCopied int64   `json:"bytesCopied"`
+	PeakBytes   int64   `json:"peakBytes"`
+	Evictions   int     `json:"evictions"`
+	Wasted      int     `json:"wasted"`
+	NoSpace     int     `json:"noSpace"`
+	Errors      int     `json:"errors"`
+}
+
+func LoadEvents(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []Event
+	var last time.Time
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1<<20), 10<<20)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		if event.Payload.Event == "" {
+			if err := json.Unmarshal(scanner.Bytes(), &event.Payload); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+		}
+
+		if event.At.IsZero() {
+			event.At = last.Add(time.Minute)
+		}
+		last = event.At
+
+		events = append(events, event)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.Before(events[j].At) })
+
+	return events, scanner.Err()
+}
+
+func LoadSnapshot(path string) (Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	return snapshot, json.Unmarshal(data, &snapshot)
+}
+
+type entry struct {
+	episode   models.EpisodeCache
+	expiresAt time.Time
+}
+
+// virtualCache stands in for redis and the cache drive, implementing
+// api.Lookup for the planner.
+type virtualCache struct {
+	capacity int64
+	used     int64
+	entries  map[string]*entry
+	history  map[string]models.ShowHistory
+	snapshot Snapshot
+}
+
+func (v *virtualCache) CachedEpisode(_ context.Context, ratingKey string) (models.EpisodeCache, bool, error) {
+	e, ok := v.entries[ratingKey]
+	if !ok {
+		return models.EpisodeCache{}, false, nil
+	}
+	return e.episode, true, nil
+}
+
+func historyKey(payload models.Payload) string {
+	return fmt.Sprintf("%d:%s", payload.Account.ID, payload.Metadata.GrandparentRatingKey)
+}
+
+func (v *virtualCache) ShowHistory(_ context.Context, payload models.Payload) (models.ShowHistory, error) {
+	return v.history[historyKey(payload)], nil
+}
+
+func (v *virtualCache) SeasonMetadata(_ context.Context, payload models.Payload) (models.SeasonMetadataResponse, error) {
+	season, ok := v.snapshot[payload.Metadata.ParentRatingKey]
+	if !ok {
+		return season, fmt.Errorf("no metadata for season %s in snapshot", payload.Metadata.ParentRatingKey)
+	}
+	return season, nil
+}
+
+func (v *virtualCache) FreeSpace() (uint64, error) {
+	return uint64(max(v.capacity-v.used, 0)), nil
+}
+
+func (v *virtualCache) expire(now time.Time, result *Result) {
+	for key, e := range v.entries {
+		if e.expiresAt.After(now) {
+			continue
+		}
+
+		v.used -= e.episode.TotalSize()
+		result.Evictions++
+		if !e.episode.Played {
+			result.Wasted++
+		}
+		delete(v.entries, key)
+	}
+}
+
+// Run replays events through the planner with a cache of capacity bytes,
+// mirroring what WebhookHandler and SubscribeToExpired do with the plan.
+func Run(name string, pol *policy.Policy, events []Event, snapshot Snapshot, capacity int64) Result {
+	result := Result{Policy: name, Events: len(events)}
+	cache := &virtualCache{
+		capacity: capacity,
+		entries:  map[string]*entry{},
+		history:  map[string]models.ShowHistory{},
+		snapshot: snapshot,
+	}
+
+	planner := api.Planner{Policy: pol, CacheRoot: "/cache", Lookup: cache}
+
+	for _, event := range events {
+		payload := event.Payload
+		cache.expire(event.At, &result)
+
+		isPlayback := (payload.Event == "media.play" || payload.Event == "media.resume") &&
+			payload.Metadata.LibrarySectionType == "show"
+
+		if isPlayback {
+			result.Plays++
+			if e, ok := cache.entries[payload.Metadata.RatingKey]; ok && e.episode.Copied {
+				result.Hits++
+				e.episode.Played = true
+			}
+		}
+
+		plan, err := planner.Plan(context.Background(), payload)
+
+		if payload.Event == "media.play" && payload.Metadata.LibrarySectionType == "show" {
+			h := cache.history[historyKey(payload)]
+			h.Plays++
+			h.LastIndex = payload.Metadata.Index
+			h.ParentIndex = payload.Metadata.ParentIndex
+			cache.history[historyKey(payload)] = h
+		}
+
+		if err != nil {
+			result.Errors++
+			continue
+		}
+
+		if !plan.Cache {
+			if plan.NoSpace {
+				result.NoSpace++
+			}
+			continue
+		}
+
+		for _, episode := range plan.Episodes {
+			// planned again, the record keeps being played like in redis
+			if old, ok := cache.entries[episode.RatingKey]; ok {
+				cache.used += episode.TotalSize() - old.episode.TotalSize()
+				episode.Played = old.episode.Played
+			} else {
+				cache.used += episode.TotalSize()
+				result.Copies++
+				result.BytesCopied += episode.TotalSize()
+			}
+
+			episode.Copied = true
+			cache.entries[episode.RatingKey] = &entry{episode: episode, expiresAt: event.At.Add(redisH.CacheTTL)}
+		}
+
+		result.PeakBytes = max(result.PeakBytes, cache.used)
+	}
+
+	if result.Plays > 0 {
+		result.HitRate = float64(result.Hits) / float64(result.Plays)
+	}
+
+	return result
+}
@@ -0,0 +1,40 @@
+package simulate
+
+import (
+	"testing"
+
+	"plexcache/plex/plextest"
+	"plexcache/policy"
+)
+
+func TestRun(t *testing.T) {
+	events, err := LoadEvents("testdata/events.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := Snapshot{"200": plextest.Season(t, "200")}
+
+	got := Run("default", policy.Default(), events, snapshot, 10000)
+
+	want := Result{
+		Policy: "default",
+		Events: 6,
+		// episode 3 and twice episode 6, cached by the play of episode 2
+		Plays:   6,
+		Hits:    3,
+		HitRate: 0.5,
+		// episodes 3 to 6, 7 and 8, planned again by the resume of episode
+		// 6 without growing the cache, and 8 again after expiring
+		Copies:      7,
+		BytesCopied: 1203 + 1204 + 1205 + 1206 + 1207 + 1208 + 1208,
+		PeakBytes:   1203 + 1204 + 1205 + 1206 + 1207 + 1208,
+		// episodes 4, 5, 7 and 8 were never played
+		Evictions: 6,
+		Wasted:    4,
+		// episodes 3 to 6 again for the resume of episode 2
+		NoSpace: 1,
+	}
+	if got != want {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+}
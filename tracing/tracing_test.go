@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"plexcache/tracing/tracingtest"
+)
+
+func TestSetupExportsToCollector(t *testing.T) {
+	collector := tracingtest.NewCollector(t)
+
+	shutdown, err := Setup(t.Context(), collector.Endpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, parent := Start(t.Context(), "parent", attribute.String("ratingKey", "202"))
+	_, child := Start(ctx, "child")
+	End(child, errors.New("copy failed"))
+	End(parent, nil)
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	parents, children := collector.Named("parent"), collector.Named("child")
+	if len(parents) != 1 || len(children) != 1 {
+		t.Fatalf("got spans %+v", collector.Spans())
+	}
+	if parents[0].Attributes["ratingKey"] != "202" {
+		t.Fatalf("got attributes %v", parents[0].Attributes)
+	}
+	if children[0].ParentSpanID != parents[0].SpanID || children[0].TraceID != parents[0].TraceID {
+		t.Fatal("child is not in the trace of its parent")
+	}
+	if children[0].Error != "copy failed" {
+		t.Fatalf("got error %q", children[0].Error)
+	}
+
+	// after shutdown spans are dropped again
+	_, span := Start(t.Context(), "late")
+	span.End()
+	if span.SpanContext().IsValid() {
+		t.Fatal("span recorded after shutdown")
+	}
+}
+
+func TestOffByDefault(t *testing.T) {
+	shutdown, err := Setup(t.Context(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(context.Background())
+
+	if _, span := Start(t.Context(), "dropped"); span.SpanContext().IsValid() {
+		t.Fatal("tracing should be off without an endpoint")
+	}
+}
@@ -0,0 +1,141 @@
+package tracingtest
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Span is a span as received by the Collector.
+type Span struct {
+	Name         string
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Attributes   map[string]any
+	// Error is the status message of a span that failed.
+	Error string
+}
+
+// Collector is an in-process OTLP/HTTP collector keeping the spans it
+// receives.
+type Collector struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	spans []Span
+}
+
+func NewCollector(t *testing.T) *Collector {
+	t.Helper()
+
+	c := &Collector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(c.export))
+	t.Cleanup(c.Close)
+
+	return c
+}
+
+// Endpoint is the traces URL to pass to tracing.Setup.
+func (c *Collector) Endpoint() string {
+	return c.URL + "/v1/traces"
+}
+
+func (c *Collector) export(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = gz
+	}
+
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(raw, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	for _, resourceSpans := range req.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, span := range scopeSpans.Spans {
+				c.spans = append(c.spans, convert(span))
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(resp)
+}
+
+func convert(span *tracepb.Span) Span {
+	converted := Span{
+		Name:         span.Name,
+		TraceID:      hex.EncodeToString(span.TraceId),
+		SpanID:       hex.EncodeToString(span.SpanId),
+		ParentSpanID: hex.EncodeToString(span.ParentSpanId),
+		Attributes:   map[string]any{},
+	}
+
+	if span.Status != nil && span.Status.Code == tracepb.Status_STATUS_CODE_ERROR {
+		converted.Error = span.Status.Message
+	}
+
+	for _, kv := range span.Attributes {
+		converted.Attributes[kv.Key] = value(kv.Value)
+	}
+
+	return converted
+}
+
+func value(v *commonpb.AnyValue) any {
+	switch v := v.Value.(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_IntValue:
+		return v.IntValue
+	case *commonpb.AnyValue_BoolValue:
+		return v.BoolValue
+	case *commonpb.AnyValue_DoubleValue:
+		return v.DoubleValue
+	}
+	return nil
+}
+
+// Spans returns the spans received so far.
+func (c *Collector) Spans() []Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Span(nil), c.spans...)
+}
+
+// Named returns the spans received so far called name.
+func (c *Collector) Named(name string) []Span {
+	var named []Span
+	for _, span := range c.Spans() {
+		if span.Name == name {
+			named = append(named, span)
+		}
+	}
+	return named
+}
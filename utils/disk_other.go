@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package utils
+
+import "errors"
+
+func FreeSpace(path string) (uint64, error) {
+	return 0, errors.New("free space is not supported on this platform")
+}
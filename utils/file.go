@@ -1,34 +1,156 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	s "strings"
+
+	"plexcache/tracing"
+
+	"github.com/cespare/xxhash/v2"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func CopyFile(src, dst string) error {
+// PartialSuffix marks a copy in progress. Copies are renamed to their name
+// once complete, so mergerfs never serves a partial file.
+const PartialSuffix = ".plex-cache-partial"
+
+// Copy describes a completed copy.
+type Copy struct {
+	Bytes int64
+	// Hash is the xxhash of what was written, see HashFile.
+	Hash string
+}
+
+// copyChunkSize is how much is copied between checks for cancellation.
+const copyChunkSize = 1 << 20
+
+// copyChunks copies in to out in chunks and stops between chunks once ctx
+// is done. It returns how many bytes were written and their hash.
+func copyChunks(ctx context.Context, out io.Writer, in io.Reader) (Copy, error) {
+	buf := make([]byte, copyChunkSize)
+	h := xxhash.New()
+	var written int64
+	result := func() Copy { return Copy{Bytes: written, Hash: hashString(h.Sum64())} }
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return result(), err
+		}
+
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			if _, err := out.Write(buf[:n]); err != nil {
+				return result(), err
+			}
+			h.Write(buf[:n])
+			written += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return result(), nil
+		}
+		if err != nil {
+			return result(), err
+		}
+	}
+}
+
+// CopyFileContext copies src to dst through a partial file that is removed
+// when the copy fails or ctx is cancelled, which is noticed within a chunk.
+// The copy is hashed while it is written, and fails when it has another
+// size than src had when it was opened.
+func CopyFileContext(ctx context.Context, src, dst string) (copied Copy, err error) {
+	ctx, span := tracing.Start(ctx, "CopyFile", attribute.String("src", src), attribute.String("dst", dst))
+	defer func() { tracing.End(span, err) }()
+
 	in, err := os.Open(src)
 	if err != nil {
-		return err
+		return copied, err
 	}
 	defer in.Close()
 
+	info, err := in.Stat()
+	if err != nil {
+		return copied, err
+	}
+
 	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
-		return err
+		return copied, err
 	}
 
-	out, err := os.Create(dst)
+	partial := dst + PartialSuffix
+	out, err := os.Create(partial)
 	if err != nil {
-		return err
+		return copied, err
 	}
-	defer out.Close()
 
-	if _, err = io.Copy(out, in); err != nil {
-		return err
+	copied, err = copyChunks(ctx, out, in)
+	span.SetAttributes(attribute.Int64("bytes", copied.Bytes), attribute.String("hash", copied.Hash))
+	if err == nil && copied.Bytes != info.Size() {
+		err = fmt.Errorf("copied %d bytes of %s, which has %d", copied.Bytes, src, info.Size())
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(partial, dst)
+	}
+
+	if err != nil {
+		os.Remove(partial)
+		return copied, err
+	}
+
+	return copied, nil
+}
+
+func hashString(sum uint64) string {
+	return fmt.Sprintf("%016x", sum)
+}
+
+// HashFile is the xxhash of a whole file, as Copy.Hash.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := xxhash.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
 	}
 
-	return out.Sync()
+	return hashString(h.Sum64()), nil
+}
+
+// RemovePartials removes the partial files below root left behind by a copy
+// that was killed, and returns how many it removed.
+func RemovePartials(root string) (int, error) {
+	removed := 0
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !s.HasSuffix(path, PartialSuffix) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+
+	return removed, err
 }
 
 func RemoveFile(path string) error {
@@ -47,3 +169,41 @@ func RemoveFile(path string) error {
 
 	return os.Remove(path)
 }
+
+// sampleSize is how much of each end of a file SampleHash reads.
+const sampleSize = 1 << 20
+
+// SampleHash is a fast fingerprint of a file: the xxhash of its size and of
+// its first and last MiB. A replaced media file almost always differs in
+// one of them, reading it whole would take as long as copying it.
+func SampleHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	h := xxhash.New()
+	fmt.Fprintf(h, "%d:", info.Size())
+
+	if _, err := io.Copy(h, io.LimitReader(f, sampleSize)); err != nil {
+		return "", err
+	}
+
+	if tail := info.Size() - sampleSize; tail > sampleSize {
+		if _, err := io.Copy(h, io.NewSectionReader(f, tail, sampleSize)); err != nil {
+			return "", err
+		}
+	} else if tail > 0 {
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+	}
+
+	return hashString(h.Sum64()), nil
+}
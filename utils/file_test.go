@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyFileContextCancelled(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.mkv")
+	dst := filepath.Join(dir, "cache", "dst.mkv")
+
+	if err := os.WriteFile(src, make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := CopyFileContext(ctx, src, dst); err == nil {
+		t.Fatal("expected the copy to be cancelled")
+	}
+
+	for _, name := range []string{dst, dst + PartialSuffix} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("%s should not exist", name)
+		}
+	}
+
+	copied, err := CopyFileContext(context.Background(), src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(dst); err != nil || info.Size() != 1<<20 {
+		t.Fatalf("incomplete copy: %v", err)
+	}
+
+	hash, err := HashFile(dst)
+	if err != nil || copied.Bytes != 1<<20 || copied.Hash != hash || len(hash) != 16 {
+		t.Fatalf("copy %+v, hash of the copy %q, %v", copied, hash, err)
+	}
+}
+
+func TestRemovePartials(t *testing.T) {
+	dir := t.TempDir()
+	keep := filepath.Join(dir, "show", "a.mkv")
+	partial := filepath.Join(dir, "show", "b.mkv"+PartialSuffix)
+
+	os.MkdirAll(filepath.Dir(keep), 0755)
+	os.WriteFile(keep, []byte("a"), 0644)
+	os.WriteFile(partial, []byte("b"), 0644)
+
+	removed, err := RemovePartials(dir)
+	if err != nil || removed != 1 {
+		t.Fatalf("removed %d, %v", removed, err)
+	}
+	if _, err := os.Stat(keep); err != nil {
+		t.Fatal("complete copies must be kept")
+	}
+}
+
+func TestSampleHash(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "episode.mkv")
+
+	hash := func() string {
+		t.Helper()
+		h, err := SampleHash(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	data := make([]byte, 3*sampleSize)
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	original := hash()
+
+	// the middle is not sampled
+	data[sampleSize+1] = 1
+	os.WriteFile(name, data, 0644)
+	if hash() != original {
+		t.Fatal("a change in the middle changed the hash")
+	}
+
+	data[len(data)-1] = 1
+	os.WriteFile(name, data, 0644)
+	if hash() == original {
+		t.Fatal("a change at the end did not change the hash")
+	}
+
+	os.WriteFile(name, []byte("short"), 0644)
+	short := hash()
+	os.WriteFile(name, []byte("shorT"), 0644)
+	if hash() == short {
+		t.Fatal("a small file was not hashed whole")
+	}
+}
@@ -0,0 +1,140 @@
+//go:build linux
+
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// watchMask are the inotify events of a file being written, replaced,
+// moved away or removed.
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+
+// Watcher reports changes to the files in a set of directories with
+// inotify. Directories are watched without their subdirectories.
+type Watcher struct {
+	fd   int
+	file *os.File
+
+	mu   sync.Mutex
+	dirs map[int32]string
+	wds  map[string]int32
+}
+
+func NewWatcher() (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	// non-blocking, so Close interrupts Run
+	return &Watcher{fd: fd, file: os.NewFile(uintptr(fd), "inotify"), dirs: map[int32]string{}, wds: map[string]int32{}}, nil
+}
+
+// Watch adds a directory, watching it twice is fine.
+func (w *Watcher) Watch(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.wds[dir]; ok {
+		return nil
+	}
+
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+
+	w.dirs[int32(wd)] = dir
+	w.wds[dir] = int32(wd)
+
+	return nil
+}
+
+// Unwatch removes a directory.
+func (w *Watcher) Unwatch(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	wd, ok := w.wds[dir]
+	if !ok {
+		return nil
+	}
+
+	delete(w.wds, dir)
+	delete(w.dirs, wd)
+
+	if _, err := syscall.InotifyRmWatch(w.fd, uint32(wd)); err != nil && err != syscall.EINVAL {
+		return &os.PathError{Op: "inotify_rm_watch", Path: dir, Err: err}
+	}
+
+	return nil
+}
+
+// Dirs returns the watched directories.
+func (w *Watcher) Dirs() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	dirs := make([]string, 0, len(w.wds))
+	for dir := range w.wds {
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// Run calls changed with the path of every file changed in a watched
+// directory until Close. When the kernel dropped events, changed is called
+// with an empty path: anything may have changed.
+func (w *Watcher) Run(changed func(path string)) error {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		n, err := w.file.Read(buf)
+		if errors.Is(err, os.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			offset = nameStart + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				changed("")
+				continue
+			}
+
+			w.mu.Lock()
+			dir, ok := w.dirs[event.Wd]
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				// the directory is gone
+				delete(w.dirs, event.Wd)
+				delete(w.wds, dir)
+			}
+			w.mu.Unlock()
+
+			if !ok || event.Len == 0 {
+				continue
+			}
+
+			name := buf[nameStart : nameStart+int(event.Len)]
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			changed(filepath.Join(dir, string(name)))
+		}
+	}
+}
+
+func (w *Watcher) Close() error {
+	return w.file.Close()
+}
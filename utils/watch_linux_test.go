@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Watch(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan string, 10)
+	done := make(chan error)
+	go func() { done <- w.Run(func(path string) { changed <- path }) }()
+
+	next := func() string {
+		t.Helper()
+		select {
+		case path := <-changed:
+			return path
+		case <-time.After(5 * time.Second):
+			t.Fatal("no change reported")
+			return ""
+		}
+	}
+
+	file := filepath.Join(dir, "episode.mkv")
+	if err := os.WriteFile(file, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := next(); got != file {
+		t.Fatalf("got %q after a write, want %q", got, file)
+	}
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if got := next(); got != file {
+		t.Fatalf("got %q after a removal, want %q", got, file)
+	}
+
+	if err := w.Unwatch(dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Dirs()) != 0 {
+		t.Fatalf("still watching %q", w.Dirs())
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+}
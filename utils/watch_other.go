@@ -0,0 +1,18 @@
+//go:build !linux
+
+package utils
+
+import "errors"
+
+// Watcher needs inotify, NewWatcher fails on other platforms.
+type Watcher struct{}
+
+func NewWatcher() (*Watcher, error) {
+	return nil, errors.New("file watching is not supported on this platform")
+}
+
+func (w *Watcher) Watch(dir string) error              { return nil }
+func (w *Watcher) Unwatch(dir string) error            { return nil }
+func (w *Watcher) Dirs() []string                      { return nil }
+func (w *Watcher) Run(changed func(path string)) error { return nil }
+func (w *Watcher) Close() error                        { return nil }